@@ -0,0 +1,448 @@
+package main
+
+// 10-web-server.go的Go客户端：把API的HTTP细节封装为带类型的方法，例如ListUsers、CreateUser、UpdatePost
+// 客户端与服务器分开存放，服务器不依赖这个文件，go run 10-web-server.go照常只需要一个文件；
+// 客户端使用服务器文件中的数据模型（User、Post、Problem等），编译和测试时需要把两个文件一起传给go命令：
+// go test 10-web-server.go 10-web-server-client.go 10-web-server-client_test.go
+// 需要单独发布时，可以连同数据模型原样移到独立的client包
+
+import (
+	"bytes"         // 提供字节缓冲区，每次重试重新创建请求体的Reader
+	"context"       // 提供请求上下文，调用方可以设置超时或取消请求
+	"crypto/rand"   // 提供密码学安全的随机数，用于生成Idempotency-Key
+	"encoding/hex"  // 提供十六进制编码，用于表示Idempotency-Key
+	"encoding/json" // 提供JSON序列化和反序列化功能
+	"errors"        // 提供errors.As，testClient用它区分错误类型
+	"fmt"           // 提供格式化输入输出功能
+	"io"            // 提供io.ReadAll，读取完整的响应体
+	"net/http"      // 提供HTTP客户端
+	"net/url"       // 提供URL解析和查询参数编码
+	"os"            // 提供环境变量读取，testClient从API_KEY读取密钥
+	"strconv"       // 提供字符串和整数的转换，用于分页参数和响应头
+	"strings"       // 提供字符串处理，用于解析Link响应头
+	"time"          // 提供超时和重试等待
+)
+
+// Client：本服务API的Go客户端
+// - 每个方法的第一个参数都是context.Context，调用方可以设置超时或随时取消请求
+// - 失败的请求按RetryPolicy自动重试，思路与8-error-handling.go中的retryOperation相同：循环执行，失败则等待后再试，直到达到最大次数
+//   与retryOperation不同的是只重试"重试也安全"的请求（创建请求自动携带Idempotency-Key，因此也可以重试），并且等待时间逐次加倍、遵守服务器的Retry-After
+// - 非2xx响应转换为错误值：422字段校验失败返回*ValidationErrors（其中每一项是*ValidationError），其余返回*NetworkError，
+//   调用方用errors.As区分处理，而不必解析响应体
+
+// NetworkError：请求失败的错误，与8-error-handling.go中的NetworkError相同
+// Code为HTTP状态码；请求没有得到响应（连接失败、超时、被取消）时Code为0，Err保存底层错误
+type NetworkError struct {
+	Code    int    // 网络错误状态码（如404、500等），没有收到响应时为0
+	Message string // 错误描述，取自响应中problem+json的detail或底层错误
+	URL     string // 发生错误的URL地址
+	Err     error  // 没有收到响应时的底层错误，可以用errors.Is判断是否为context.DeadlineExceeded等
+}
+
+// Error()方法：实现error接口
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("网络错误 %d: %s (URL: %s)", e.Code, e.Message, e.URL)
+}
+
+// Unwrap：返回底层错误，使errors.Is和errors.As能够继续检查
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy：客户端的重试策略
+type RetryPolicy struct {
+	MaxAttempts int           // 最多尝试的次数（包括第一次），小于等于1表示不重试
+	BaseDelay   time.Duration // 第一次重试前的等待时间，之后每次加倍
+	MaxDelay    time.Duration // 单次等待时间的上限，也限制服务器Retry-After要求的等待时间
+}
+
+// defaultRetryPolicy：NewClient使用的默认重试策略，最多尝试3次，等待200ms、400ms
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// delay：第attempt次（从1开始）失败后、下一次尝试之前的等待时间
+// retryAfter是响应中的Retry-After请求头（秒数），存在时优先使用
+func (p RetryPolicy) delay(attempt int, retryAfter string) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		d = time.Duration(seconds) * time.Second
+	}
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d < 0) {
+		d = p.MaxDelay // d < 0：移位溢出
+	}
+	return d
+}
+
+// Client：API客户端，字段可以在NewClient之后按需修改；多个goroutine可以共享同一个Client
+type Client struct {
+	BaseURL    string       // 服务器地址，例如"http://localhost:8080"
+	APIKey     string       // API密钥，写操作需要；为空时只能调用公开的读接口
+	HTTPClient *http.Client // 发送请求使用的HTTP客户端
+	Retry      RetryPolicy  // 重试策略
+}
+
+// NewClient：创建客户端，使用默认的重试策略和30秒的请求超时
+func NewClient(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Retry:      defaultRetryPolicy,
+	}
+}
+
+// ListOptions：列表接口的分页、排序和过滤参数，零值表示使用服务器的默认值
+type ListOptions struct {
+	Limit  int        // 每页条数
+	Cursor string     // 上一页返回的Page.NextCursor
+	Sort   string     // 排序字段，前缀"-"表示降序
+	Filter url.Values // 其他过滤参数，例如age_min、author_id
+}
+
+// values：转换为URL查询参数
+func (o ListOptions) values() url.Values {
+	query := url.Values{}
+	for key, values := range o.Filter {
+		query[key] = append([]string(nil), values...)
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		query.Set("cursor", o.Cursor)
+	}
+	if o.Sort != "" {
+		query.Set("sort", o.Sort)
+	}
+	return query
+}
+
+// Page：列表接口的一页结果
+type Page[T any] struct {
+	Items      []T    // 本页的记录
+	Total      int    // 符合条件的记录总数（X-Total-Count）
+	NextCursor string // 下一页的游标，为空表示已是最后一页
+}
+
+// clientRequest：一次API调用的请求内容
+type clientRequest struct {
+	method  string
+	path    string
+	query   url.Values
+	ifMatch int         // 大于0时发送If-Match请求头，取值为资源的版本号
+	body    interface{} // 请求体，序列化为JSON；nil表示没有请求体
+
+	idempotencyKey string // 非空时发送Idempotency-Key请求头，所有重试使用同一个键
+}
+
+// idempotent：请求重复执行是否安全
+// GET、PUT、DELETE按HTTP语义是幂等的；PUT和DELETE还带有If-Match，重复执行时最多得到412，不会重复修改
+// POST会创建新记录，只有携带Idempotency-Key时才能安全重试：服务器重放第一次的响应，而不是再创建一条
+func (req clientRequest) idempotent() bool {
+	return req.method != http.MethodPost || req.idempotencyKey != ""
+}
+
+// newIdempotencyKey：为一次创建请求生成随机的Idempotency-Key
+func newIdempotencyKey() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// do：发送请求并把2xx响应体解码到out（可以为nil），按重试策略处理失败
+// 返回响应头，列表接口需要从中读取总数和下一页的链接
+func (c *Client) do(ctx context.Context, req clientRequest, out interface{}) (http.Header, error) {
+	// 请求体只序列化一次，每次重试重新创建Reader
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+	target := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	attempts := c.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		header, retryable, err := c.send(ctx, req, target, body, out)
+		if err == nil || !retryable || attempt >= attempts {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("已尝试%d次: %w", attempt, err)
+			}
+			return header, err
+		}
+
+		// 等待后重试；等待期间ctx被取消则立即返回
+		timer := time.NewTimer(c.Retry.delay(attempt, header.Get("Retry-After")))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return header, err
+		case <-timer.C:
+		}
+	}
+}
+
+// send：发送一次请求
+// 返回值retryable表示这次失败是否值得重试：
+// - 429：请求被限流中间件拒绝，处理器根本没有执行，任何方法都可以重试
+// - 502、503、504和没有收到响应：服务器可能已经处理了请求，只重试幂等的请求
+// - 其他4xx是请求本身的问题，重试也不会成功
+func (c *Client) send(ctx context.Context, req clientRequest, target string, body []byte, out interface{}) (http.Header, bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target, reader)
+	if err != nil {
+		return nil, false, err
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	if req.ifMatch > 0 {
+		httpReq.Header.Set("If-Match", versionETag(req.ifMatch))
+	}
+	if req.idempotencyKey != "" {
+		httpReq.Header.Set(idempotencyHeader, req.idempotencyKey)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		// ctx被取消或超时不再重试
+		return nil, req.idempotent() && ctx.Err() == nil, &NetworkError{Message: err.Error(), URL: target, Err: err}
+	}
+	// 读完并关闭响应体：只有读到末尾的连接才会被放回连接池复用
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.Header, req.idempotent() && ctx.Err() == nil, &NetworkError{Code: resp.StatusCode, Message: "读取响应失败: " + err.Error(), URL: target, Err: err}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if out != nil && len(data) > 0 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return resp.Header, false, fmt.Errorf("解析响应失败: %w", err)
+			}
+		}
+		return resp.Header, false, nil
+	}
+
+	// 409且带有Retry-After：相同Idempotency-Key的第一次请求仍在处理，稍后重试即可拿到它的响应
+	retryable := resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusConflict && req.idempotencyKey != "" && resp.Header.Get("Retry-After") != "" ||
+		req.idempotent() && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout)
+	return resp.Header, retryable, responseError(resp, data, target)
+}
+
+// responseError：把非2xx响应转换为错误值
+// 422且列出了无效字段时返回*ValidationErrors，字段名与服务器校验时使用的JSON字段名一致；其余返回*NetworkError
+func responseError(resp *http.Response, data []byte, target string) error {
+	var problem Problem
+	json.Unmarshal(data, &problem) // 响应不是problem+json时（例如代理返回的HTML错误页）problem保持零值
+	if resp.StatusCode == http.StatusUnprocessableEntity && len(problem.Errors) > 0 {
+		errs := &ValidationErrors{}
+		for _, field := range problem.Errors {
+			errs.Add(field.Field, field.Message)
+		}
+		return errs
+	}
+
+	message := problem.Detail
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return &NetworkError{Code: resp.StatusCode, Message: message, URL: target}
+}
+
+// listPage：请求列表接口，从响应头中读取总数和下一页的游标
+// Go的方法不能有类型参数，因此写成泛型函数，由ListUsers、ListPosts调用
+func listPage[T any](ctx context.Context, c *Client, path string, opts ListOptions) (Page[T], error) {
+	page := Page[T]{Items: []T{}}
+	header, err := c.do(ctx, clientRequest{method: http.MethodGet, path: path, query: opts.values()}, &page.Items)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	page.Total, _ = strconv.Atoi(header.Get("X-Total-Count"))
+	page.NextCursor = nextCursor(header.Get("Link"))
+	return page, nil
+}
+
+// nextCursor：从Link响应头中取出rel="next"链接的cursor参数，没有下一页时返回空字符串
+func nextCursor(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		target, params, ok := strings.Cut(part, ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return ""
+		}
+		return u.Query().Get("cursor")
+	}
+	return ""
+}
+
+// Health：查询服务器是否就绪（GET /readyz）
+// 服务器未就绪时返回Code为503的*NetworkError
+func (c *Client) Health(ctx context.Context) (*HealthReport, error) {
+	var health HealthReport
+	if _, err := c.do(ctx, clientRequest{method: http.MethodGet, path: "/readyz"}, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// ListUsers：获取一页用户（GET /users）
+func (c *Client) ListUsers(ctx context.Context, opts ListOptions) (Page[User], error) {
+	return listPage[User](ctx, c, "/users", opts)
+}
+
+// GetUser：获取单个用户（GET /users/{id}），用户不存在时返回Code为404的*NetworkError
+func (c *Client) GetUser(ctx context.Context, id int) (User, error) {
+	var user User
+	_, err := c.do(ctx, clientRequest{method: http.MethodGet, path: fmt.Sprintf("/users/%d", id)}, &user)
+	return user, err
+}
+
+// CreateUser：创建用户（POST /users），返回服务器分配了ID的用户
+// 请求携带自动生成的Idempotency-Key，因此超时后的重试不会创建重复的用户
+func (c *Client) CreateUser(ctx context.Context, user User) (User, error) {
+	var created User
+	_, err := c.do(ctx, clientRequest{method: http.MethodPost, path: "/users", body: user, idempotencyKey: newIdempotencyKey()}, &created)
+	return created, err
+}
+
+// UpdateUser：整体替换用户（PUT /users/{id}）
+// user.Version必须是读取时的版本号，用户已被其他请求修改时返回Code为412的*NetworkError
+func (c *Client) UpdateUser(ctx context.Context, user User) (User, error) {
+	var updated User
+	_, err := c.do(ctx, clientRequest{method: http.MethodPut, path: fmt.Sprintf("/users/%d", user.ID), ifMatch: user.Version, body: user}, &updated)
+	return updated, err
+}
+
+// DeleteUser：删除用户（DELETE /users/{id}）
+// policy指定名下帖子的处理方式，零值表示使用服务器配置的策略
+func (c *Client) DeleteUser(ctx context.Context, id, version int, policy UserDeletePolicy) error {
+	query := url.Values{}
+	if policy.Mode != "" {
+		query.Set("posts", policy.Mode)
+	}
+	if policy.ReassignTo > 0 {
+		query.Set("reassign_to", strconv.Itoa(policy.ReassignTo))
+	}
+	_, err := c.do(ctx, clientRequest{method: http.MethodDelete, path: fmt.Sprintf("/users/%d", id), query: query, ifMatch: version}, nil)
+	return err
+}
+
+// RestoreUser：从回收站恢复用户（POST /users/{id}:restore），需要trash:admin权限
+func (c *Client) RestoreUser(ctx context.Context, id int) (User, error) {
+	var user User
+	_, err := c.do(ctx, clientRequest{method: http.MethodPost, path: fmt.Sprintf("/users/%d:restore", id)}, &user)
+	return user, err
+}
+
+// ListPosts：获取一页帖子（GET /posts）
+func (c *Client) ListPosts(ctx context.Context, opts ListOptions) (Page[Post], error) {
+	return listPage[Post](ctx, c, "/posts", opts)
+}
+
+// GetPost：获取单个帖子（GET /posts/{id}）
+func (c *Client) GetPost(ctx context.Context, id int) (Post, error) {
+	var post Post
+	_, err := c.do(ctx, clientRequest{method: http.MethodGet, path: fmt.Sprintf("/posts/%d", id)}, &post)
+	return post, err
+}
+
+// CreatePost：创建帖子（POST /posts），与CreateUser一样携带Idempotency-Key
+func (c *Client) CreatePost(ctx context.Context, post Post) (Post, error) {
+	var created Post
+	_, err := c.do(ctx, clientRequest{method: http.MethodPost, path: "/posts", body: post, idempotencyKey: newIdempotencyKey()}, &created)
+	return created, err
+}
+
+// UpdatePost：整体替换帖子（PUT /posts/{id}），post.Version必须是读取时的版本号
+func (c *Client) UpdatePost(ctx context.Context, post Post) (Post, error) {
+	var updated Post
+	_, err := c.do(ctx, clientRequest{method: http.MethodPut, path: fmt.Sprintf("/posts/%d", post.ID), ifMatch: post.Version, body: post}, &updated)
+	return updated, err
+}
+
+// DeletePost：删除帖子（DELETE /posts/{id}）
+func (c *Client) DeletePost(ctx context.Context, id, version int) error {
+	_, err := c.do(ctx, clientRequest{method: http.MethodDelete, path: fmt.Sprintf("/posts/%d", id), ifMatch: version}, nil)
+	return err
+}
+
+// RestorePost：从回收站恢复帖子（POST /posts/{id}:restore），作者仍在回收站中时返回Code为409的*NetworkError
+func (c *Client) RestorePost(ctx context.Context, id int) (Post, error) {
+	var post Post
+	_, err := c.do(ctx, clientRequest{method: http.MethodPost, path: fmt.Sprintf("/posts/%d:restore", id)}, &post)
+	return post, err
+}
+
+// Trash：查看回收站（GET /trash），需要trash:admin权限
+func (c *Client) Trash(ctx context.Context) (Trash, error) {
+	var trash Trash
+	_, err := c.do(ctx, clientRequest{method: http.MethodGet, path: "/trash"}, &trash)
+	return trash, err
+}
+
+// SearchPosts：全文搜索帖子（GET /posts/search），limit为0时使用服务器的默认值
+func (c *Client) SearchPosts(ctx context.Context, q string, limit int) ([]SearchHit, error) {
+	query := url.Values{"q": {q}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	hits := []SearchHit{}
+	_, err := c.do(ctx, clientRequest{method: http.MethodGet, path: "/posts/search", query: query}, &hits)
+	return hits, err
+}
+
+// testClient：用客户端调用正在运行的服务器，演示错误的分类处理
+// 用法：先启动服务器，再在另一个程序中调用testClient
+func testClient() {
+	fmt.Println("\n=== 客户端测试 ===")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := NewClient("http://localhost:8080", os.Getenv("API_KEY"))
+
+	// 测试健康检查API
+	health, err := client.Health(ctx)
+	if err != nil {
+		fmt.Printf("请求失败: %v\n", err)
+		return
+	}
+	fmt.Printf("健康检查: %s（版本 %s）\n", health.Status, health.Version)
+
+	// 测试获取用户列表API
+	page, err := client.ListUsers(ctx, ListOptions{Limit: 10, Sort: "id"})
+	if err != nil {
+		fmt.Printf("请求失败: %v\n", err)
+		return
+	}
+	fmt.Printf("获取用户: 共%d个，本页%d个\n", page.Total, len(page.Items))
+
+	// 提交无效数据，用errors.As区分校验错误和其他错误
+	_, err = client.CreateUser(ctx, User{Name: "", Email: "invalid"})
+	var validationErrs *ValidationErrors
+	var networkErr *NetworkError
+	switch {
+	case errors.As(err, &validationErrs):
+		for _, fieldErr := range validationErrs.Errors {
+			fmt.Printf("校验错误: %v\n", fieldErr)
+		}
+	case errors.As(err, &networkErr):
+		fmt.Printf("请求失败 - 代码: %d, 消息: %s\n", networkErr.Code, networkErr.Message) // 例如没有设置API_KEY时为401
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+// 10-web-server-client.go的测试：错误的分类和重试策略
+// 测试服务器用httptest按需返回各种状态码，不启动真正的API服务器：
+// go test 10-web-server.go 10-web-server-client.go 10-web-server-client_test.go
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI：按调用次数返回预设响应的测试服务器，记录每次收到的请求
+type fakeAPI struct {
+	mu       sync.Mutex
+	requests []*http.Request                          // 收到的请求，按顺序
+	respond  func(attempt int, w http.ResponseWriter) // 第attempt次（从1开始）请求的响应
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Clone(context.Background()))
+	attempt := len(f.requests)
+	f.mu.Unlock()
+	f.respond(attempt, w)
+}
+
+// attempts：服务器收到的请求数
+func (f *fakeAPI) attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// newFakeClient：启动fakeAPI并返回指向它的客户端，重试的等待时间缩短到毫秒级
+func newFakeClient(t *testing.T, respond func(attempt int, w http.ResponseWriter)) (*Client, *fakeAPI) {
+	t.Helper()
+	api := &fakeAPI{respond: respond}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "test-key")
+	client.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	return client, api
+}
+
+// respondWith：每次都返回相同的状态码、响应头和响应体
+func respondWith(status int, body string, headers ...string) func(int, http.ResponseWriter) {
+	return func(_ int, w http.ResponseWriter) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// TestClientErrors：422转换为*ValidationErrors，可以用errors.As取出*ValidationError；其他非2xx响应和连接失败转换为*NetworkError
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		respond  func(int, http.ResponseWriter)
+		code     int // 期望的NetworkError.Code，0表示期望ValidationErrors
+		message  string
+		attempts int // 期望服务器收到的请求数
+	}{
+		{
+			name:     "字段校验失败",
+			respond:  respondWith(http.StatusUnprocessableEntity, `{"status": 422, "errors": [{"field": "email", "message": "邮箱格式无效"}]}`),
+			attempts: 1,
+		},
+		{"资源不存在", respondWith(http.StatusNotFound, `{"status": 404, "detail": "用户不存在"}`), http.StatusNotFound, "用户不存在", 1},
+		{"服务器内部错误", respondWith(http.StatusInternalServerError, `{"status": 500, "detail": "服务器内部错误"}`), http.StatusInternalServerError, "服务器内部错误", 1},
+		{"代理返回的HTML错误页", respondWith(http.StatusBadGateway, "<html>bad gateway</html>"), http.StatusBadGateway, "Bad Gateway", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, api := newFakeClient(t, tt.respond)
+			var err error
+			if tt.code == 0 {
+				_, err = client.UpdateUser(context.Background(), User{ID: 1, Version: 1, Email: "invalid"})
+			} else {
+				_, err = client.GetUser(context.Background(), 1)
+			}
+			if api.attempts() != tt.attempts {
+				t.Errorf("服务器收到%d个请求，期望%d个", api.attempts(), tt.attempts)
+			}
+
+			if tt.code == 0 {
+				var fieldErr *ValidationError
+				var networkErr *NetworkError
+				if !errors.As(err, &fieldErr) || fieldErr.Field != "email" || errors.As(err, &networkErr) {
+					t.Fatalf("错误是 %#v，期望email字段的*ValidationError", err)
+				}
+				return
+			}
+			var networkErr *NetworkError
+			if !errors.As(err, &networkErr) {
+				t.Fatalf("错误是 %#v，期望*NetworkError", err)
+			}
+			if networkErr.Code != tt.code || networkErr.Message != tt.message {
+				t.Errorf("NetworkError的Code是 %d、Message是 %q，期望 %d 和 %q", networkErr.Code, networkErr.Message, tt.code, tt.message)
+			}
+		})
+	}
+
+	t.Run("连接失败", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close() // 关闭后的地址拒绝连接
+		client := NewClient(server.URL, "")
+		client.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+		_, err := client.GetUser(context.Background(), 1)
+		var networkErr *NetworkError
+		if !errors.As(err, &networkErr) || networkErr.Code != 0 || networkErr.Err == nil {
+			t.Errorf("错误是 %#v，期望Code为0且带有底层错误的*NetworkError", err)
+		}
+	})
+}
+
+// TestClientRetry：429和503按重试策略重试，等待时间遵守服务器的Retry-After，但不超过MaxDelay
+func TestClientRetry(t *testing.T) {
+	t.Run("503之后成功", func(t *testing.T) {
+		client, api := newFakeClient(t, func(attempt int, w http.ResponseWriter) {
+			if attempt < 3 {
+				respondWith(http.StatusServiceUnavailable, `{"status": 503}`)(attempt, w)
+				return
+			}
+			respondWith(http.StatusOK, `{"id": 1, "name": "张三", "version": 2}`)(attempt, w)
+		})
+		user, err := client.GetUser(context.Background(), 1)
+		if err != nil || user.Name != "张三" || api.attempts() != 3 {
+			t.Errorf("GetUser返回 %+v、%v，服务器收到%d个请求，期望第3次成功", user, err, api.attempts())
+		}
+	})
+
+	t.Run("用完重试次数", func(t *testing.T) {
+		client, api := newFakeClient(t, respondWith(http.StatusServiceUnavailable, `{"status": 503, "detail": "维护中"}`))
+		_, err := client.GetUser(context.Background(), 1)
+		var networkErr *NetworkError
+		if !errors.As(err, &networkErr) || networkErr.Code != http.StatusServiceUnavailable || api.attempts() != 3 {
+			t.Errorf("错误是 %v，服务器收到%d个请求，期望尝试3次后返回503的*NetworkError", err, api.attempts())
+		}
+	})
+
+	t.Run("遵守Retry-After", func(t *testing.T) {
+		client, api := newFakeClient(t, func(attempt int, w http.ResponseWriter) {
+			if attempt == 1 {
+				respondWith(http.StatusTooManyRequests, `{"status": 429}`, "Retry-After", "1")(attempt, w)
+				return
+			}
+			respondWith(http.StatusOK, `{"id": 1}`)(attempt, w)
+		})
+		client.Retry.MaxDelay = 5 * time.Second
+		start := time.Now()
+		if _, err := client.GetUser(context.Background(), 1); err != nil || api.attempts() != 2 {
+			t.Fatalf("GetUser返回 %v，服务器收到%d个请求，期望第2次成功", err, api.attempts())
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("只等待了%v就重试，期望按Retry-After等待1秒", elapsed)
+		}
+	})
+
+	t.Run("Retry-After不超过MaxDelay", func(t *testing.T) {
+		client, api := newFakeClient(t, respondWith(http.StatusTooManyRequests, `{"status": 429}`, "Retry-After", "60"))
+		start := time.Now()
+		client.GetUser(context.Background(), 1)
+		if elapsed := time.Since(start); elapsed > 5*time.Second || api.attempts() != 3 {
+			t.Errorf("耗时%v，服务器收到%d个请求，期望每次最多等待MaxDelay并尝试3次", elapsed, api.attempts())
+		}
+	})
+
+	t.Run("等待期间取消", func(t *testing.T) {
+		client, api := newFakeClient(t, respondWith(http.StatusServiceUnavailable, `{"status": 503}`, "Retry-After", "60"))
+		client.Retry.MaxDelay = time.Minute
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := client.GetUser(ctx, 1); err == nil || api.attempts() != 1 {
+			t.Errorf("GetUser返回 %v，服务器收到%d个请求，期望取消后立即返回", err, api.attempts())
+		}
+	})
+}
+
+// TestClientPostRetry：POST只有携带Idempotency-Key时才在503之后重试，所有重试使用同一个键；429时处理器没有执行，任何请求都可以重试
+func TestClientPostRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		call     func(*Client) error
+		attempts int
+		keyed    bool // 请求是否携带Idempotency-Key
+	}{
+		{"创建用户携带幂等键", http.StatusServiceUnavailable, func(c *Client) error {
+			_, err := c.CreateUser(context.Background(), User{Name: "张三", Email: "zhangsan@example.com", Age: 25})
+			return err
+		}, 3, true},
+		{"创建帖子携带幂等键", http.StatusBadGateway, func(c *Client) error {
+			_, err := c.CreatePost(context.Background(), Post{Title: "标题", Content: "内容", AuthorID: 1})
+			return err
+		}, 3, true},
+		{"没有幂等键的POST不重试", http.StatusServiceUnavailable, func(c *Client) error {
+			_, err := c.RestoreUser(context.Background(), 1)
+			return err
+		}, 1, false},
+		{"没有幂等键的POST在429之后重试", http.StatusTooManyRequests, func(c *Client) error {
+			_, err := c.RestorePost(context.Background(), 1)
+			return err
+		}, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, api := newFakeClient(t, respondWith(tt.status, `{"status": 0}`))
+			if err := tt.call(client); err == nil {
+				t.Fatal("期望返回错误")
+			}
+			if api.attempts() != tt.attempts {
+				t.Fatalf("服务器收到%d个请求，期望%d个", api.attempts(), tt.attempts)
+			}
+			key := api.requests[0].Header.Get(idempotencyHeader)
+			if (key != "") != tt.keyed {
+				t.Fatalf("Idempotency-Key是 %q", key)
+			}
+			for i, req := range api.requests {
+				if got := req.Header.Get(idempotencyHeader); got != key {
+					t.Errorf("第%d次请求的Idempotency-Key是 %q，第1次是 %q", i+1, got, key)
+				}
+			}
+		})
+	}
+}
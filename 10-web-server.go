@@ -1,20 +1,56 @@
 package main
 
 import (
+	"bufio"           // 提供带缓冲的读取，导入NDJSON时逐行扫描请求体
+	"bytes"           // 提供字节缓冲区，用于构造请求体
+	"compress/gzip"   // 提供gzip压缩，静态资源在启动时预压缩
+	"context"         // 提供请求上下文，路由器通过它向处理器传递路径参数
+	"crypto/rand"     // 提供密码学安全的随机数，用于生成API密钥
+	"crypto/sha256"   // 提供SHA-256哈希，API密钥只以哈希形式保存
+	"database/sql"    // 提供通用的SQL数据库接口，SQLite存储基于它实现
+	"embed"           // 提供编译时文件打包，主页模板和静态资源打包进程序
+	"encoding/base64" // 提供Base64编码，用于生成不透明的分页游标
+	"encoding/csv"    // 提供CSV读写，用于批量导入和导出
+	"encoding/hex"    // 提供十六进制编码，用于表示哈希值
 	"encoding/json"   // 提供JSON序列化和反序列化功能，用于处理API的JSON请求和响应
+	"errors"          // 提供错误创建和判断功能（errors.New、errors.Is）
+	"flag"            // 提供命令行参数解析功能，用于在启动时选择存储实现
 	"fmt"             // 提供格式化输入输出功能
+	"html"            // 提供HTML转义，搜索结果的高亮摘要需要转义原文
+	"html/template"   // 提供自动转义的HTML模板，主页由OpenAPI文档渲染而成
+	"io"              // 提供基础I/O接口，如io.Discard、io.Copy
+	"io/fs"           // 提供文件系统抽象，遍历打包的静态资源
 	"log"             // 提供日志记录功能
+	"log/slog"        // 提供结构化日志，访问日志以JSON格式输出
+	"math"            // 提供数学函数，BM25排序需要计算对数
+	"mime"            // 提供扩展名到Content-Type的映射
+	"net"             // 提供IP地址解析功能，限流时用于识别客户端和受信任代理
 	"net/http"        // 提供HTTP服务器和客户端功能，是Go Web开发的核心包
+	"net/url"         // 提供URL和查询参数处理功能
+	"os"              // 提供操作系统功能，如标准错误输出、环境变量、读取配置文件
+	"os/signal"       // 提供信号处理功能，收到Ctrl+C时优雅关闭服务器
+	"path"            // 提供斜杠分隔路径的处理，用于取静态资源的扩展名
+	"reflect"         // 提供反射功能，用于读取结构体的json标签
+	"regexp"          // 提供正则表达式，用于识别批量操作中对之前结果的引用
+	"runtime"         // 提供运行时信息，用于获取处理器函数名
+	"sort"            // 提供排序功能，列表接口需要稳定的返回顺序
 	"strconv"         // 提供字符串和基本数据类型之间的转换功能
 	"strings"         // 提供字符串操作功能
+	"sync"            // 提供互斥锁等同步原语，保证存储在并发请求下的数据安全
+	"syscall"         // 提供系统调用常量，如SIGTERM信号
 	"time"            // 提供时间相关的功能，用于处理时间戳和超时等
+	"unicode"         // 提供字符分类功能，分词时区分字母、数字和中日韩文字
+	"unicode/utf8"    // 提供UTF-8编码处理，生成摘要时按字符而不是字节截取
+
+	// 导入SQLite驱动（与11-database.go相同），只使用其初始化函数注册"sqlite3"驱动
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // Web服务器开发
 // Go语言的HTTP服务器和RESTful API开发
 // 本示例展示了如何使用Go标准库构建一个完整的Web服务器，包括：
 // - 数据模型定义
-// - 内存存储（模拟数据库）
+// - 可插拔的存储层（内存存储 / SQLite持久化存储）
 // - 中间件机制
 // - RESTful API实现
 // - 静态文件服务
@@ -25,511 +61,7460 @@ import (
 // 结构体字段后的`json:"字段名"`是结构体标签（struct tag）
 // 作用：在JSON序列化/反序列化时指定字段名称，实现Go字段名与JSON字段名的映射
 type User struct {
-	ID      int    `json:"id"`       // 用户唯一标识，自增整数
-	Name    string `json:"name"`     // 用户名
-	Email   string `json:"email"`    // 用户邮箱
-	Age     int    `json:"age"`      // 用户年龄
-	Created string `json:"created"`  // 账号创建时间，使用RFC3339格式字符串
+	ID        int    `json:"id"`                                      // 用户唯一标识，自增整数
+	Name      string `json:"name"`                                    // 用户名
+	Email     string `json:"email" format:"email"`                    // 用户邮箱
+	Age       int    `json:"age"`                                     // 用户年龄
+	Created   string `json:"created" format:"date-time"`              // 账号创建时间，使用RFC3339格式字符串
+	Version   int    `json:"version"`                                 // 版本号，创建时为1，每次修改加一，用于生成ETag和检测并发修改
+	DeletedAt string `json:"deleted_at,omitempty" format:"date-time"` // 删除时间，未删除的用户省略该字段；删除后进入回收站，可以恢复
 }
 
 // Post：帖子数据模型，用于表示用户发布的内容
 type Post struct {
-	ID      int    `json:"id"`       // 帖子唯一标识，自增整数
-	Title   string `json:"title"`    // 帖子标题
-	Content string `json:"content"`  // 帖子内容
-	Author  string `json:"author"`   // 作者名称
-	Date    string `json:"date"`     // 发布时间，使用RFC3339格式字符串
+	ID        int    `json:"id"`                                      // 帖子唯一标识，自增整数
+	Title     string `json:"title"`                                   // 帖子标题
+	Content   string `json:"content"`                                 // 帖子内容
+	AuthorID  int    `json:"author_id"`                               // 作者的用户ID，必须指向已存在的用户
+	Date      string `json:"date" format:"date-time"`                 // 发布时间，使用RFC3339格式字符串
+	Version   int    `json:"version"`                                 // 版本号，创建时为1，每次修改加一
+	DeletedAt string `json:"deleted_at,omitempty" format:"date-time"` // 删除时间，未删除的帖子省略该字段
+}
+
+// PostWithAuthor：带作者详情的帖子，请求参数expand=author时返回
+// 嵌入Post使帖子字段在JSON中保持平铺，只是多出一个author对象
+type PostWithAuthor struct {
+	Post
+	Author *User `json:"author,omitempty"` // 作者详情，作者已不存在时省略
+}
+
+// 2. 存储层
+// Store：存储接口，定义处理器需要的全部数据操作
+// 处理器只依赖这个接口，而不关心数据实际保存在哪里
+// 启动时根据命令行参数选择具体实现（内存存储或SQLite存储），这就是"可插拔"的含义
+// 删除是软删除：记录只是被标记上deleted_at并移入回收站，除ListDeleted*、Restore*和PurgeDeleted之外的方法都看不到回收站中的记录
+type Store interface {
+	ListUsers() ([]User, error)                                          // 获取所有用户
+	ListUsersAfter(afterID, limit int) ([]User, error)                   // 按ID升序获取ID大于afterID的至多limit个用户，用于分批导出
+	GetUser(id int) (*User, error)                                       // 根据ID获取用户，不存在时返回ErrNotFound
+	GetUsers(ids []int) ([]User, error)                                  // 根据一组ID获取用户，不存在的ID被忽略，返回顺序不固定
+	CreateUser(user *User) error                                         // 创建用户，由存储负责分配ID，版本号从1开始
+	UpdateUser(user *User) error                                         // 更新用户，user.Version必须等于当前版本，成功后写回新版本号
+	DeleteUser(id, version int, policy UserDeletePolicy) ([]Post, error) // 把用户移入回收站，version必须等于当前版本；名下帖子按policy处理，返回被删除或转移的帖子
+	ListPosts() ([]Post, error)                                          // 获取所有帖子
+	ListPostsByAuthor(authorID int) ([]Post, error)                      // 获取指定作者的帖子
+	GetPost(id int) (*Post, error)                                       // 根据ID获取帖子，不存在时返回ErrNotFound
+	CreatePost(post *Post) error                                         // 创建帖子，由存储负责分配ID，版本号从1开始；作者不存在时返回ErrAuthorNotFound
+	UpdatePost(post *Post) error                                         // 更新帖子，post.Version必须等于当前版本，成功后写回新版本号；作者不存在时返回ErrAuthorNotFound
+	DeletePost(id, version int) error                                    // 把帖子移入回收站，version必须等于当前版本
+	ListDeletedUsers() ([]User, error)                                   // 获取回收站中的用户
+	ListDeletedPosts() ([]Post, error)                                   // 获取回收站中的帖子
+	RestoreUser(id int) (*User, []Post, error)                           // 从回收站恢复用户，以及与它一起级联删除的帖子；用户不在回收站中时返回ErrNotFound
+	RestorePost(id int) (*Post, error)                                   // 从回收站恢复帖子，帖子不在回收站中时返回ErrNotFound，作者不存在（或仍在回收站中）时返回ErrAuthorNotFound
+	PurgeDeleted(before time.Time) (users, posts int, err error)         // 永久删除在before之前进入回收站的记录，返回删除的用户数和帖子数
+	Count(ctx context.Context) (users, posts int, err error)             // 统计不在回收站中的用户数和帖子数，用于监控指标
+	Ping(ctx context.Context) error                                      // 检查存储是否可用，用于就绪探针
+	Begin() (Tx, error)                                                  // 开始事务，事务中的修改在Commit之前对其他请求不生效（内存存储见memoryTx的说明）
+	Close() error                                                        // 释放存储占用的资源
+}
+
+// Tx：存储事务，在Store的基础上增加提交和回滚，批量操作（POST /batch）用它实现"全部成功或全部撤销"
+// 事务中的读写都通过Tx自身的Store方法进行；不支持嵌套事务，Tx的Begin返回错误
+// Commit之后再调用Rollback没有任何效果，因此可以在开始事务后立即defer tx.Rollback()
+type Tx interface {
+	Store
+	Commit() error   // 提交事务
+	Rollback() error // 撤销事务中的全部修改
 }
 
-// 2. 内存存储（模拟数据库）
-// 本示例使用map作为内存存储来模拟数据库，适合教学和演示
-// 在实际项目中，通常会替换为真实的数据库（如MySQL、PostgreSQL等）
+// errNestedTx：在事务中再次调用Begin
+var errNestedTx = errors.New("不支持嵌套事务")
+
+// ErrNotFound：记录不存在时返回的哨兵错误（sentinel error）
+// 处理器通过errors.Is(err, ErrNotFound)判断是否应返回404，而不必关心具体存储实现
+var ErrNotFound = errors.New("记录不存在")
+
+// ErrAuthorNotFound：帖子引用的作者（用户）不存在
+// ErrUserHasPosts：按reject策略删除用户时，用户名下仍有帖子
 var (
-	users      = make(map[int]User)  // 存储用户数据，key为用户ID
-	posts      = make(map[int]Post)  // 存储帖子数据，key为帖子ID
-	nextUserID = 1                   // 下一个可用的用户ID，用于生成新用户的唯一标识
-	nextPostID = 1                   // 下一个可用的帖子ID，用于生成新帖子的唯一标识
+	ErrAuthorNotFound = errors.New("作者不存在")
+	ErrUserHasPosts   = errors.New("用户名下仍有帖子")
 )
 
-// 3. 中间件
-// 中间件（Middleware）是Go Web开发中的重要概念，用于在请求到达处理器之前或之后添加额外逻辑
-// 典型用途：日志记录、身份验证、跨域处理、错误处理等
-// 实现原理：接收一个http.HandlerFunc作为参数，返回一个新的http.HandlerFunc
+// deletedAtLayout：deleted_at的时间格式，即带固定9位小数的RFC3339
+// 随用户级联删除的帖子靠与用户相同的deleted_at识别，只精确到秒时，同一秒内单独删除的帖子会被当作级联删除一起恢复；
+// 写入时总是先转换为UTC（以Z结尾），小数位数固定（不像time.RFC3339Nano那样省略末尾的0），
+// 因此字符串顺序就是时间顺序，不受夏令时、TZ环境变量或把SQLite文件拷到其他时区的机器上的影响
+const deletedAtLayout = "2006-01-02T15:04:05.000000000Z07:00"
 
-// loggingMiddleware：日志中间件，记录请求处理的相关信息
-// 功能：记录请求方法、路径、处理开始时间和耗时
-// 参数：next http.HandlerFunc - 下一个要执行的处理器函数
-// 返回值：包装后的处理器函数
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	// 返回一个匿名函数作为新的处理器
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()                          // 记录请求处理开始时间
-		log.Printf("开始处理: %s %s", r.Method, r.URL.Path)  // 记录请求方法和路径
-		
-		next(w, r)  // 调用下一个处理器，继续处理请求（核心：中间件链的传递）
-		
-		// 计算并记录请求处理耗时
-		log.Printf("完成处理: %s %s (%v)", r.Method, r.URL.Path, time.Since(start))
-	}
+// 删除用户时处理其名下帖子的策略
+const (
+	deleteReject   = "reject"   // 用户有帖子时拒绝删除（409 Conflict）
+	deleteCascade  = "cascade"  // 连同帖子一起删除
+	deleteReassign = "reassign" // 把帖子转给另一个用户
+)
+
+// UserDeletePolicy：删除用户时如何处理其名下的帖子
+// 帖子通过author_id引用用户，直接删除用户会留下指向不存在用户的帖子
+type UserDeletePolicy struct {
+	Mode       string // deleteReject、deleteCascade或deleteReassign
+	ReassignTo int    // Mode为deleteReassign时接收帖子的用户ID
 }
 
-// corsMiddleware：跨域资源共享中间件，处理浏览器的跨域请求限制
-// 功能：设置CORS相关的HTTP头，允许跨域请求
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 设置允许的源（*表示允许所有源）
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		// 设置允许的HTTP方法
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		// 设置允许的请求头
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		// 处理预检请求（OPTIONS方法）
-		// 浏览器在发送跨域请求前，可能会先发送OPTIONS请求检查服务器是否允许跨域
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)  // 直接返回200表示允许
-			return
+// userDeletePolicy：默认的用户删除策略，在main函数中根据配置初始化
+// DELETE /users/{id}可以通过posts、reassign_to参数为单次请求指定其他策略
+var userDeletePolicy = UserDeletePolicy{Mode: deleteReject}
+
+// NewUserDeletePolicy：校验并创建删除策略
+// reassign策略必须指定接收帖子的用户，其余策略忽略reassignTo
+func NewUserDeletePolicy(mode string, reassignTo int) (UserDeletePolicy, error) {
+	switch mode {
+	case deleteReject, deleteCascade:
+		return UserDeletePolicy{Mode: mode}, nil
+	case deleteReassign:
+		if reassignTo <= 0 {
+			return UserDeletePolicy{}, errors.New("reassign策略需要指定接收帖子的用户ID（reassign_to）")
 		}
-		
-		next(w, r)  // 继续处理请求
+		return UserDeletePolicy{Mode: mode, ReassignTo: reassignTo}, nil
+	default:
+		return UserDeletePolicy{}, fmt.Errorf("未知的删除策略: %s（可选值: reject、cascade、reassign）", mode)
 	}
 }
 
-// 4. 用户管理处理器
-// 处理器（Handler）是处理HTTP请求的函数，遵循http.HandlerFunc类型定义
-// 签名为：func(w http.ResponseWriter, r *http.Request)
-// w：用于构建响应，r：包含请求信息
+// ErrVersionConflict：更新或删除时记录的版本号与预期不一致，说明记录已被其他请求修改
+// "比较版本号"和"写入"由存储在同一个原子操作中完成（乐观锁），处理器据此返回412
+var ErrVersionConflict = errors.New("版本冲突")
 
-// handleUsers：用户管理的主处理器，根据HTTP方法分发到不同的处理函数
-// 实现RESTful API的核心思想：同一资源路径根据不同HTTP方法执行不同操作
-func handleUsers(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:    // GET方法：获取资源
-		getUsers(w, r)
-	case http.MethodPost:   // POST方法：创建资源
-		createUser(w, r)
-	case http.MethodPut:    // PUT方法：更新资源
-		updateUser(w, r)
-	case http.MethodDelete: // DELETE方法：删除资源
-		deleteUser(w, r)
-	default:
-		// 处理不支持的HTTP方法，返回405 Method Not Allowed
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+// store：当前使用的存储实现，在main函数中根据启动参数初始化
+var store Store
+
+// txKey：在请求上下文中保存批量操作事务的键
+type txKey struct{}
+
+// requestTx：一个批量操作的事务，以及提交之后才执行的回调
+// 同一批量操作的子请求在同一个goroutine中依次执行，因此hooks不需要加锁
+type requestTx struct {
+	tx    Tx
+	hooks []func()
+}
+
+// storeFrom：返回处理请求应使用的存储
+// 批量操作的子请求使用上下文中的事务，其余请求使用全局的store
+// 处理器必须通过它访问存储：SQLite只有一个连接，事务进行期间直接使用store会一直等待连接而死锁
+func storeFrom(r *http.Request) Store {
+	if rtx, ok := r.Context().Value(txKey{}).(*requestTx); ok {
+		return rtx.tx
 	}
+	return store
 }
 
-// getUsers：处理获取所有用户的请求（GET /users）
-// 功能：从内存存储中读取所有用户，以JSON格式返回
-func getUsers(w http.ResponseWriter, r *http.Request) {
-	// 设置响应头Content-Type为application/json，告诉客户端返回的是JSON数据
-	w.Header().Set("Content-Type", "application/json")
-	
-	// 将map中的用户转换为切片（数组），因为JSON序列化map的顺序不确定
-	userList := make([]User, 0, len(users))
-	for _, user := range users {
-		userList = append(userList, user)
+// afterCommit：在数据真正写入之后执行fn，用于发布事件、更新搜索索引等派生数据
+// 不在事务中时立即执行；在事务中时推迟到提交之后，事务回滚则不执行，订阅者和索引不会看到被撤销的修改
+func afterCommit(r *http.Request, fn func()) {
+	if rtx, ok := r.Context().Value(txKey{}).(*requestTx); ok {
+		rtx.hooks = append(rtx.hooks, fn)
+		return
 	}
-	
-	// 使用json.NewEncoder将用户列表编码为JSON并写入响应
-	// Encode方法会自动处理错误，失败时会返回500 Internal Server Error
-	json.NewEncoder(w).Encode(userList)
+	fn()
 }
 
-// createUser：处理创建新用户的请求（POST /users）
-// 功能：解析请求体中的JSON数据，创建新用户并保存到内存存储
-func createUser(w http.ResponseWriter, r *http.Request) {
-	var user User  // 声明一个User类型变量，用于接收解析后的请求数据
-	
-	// 解析请求体中的JSON数据到user变量
-	// json.NewDecoder(r.Body).Decode(&user)：从请求体读取并反序列化JSON
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		// 解析失败时，返回400 Bad Request错误
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
-		return
-	}
-	
-	// 为新用户分配ID和创建时间
-	user.ID = nextUserID          // 使用全局变量nextUserID作为新用户ID
-	user.Created = time.Now().Format(time.RFC3339)  // 格式化当前时间为RFC3339标准格式
-	nextUserID++                  // 更新nextUserID，确保下次创建用户时ID唯一
-	
-	// 将新用户保存到内存存储
-	users[user.ID] = user
-	
-	// 设置响应头和状态码
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)  // 201 Created表示资源创建成功
-	// 返回创建的用户信息
-	json.NewEncoder(w).Encode(user)
+// publishEvent：通过afterCommit发布变更事件
+func publishEvent(r *http.Request, eventType string, data interface{}) {
+	afterCommit(r, func() { events.Publish(eventType, data) })
 }
 
-// updateUser：处理更新用户的请求（PUT /users/{id}）
-// 功能：根据URL路径中的ID查找用户，更新其信息并保存
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	// 从URL路径中提取用户ID（例如从"/users/123"中提取"123"）
-	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
-	// 将字符串ID转换为整数
-	id, err := strconv.Atoi(idStr)
+// inRequestTx：在存储事务中执行fn，fn返回错误时撤销它所做的全部修改，成功提交后再执行afterCommit登记的回调
+// fn收到的请求携带事务，fn内部同样通过storeFrom、afterCommit访问存储；
+// 请求本身已经是批量操作的子请求时不开启新事务（不支持嵌套事务），直接执行fn，由批量操作决定提交还是回滚
+func inRequestTx(r *http.Request, fn func(r *http.Request) error) error {
+	if _, ok := r.Context().Value(txKey{}).(*requestTx); ok {
+		return fn(r)
+	}
+	tx, err := store.Begin()
 	if err != nil {
-		// 转换失败（ID不是数字），返回400 Bad Request
-		http.Error(w, "无效的用户ID", http.StatusBadRequest)
-		return
+		return fmt.Errorf("开始事务失败: %w", err)
 	}
-	
-	// 解析请求体中的JSON数据到临时user变量
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
-		return
+	defer tx.Rollback()
+	rtx := &requestTx{tx: tx}
+	if err := fn(r.WithContext(context.WithValue(r.Context(), txKey{}, rtx))); err != nil {
+		return err
 	}
-	
-	// 检查用户是否存在
-	if _, exists := users[id]; !exists {
-		// 用户不存在，返回404 Not Found
-		http.Error(w, "用户不存在", http.StatusNotFound)
-		return
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	
-	// 确保更新的用户ID与URL中的ID一致（防止ID被篡改）
-	user.ID = id
-	// 更新内存存储中的用户信息
-	users[id] = user
-	
-	// 返回更新后的用户信息
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	for _, hook := range rtx.hooks {
+		hook()
+	}
+	return nil
 }
 
-// deleteUser：处理删除用户的请求（DELETE /users/{id}）
-// 功能：根据URL路径中的ID查找并删除用户
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	// 从URL路径中提取用户ID
-	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
-	id, err := strconv.Atoi(idStr)
+// 2.1 并发安全的基础组件
+// net/http会为每个请求启动一个goroutine，多个处理器可能同时读写存储
+// 普通map和int计数器在并发读写时会产生数据竞争（data race），导致map损坏或ID重复
+// 下面两个组件分别沿用7-goroutines-channels.go中的SafeCounter和12-advanced-topics.go中的Cache[K,V]
+
+// SafeCounter：并发安全计数器，使用Mutex保护value字段
+// 在这里用作ID分配器：Next()在同一把锁内完成"加一并读取"，保证每次分配的ID唯一
+type SafeCounter struct {
+	mu    sync.Mutex // 互斥锁
+	value int        // 受保护的值（最后一次分配出去的ID）
+}
+
+// NewSafeCounter：创建计数器，start为初始值（下一次Next()返回start+1）
+func NewSafeCounter(start int) *SafeCounter {
+	return &SafeCounter{value: start}
+}
+
+// Next：原子地递增并返回新值
+// 注意：不能用"先Value()再Increment()"两步实现，两步之间其他goroutine可能插入，导致ID重复
+func (c *SafeCounter) Next() int {
+	c.mu.Lock()         // 获取锁
+	defer c.mu.Unlock() // 确保释放锁
+	c.value++
+	return c.value
+}
+
+// Value：读取当前值
+func (c *SafeCounter) Value() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+// Cache：线程安全的泛型键值存储，使用读写锁保护内部map
+// 读操作（Get、Values、Len）使用读锁，可以并发执行；写操作使用写锁，互斥执行
+type Cache[K comparable, V any] struct {
+	items map[K]V
+	mu    sync.RWMutex
+}
+
+// NewCache：创建并返回一个新的泛型缓存
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{
+		items: make(map[K]V),
+	}
+}
+
+// Set：设置缓存项（不存在则新增，存在则覆盖）
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = value
+}
+
+// Get：获取缓存项，第二个返回值表示键是否存在
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, exists := c.items[key]
+	return value, exists
+}
+
+// Replace：仅当键已存在时才覆盖，返回是否替换成功
+// "检查是否存在"和"写入"在同一把写锁内完成，避免检查之后记录被其他goroutine删除
+func (c *Cache[K, V]) Replace(key K, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.items[key]; !exists {
+		return false
+	}
+	c.items[key] = value
+	return true
+}
+
+// LoadOrStore：键存在时返回已有的值和true；不存在时写入value并返回value和false
+// "检查"和"写入"在同一把写锁内完成，多个goroutine同时调用时只有一个能写入
+func (c *Cache[K, V]) LoadOrStore(key K, value V) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current, exists := c.items[key]; exists {
+		return current, true
+	}
+	c.items[key] = value
+	return value, false
+}
+
+// Delete：删除缓存项，返回键删除前是否存在
+func (c *Cache[K, V]) Delete(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.items[key]
+	delete(c.items, key)
+	return exists
+}
+
+// Update：在同一把写锁内读取当前值、由fn计算新值并写回，用于实现"比较并交换"
+// 返回值：键不存在时返回false；fn返回错误时不做修改，并把错误原样返回
+func (c *Cache[K, V]) Update(key K, fn func(current V) (V, error)) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, exists := c.items[key]
+	if !exists {
+		return false, nil
+	}
+	updated, err := fn(current)
 	if err != nil {
-		http.Error(w, "无效的用户ID", http.StatusBadRequest)
-		return
+		return true, err
 	}
-	
-	// 检查用户是否存在
-	if _, exists := users[id]; !exists {
-		http.Error(w, "用户不存在", http.StatusNotFound)
-		return
+	c.items[key] = updated
+	return true, nil
+}
+
+// DeleteIf：仅当check返回nil时才删除，检查和删除在同一把写锁内完成
+// 返回值：键不存在时返回false；check返回错误时不删除，并把错误原样返回
+func (c *Cache[K, V]) DeleteIf(key K, check func(current V) error) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, exists := c.items[key]
+	if !exists {
+		return false, nil
 	}
-	
-	// 从内存存储中删除用户
-	delete(users, id)
-	// 返回204 No Content，表示删除成功且无响应体
-	w.WriteHeader(http.StatusNoContent)
+	if err := check(current); err != nil {
+		return true, err
+	}
+	delete(c.items, key)
+	return true, nil
 }
 
-// 5. 帖子管理处理器
-// handlePosts：帖子管理的主处理器，根据HTTP方法分发到不同的处理函数
-func handlePosts(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:    // GET方法：获取帖子列表
-		getPosts(w, r)
-	case http.MethodPost:   // POST方法：创建新帖子
-		createPost(w, r)
-	default:
-		// 暂不支持PUT和DELETE方法，返回405
-		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+// DeleteFunc：删除所有满足match的缓存项，返回删除的数量
+func (c *Cache[K, V]) DeleteFunc(match func(key K, value V) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deleted := 0
+	for key, value := range c.items {
+		if match(key, value) {
+			delete(c.items, key)
+			deleted++
+		}
 	}
+	return deleted
 }
 
-// getPosts：处理获取所有帖子的请求（GET /posts）
-// 功能：从内存存储中读取所有帖子，以JSON格式返回
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	
-	// 将map中的帖子转换为切片
-	postList := make([]Post, 0, len(posts))
-	for _, post := range posts {
-		postList = append(postList, post)
+// Values：返回所有值的快照切片，调用方可以安全地遍历而不持有锁
+func (c *Cache[K, V]) Values() []V {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make([]V, 0, len(c.items))
+	for _, value := range c.items {
+		values = append(values, value)
 	}
-	
-	json.NewEncoder(w).Encode(postList)
+	return values
 }
 
-// createPost：处理创建新帖子的请求（POST /posts）
-// 功能：解析请求体中的JSON数据，创建新帖子并保存到内存存储
-func createPost(w http.ResponseWriter, r *http.Request) {
-	var post Post
-	
-	// 解析请求体中的JSON数据
-	if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
-		return
+// ValuesFunc：返回满足match的值的快照切片，只复制匹配的值
+func (c *Cache[K, V]) ValuesFunc(match func(key K, value V) bool) []V {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var values []V
+	for key, value := range c.items {
+		if match(key, value) {
+			values = append(values, value)
+		}
 	}
-	
-	// 为新帖子分配ID和发布时间
-	post.ID = nextPostID
-	post.Date = time.Now().Format(time.RFC3339)
-	nextPostID++
-	
-	// 保存新帖子
-	posts[post.ID] = post
-	
-	// 返回创建的帖子信息
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(post)
+	return values
+}
+
+// Len：返回缓存项数量
+func (c *Cache[K, V]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.items)
 }
 
-// 6. 健康检查处理器
-// handleHealth：处理健康检查请求（GET /health）
-// 功能：返回服务器的健康状态，常用于监控系统检查服务是否正常运行
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	// 构建健康状态数据
-	health := map[string]interface{}{
-		"status":    "healthy",                // 健康状态
-		"timestamp": time.Now().Format(time.RFC3339),  // 当前时间戳
-		"version":   "1.0.0",                  // 服务版本
+// CountFunc：返回满足match的缓存项数量，不复制任何值
+func (c *Cache[K, V]) CountFunc(match func(key K, value V) bool) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	count := 0
+	for key, value := range c.items {
+		if match(key, value) {
+			count++
+		}
 	}
-	
-	// 返回JSON格式的健康状态
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(health)
+	return count
+}
+
+// MemoryStore：基于内存的存储，数据在程序退出后丢失，适合教学和演示
+// 数据保存在并发安全的Cache中，ID由SafeCounter分配，因此可以被多个处理器goroutine同时调用
+type MemoryStore struct {
+	users      *Cache[int, User] // 存储用户数据，key为用户ID
+	posts      *Cache[int, Post] // 存储帖子数据，key为帖子ID
+	nextUserID *SafeCounter      // 用户ID分配器，保证并发创建时ID唯一
+	nextPostID *SafeCounter      // 帖子ID分配器
+
+	// relations：保护用户与帖子之间的引用关系
+	// Cache只保证单个集合内的操作是原子的；"检查作者存在再写入帖子"、"处理帖子再删除用户"跨越两个集合，
+	// 必须在同一把锁内完成，否则可能出现作者刚被删除、引用它的帖子却写入成功的情况
+	relations sync.Mutex
+
+	// writers：普通写操作持有读锁，彼此之间仍然可以并发；事务持有写锁，进行期间其他写操作等待
+	// 事务内部使用的视图（memoryTx）中为nil，不再加锁
+	writers *sync.RWMutex
 }
 
-// 7. 统计信息处理器
-// handleStats：处理统计信息请求（GET /stats）
-// 功能：返回服务器的统计数据，如用户数量、帖子数量、运行时间等
-func handleStats(w http.ResponseWriter, r *http.Request) {
-	// 构建统计数据
-	stats := map[string]interface{}{
-		"users":  len(users),                 // 用户数量
-		"posts":  len(posts),                 // 帖子数量
-		"uptime": time.Since(startTime).String(),  // 服务器运行时间
+// NewMemoryStore：创建空的内存存储，ID从1开始分配
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      NewCache[int, User](),
+		posts:      NewCache[int, Post](),
+		nextUserID: NewSafeCounter(0),
+		nextPostID: NewSafeCounter(0),
+		writers:    &sync.RWMutex{},
 	}
-	
-	// 返回JSON格式的统计信息
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
 }
 
-// 8. 路由处理器
-// handleAPI：API路由分发处理器，根据URL路径分发到不同的功能处理器
-// 注意：本示例中此函数未被直接使用，主路由设置在main函数中
-func handleAPI(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path  // 获取请求的URL路径
-	
-	// 根据路径匹配不同的处理器
-	switch {
-	case path == "/health":
-		handleHealth(w, r)
-	case path == "/stats":
-		handleStats(w, r)
-	case path == "/users" || strings.HasPrefix(path, "/users/"):
-		handleUsers(w, r)
-	case path == "/posts" || strings.HasPrefix(path, "/posts/"):
-		handlePosts(w, r)
+// lockWrites：写操作开始时调用，返回的函数在写操作结束时调用
+func (s *MemoryStore) lockWrites() func() {
+	if s.writers == nil {
+		return func() {}
+	}
+	s.writers.RLock()
+	return s.writers.RUnlock
+}
+
+// usersIn：返回用户的快照，deleted为true时只包含回收站中的用户，否则只包含未删除的用户
+// 软删除的记录与正常记录保存在同一个Cache中，读取时按DeletedAt区分
+func (s *MemoryStore) usersIn(deleted bool) []User {
+	all := s.users.Values()
+	list := make([]User, 0, len(all))
+	for _, user := range all {
+		if (user.DeletedAt != "") == deleted {
+			list = append(list, user)
+		}
+	}
+	return list
+}
+
+// postsIn：与usersIn相同，用于帖子
+func (s *MemoryStore) postsIn(deleted bool) []Post {
+	all := s.posts.Values()
+	list := make([]Post, 0, len(all))
+	for _, post := range all {
+		if (post.DeletedAt != "") == deleted {
+			list = append(list, post)
+		}
+	}
+	return list
+}
+
+// liveUser：用户存在且不在回收站中时返回true
+func (s *MemoryStore) liveUser(id int) (User, bool) {
+	user, exists := s.users.Get(id)
+	return user, exists && user.DeletedAt == ""
+}
+
+// ListUsers：返回所有未删除用户的快照
+func (s *MemoryStore) ListUsers() ([]User, error) {
+	return s.usersIn(false), nil
+}
+
+// ListUsersAfter：从全部用户中筛选出ID大于afterID的部分，排序后截取limit个
+func (s *MemoryStore) ListUsersAfter(afterID, limit int) ([]User, error) {
+	var page []User
+	for _, user := range s.usersIn(false) {
+		if user.ID > afterID {
+			page = append(page, user)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page, nil
+}
+
+// GetUser：用户不存在或在回收站中时返回ErrNotFound
+func (s *MemoryStore) GetUser(id int) (*User, error) {
+	user, exists := s.liveUser(id)
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+// GetUsers：逐个按ID查找，不存在或在回收站中的用户被忽略
+func (s *MemoryStore) GetUsers(ids []int) ([]User, error) {
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if user, exists := s.liveUser(id); exists {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// CreateUser：分配ID后保存用户，分配的ID和初始版本号会写回user
+func (s *MemoryStore) CreateUser(user *User) error {
+	defer s.lockWrites()()
+	user.ID = s.nextUserID.Next()
+	user.Version = 1
+	user.DeletedAt = "" // 新用户总是未删除的，忽略客户端传入的deleted_at
+	s.users.Set(user.ID, *user)
+	return nil
+}
+
+// UpdateUser：用户不存在时返回ErrNotFound，版本号不一致时返回ErrVersionConflict
+func (s *MemoryStore) UpdateUser(user *User) error {
+	defer s.lockWrites()()
+	s.relations.Lock() // 与DeleteUser互斥，保证删除过程中用户的版本号不会变化
+	defer s.relations.Unlock()
+	found, err := s.users.Update(user.ID, func(current User) (User, error) {
+		if current.DeletedAt != "" {
+			return current, ErrNotFound
+		}
+		if current.Version != user.Version {
+			return current, ErrVersionConflict
+		}
+		user.Version++
+		user.DeletedAt = ""
+		return *user, nil
+	})
+	if !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeleteUser：把用户移入回收站；用户不存在时返回ErrNotFound，版本号不一致时返回ErrVersionConflict
+// 名下帖子按policy处理：reject时返回ErrUserHasPosts，cascade时帖子与用户带着相同的deleted_at一起进入回收站，
+// reassign的目标用户不存在时返回ErrAuthorNotFound
+// 返回值：cascade时为被删除的帖子，reassign时为转移后的帖子，调用方据此同步搜索索引等派生数据
+func (s *MemoryStore) DeleteUser(id, version int, policy UserDeletePolicy) ([]Post, error) {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+
+	user, exists := s.liveUser(id)
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if user.Version != version {
+		return nil, ErrVersionConflict
+	}
+
+	var owned []Post
+	for _, post := range s.postsIn(false) {
+		if post.AuthorID == id {
+			owned = append(owned, post)
+		}
+	}
+	deletedAt := time.Now().UTC().Format(deletedAtLayout)
+	switch policy.Mode {
+	case deleteReject:
+		if len(owned) > 0 {
+			return nil, ErrUserHasPosts
+		}
+	case deleteCascade:
+		for i := range owned {
+			owned[i].DeletedAt = deletedAt
+			owned[i].Version++
+			s.posts.Set(owned[i].ID, owned[i])
+		}
+	case deleteReassign:
+		if _, exists := s.liveUser(policy.ReassignTo); !exists || policy.ReassignTo == id {
+			return nil, ErrAuthorNotFound
+		}
+		for i := range owned {
+			owned[i].AuthorID = policy.ReassignTo
+			owned[i].Version++ // 帖子的内容发生了变化，版本号同样要加一，否则客户端缓存的ETag仍然有效
+			s.posts.Set(owned[i].ID, owned[i])
+		}
 	default:
-		// 路径未匹配，返回404 Not Found
-		http.NotFound(w, r)
+		return nil, fmt.Errorf("未知的删除策略: %s", policy.Mode)
 	}
+	user.DeletedAt = deletedAt
+	user.Version++
+	s.users.Set(id, user)
+	return owned, nil
 }
 
-// 9. 初始化数据
-// initData：服务器启动时初始化示例数据
-// 功能：添加一些默认用户和帖子，方便测试API功能
-func initData() {
-	// 添加示例用户
-	users[1] = User{
-		ID:      1,
-		Name:    "张三",
-		Email:   "zhangsan@example.com",
-		Age:     25,
-		Created: time.Now().Format(time.RFC3339),
+// ListPosts：返回所有未删除帖子的快照
+func (s *MemoryStore) ListPosts() ([]Post, error) {
+	return s.postsIn(false), nil
+}
+
+// ListPostsByAuthor：只复制指定作者的未删除帖子
+func (s *MemoryStore) ListPostsByAuthor(authorID int) ([]Post, error) {
+	posts := s.posts.ValuesFunc(func(_ int, post Post) bool { return post.AuthorID == authorID && post.DeletedAt == "" })
+	if posts == nil {
+		posts = make([]Post, 0)
 	}
-	
-	users[2] = User{
-		ID:      2,
-		Name:    "李四",
-		Email:   "lisi@example.com",
-		Age:     30,
-		Created: time.Now().Format(time.RFC3339),
+	return posts, nil
+}
+
+// GetPost：帖子不存在或在回收站中时返回ErrNotFound
+func (s *MemoryStore) GetPost(id int) (*Post, error) {
+	post, exists := s.posts.Get(id)
+	if !exists || post.DeletedAt != "" {
+		return nil, ErrNotFound
 	}
-	
-	// 添加示例帖子
-	posts[1] = Post{
-		ID:      1,
-		Title:   "Go语言入门",
-		Content: "Go语言是一门现代化的编程语言，具有并发支持...",
-		Author:  "张三",
-		Date:    time.Now().Format(time.RFC3339),
-	}
-	
-	posts[2] = Post{
-		ID:      2,
-		Title:   "Web开发基础",
-		Content: "使用Go语言构建Web应用非常简单...",
-		Author:  "李四",
-		Date:    time.Now().Format(time.RFC3339),
-	}
-	
-	// 更新下一个可用ID，确保新创建的资源ID不会冲突
-	nextUserID = 3
-	nextPostID = 3
+	return &post, nil
 }
 
-// 全局变量
-var startTime = time.Now()  // 记录服务器启动时间，用于计算运行时间
+// CreatePost：分配ID后保存帖子，分配的ID和初始版本号会写回post；作者不存在时返回ErrAuthorNotFound
+func (s *MemoryStore) CreatePost(post *Post) error {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+	if _, exists := s.liveUser(post.AuthorID); !exists {
+		return ErrAuthorNotFound
+	}
+	post.ID = s.nextPostID.Next()
+	post.Version = 1
+	post.DeletedAt = ""
+	s.posts.Set(post.ID, *post)
+	return nil
+}
 
-// 10. 静态文件服务
-// handleStatic：处理静态文件请求和主页请求
-// 功能：提供静态资源访问和默认主页
-func handleStatic(w http.ResponseWriter, r *http.Request) {
-	// 根路径请求（/）返回主页
-	if r.URL.Path == "/" {
-		serveHomePage(w, r)
-		return
+// UpdatePost：帖子不存在时返回ErrNotFound，版本号不一致时返回ErrVersionConflict，作者不存在时返回ErrAuthorNotFound
+func (s *MemoryStore) UpdatePost(post *Post) error {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+	if _, exists := s.liveUser(post.AuthorID); !exists {
+		if current, found := s.posts.Get(post.ID); !found || current.DeletedAt != "" {
+			return ErrNotFound
+		}
+		return ErrAuthorNotFound
 	}
-	
-	// 处理静态文件请求（/static/前缀的路径）
-	if strings.HasPrefix(r.URL.Path, "/static/") {
-		// http.ServeFile：从本地文件系统读取文件并返回给客户端
-		// r.URL.Path[1:]：去掉路径开头的斜杠，获取正确的文件路径
-		http.ServeFile(w, r, r.URL.Path[1:])
-		return
+	found, err := s.posts.Update(post.ID, func(current Post) (Post, error) {
+		if current.DeletedAt != "" {
+			return current, ErrNotFound
+		}
+		if current.Version != post.Version {
+			return current, ErrVersionConflict
+		}
+		post.Version++
+		post.DeletedAt = ""
+		return *post, nil
+	})
+	if !found {
+		return ErrNotFound
 	}
-	
-	// 未匹配的路径返回404
-	http.NotFound(w, r)
+	return err
 }
 
-// 11. 主页服务
-// serveHomePage：生成并返回HTML格式的主页
-// 功能：展示服务器的API端点和使用示例，方便用户了解如何使用API
-func serveHomePage(w http.ResponseWriter, r *http.Request) {
-	// 定义HTML内容，包含API端点说明和使用示例
-	html := `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Go Web服务器示例</title>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 40px; }
-        .endpoint { margin: 20px 0; padding: 10px; background: #f5f5f5; border-radius: 5px; }
-        .method { color: #007cba; font-weight: bold; }
-        .path { color: #d73a49; font-family: monospace; }
-    </style>
-</head>
-<body>
-    <h1>Go语言Web服务器示例</h1>
-    <p>这是一个使用Go语言构建的简单Web服务器示例</p>
-    
-    <h2>可用API端点</h2>
-    
-    <div class="endpoint">
-        <span class="method">GET</span> <span class="path">/health</span> - 健康检查
-    </div>
-    
-    <div class="endpoint">
-        <span class="method">GET</span> <span class="path">/stats</span> - 统计信息
-    </div>
-    
-    <div class="endpoint">
-        <span class="method">GET</span> <span class="path">/users</span> - 获取所有用户
-    </div>
-    
-    <div class="endpoint">
-        <span class="method">POST</span> <span class="path">/users</span> - 创建新用户
-    </div>
-    
-    <div class="endpoint">
-        <span class="method">GET</span> <span class="path">/posts</span> - 获取所有帖子
-    </div>
-    
-    <div class="endpoint">
-        <span class="method">POST</span> <span class="path">/posts</span> - 创建新帖子
-    </div>
-    
-    <h2>使用示例</h2>
-    <pre>
-# 健康检查
-curl http://localhost:8080/health
-
-# 获取用户列表
-curl http://localhost:8080/users
-
-# 创建新用户
-curl -X POST http://localhost:8080/users \
-  -H "Content-Type: application/json" \
-  -d '{"name":"王五","email":"wangwu@example.com","age":28}'
-    </pre>
-</body>
-</html>
-`
-	
-	// 设置响应头Content-Type为text/html，告诉客户端返回的是HTML内容
-	w.Header().Set("Content-Type", "text/html")
-	// 将HTML内容写入响应
-	fmt.Fprint(w, html)
+// DeletePost：把帖子移入回收站；帖子不存在时返回ErrNotFound，版本号不一致时返回ErrVersionConflict
+func (s *MemoryStore) DeletePost(id, version int) error {
+	defer s.lockWrites()()
+	found, err := s.posts.Update(id, func(current Post) (Post, error) {
+		if current.DeletedAt != "" {
+			return current, ErrNotFound
+		}
+		if current.Version != version {
+			return current, ErrVersionConflict
+		}
+		current.DeletedAt = time.Now().UTC().Format(deletedAtLayout)
+		current.Version++
+		return current, nil
+	})
+	if !found {
+		return ErrNotFound
+	}
+	return err
 }
 
-// 12. 中间件链
-// withMiddleware：组合多个中间件，形成中间件链
-// 功能：将CORS中间件和日志中间件组合，应用到处理器上
-// 注意：中间件的顺序很重要，这里先执行corsMiddleware，再执行loggingMiddleware
-func withMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return corsMiddleware(loggingMiddleware(next))
+// ListDeletedUsers：返回回收站中的用户
+func (s *MemoryStore) ListDeletedUsers() ([]User, error) {
+	return s.usersIn(true), nil
 }
 
-// 主函数：程序入口点
-func main() {
-	fmt.Println("=== Go语言Web服务器开发 ===")
-	
-	// 初始化示例数据
-	initData()
-	
-	// 设置路由规则
-	// http.HandleFunc：将URL模式与处理器函数关联
-	// 第一个参数是URL模式，第二个参数是处理器函数（可以是经过中间件包装的）
-	http.HandleFunc("/", withMiddleware(handleStatic))
-	http.HandleFunc("/health", withMiddleware(handleHealth))
-	http.HandleFunc("/stats", withMiddleware(handleStats))
-	http.HandleFunc("/users", withMiddleware(handleUsers))
-	http.HandleFunc("/users/", withMiddleware(handleUsers))  // 处理带ID的用户路径
-	http.HandleFunc("/posts", withMiddleware(handlePosts))
-	http.HandleFunc("/posts/", withMiddleware(handlePosts))  // 处理带ID的帖子路径
-	
-	// 启动HTTP服务器
-	fmt.Println("服务器启动在 http://localhost:8080")
-	fmt.Println("按 Ctrl+C 停止服务器")
-	
-	// http.ListenAndServe：启动服务器，监听指定地址和端口
-	// 第一个参数是地址（格式为"host:port"），第二个参数是处理器（nil表示使用默认的DefaultServeMux）
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		// 服务器启动失败时，记录错误并退出
-		log.Fatal("服务器启动失败:", err)
+// ListDeletedPosts：返回回收站中的帖子
+func (s *MemoryStore) ListDeletedPosts() ([]Post, error) {
+	return s.postsIn(true), nil
+}
+
+// RestoreUser：恢复用户，deleted_at与用户相同的帖子是删除用户时级联删除的，一并恢复
+// 恢复也是一次修改，版本号加一：删除之前取得的ETag不能再用来修改恢复后的记录
+func (s *MemoryStore) RestoreUser(id int) (*User, []Post, error) {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+
+	user, exists := s.users.Get(id)
+	if !exists || user.DeletedAt == "" {
+		return nil, nil, ErrNotFound
+	}
+	var restored []Post
+	for _, post := range s.postsIn(true) {
+		if post.AuthorID == id && post.DeletedAt == user.DeletedAt {
+			post.DeletedAt = ""
+			post.Version++
+			s.posts.Set(post.ID, post)
+			restored = append(restored, post)
+		}
+	}
+	sort.Slice(restored, func(i, j int) bool { return restored[i].ID < restored[j].ID })
+	user.DeletedAt = ""
+	user.Version++
+	s.users.Set(id, user)
+	return &user, restored, nil
+}
+
+// RestorePost：恢复帖子，作者必须存在且不在回收站中，否则恢复出的帖子会指向一个看不到的用户
+func (s *MemoryStore) RestorePost(id int) (*Post, error) {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+
+	post, exists := s.posts.Get(id)
+	if !exists || post.DeletedAt == "" {
+		return nil, ErrNotFound
+	}
+	if _, exists := s.liveUser(post.AuthorID); !exists {
+		return nil, ErrAuthorNotFound
+	}
+	post.DeletedAt = ""
+	post.Version++
+	s.posts.Set(id, post)
+	return &post, nil
+}
+
+// PurgeDeleted：永久删除过期的回收站记录
+// 被永久删除的用户名下的帖子（此时都在回收站中）即使还没有过期也一并删除，不会留下指向不存在用户的帖子
+func (s *MemoryStore) PurgeDeleted(before time.Time) (int, int, error) {
+	defer s.lockWrites()()
+	s.relations.Lock()
+	defer s.relations.Unlock()
+
+	purgedUsers := make(map[int]bool)
+	for _, user := range s.usersIn(true) {
+		if deletedBefore(user.DeletedAt, before) {
+			purgedUsers[user.ID] = true
+		}
+	}
+	posts := s.posts.DeleteFunc(func(_ int, post Post) bool {
+		return post.DeletedAt != "" && (deletedBefore(post.DeletedAt, before) || purgedUsers[post.AuthorID])
+	})
+	users := s.users.DeleteFunc(func(id int, _ User) bool { return purgedUsers[id] })
+	return users, posts, nil
+}
+
+// deletedBefore：判断删除时间是否早于before，time.RFC3339可以解析带小数秒的deletedAtLayout
+func deletedBefore(deletedAt string, before time.Time) bool {
+	t, err := time.Parse(time.RFC3339, deletedAt)
+	return err == nil && t.Before(before)
+}
+
+// Close：内存存储没有需要释放的资源
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Count：只在Cache的读锁内计数，不复制记录
+func (s *MemoryStore) Count(ctx context.Context) (users, posts int, err error) {
+	users = s.users.CountFunc(func(_ int, user User) bool { return user.DeletedAt == "" })
+	posts = s.posts.CountFunc(func(_ int, post Post) bool { return post.DeletedAt == "" })
+	return users, posts, nil
+}
+
+// Ping：内存存储总是可用
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Begin：获取写锁并返回事务，事务结束（Commit或Rollback）时释放
+func (s *MemoryStore) Begin() (Tx, error) {
+	if s.writers == nil {
+		return nil, errNestedTx
+	}
+	s.writers.Lock()
+	view := &MemoryStore{users: s.users, posts: s.posts, nextUserID: s.nextUserID, nextPostID: s.nextPostID}
+	return &memoryTx{MemoryStore: view, base: s}, nil
+}
+
+// memoryTx：内存存储的事务
+// 修改直接写入共享的Cache，同时记录撤销操作（undo log），回滚时按相反的顺序执行
+// 事务持有写锁，进行期间其他写操作等待，因此撤销时不会覆盖其他请求的修改；
+// 但读操作不等待，可能读到尚未提交的数据。需要完整隔离时使用SQLite存储
+// 回滚的记录已经分配的ID不会复用，与SQLite的AUTOINCREMENT一致
+type memoryTx struct {
+	*MemoryStore              // 不加锁的视图，与base共享数据
+	base         *MemoryStore // 持有写锁的存储
+	undo         []func()     // 撤销操作，按修改的顺序排列
+	done         bool         // 是否已经提交或回滚
+}
+
+// CreateUser：撤销操作是删除新用户
+func (tx *memoryTx) CreateUser(user *User) error {
+	if err := tx.MemoryStore.CreateUser(user); err != nil {
+		return err
 	}
+	id := user.ID
+	tx.undo = append(tx.undo, func() { tx.users.Delete(id) })
+	return nil
 }
 
-// 13. 客户端测试函数（在另一个文件中）
-// testClient：用于测试服务器API的客户端函数
-// 功能：发送测试请求到服务器，验证API是否正常工作
-func testClient() {
-	// 这个函数可以在另一个文件中用于测试服务器
-	fmt.Println("\n=== 客户端测试 ===")
-	
-	// 测试健康检查API
-	resp, err := http.Get("http://localhost:8080/health")
+// UpdateUser：撤销操作是恢复修改前的用户
+func (tx *memoryTx) UpdateUser(user *User) error {
+	previous, _ := tx.users.Get(user.ID)
+	if err := tx.MemoryStore.UpdateUser(user); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tx.users.Set(previous.ID, previous) })
+	return nil
+}
+
+// DeleteUser：撤销操作是恢复用户，以及被删除或转移之前的帖子
+func (tx *memoryTx) DeleteUser(id, version int, policy UserDeletePolicy) ([]Post, error) {
+	previous, _ := tx.users.Get(id)
+	var owned []Post
+	for _, post := range tx.posts.Values() {
+		if post.AuthorID == id {
+			owned = append(owned, post)
+		}
+	}
+	affected, err := tx.MemoryStore.DeleteUser(id, version, policy)
 	if err != nil {
-		fmt.Printf("请求失败: %v\n", err)
-		return
+		return nil, err
+	}
+	tx.undo = append(tx.undo, func() {
+		tx.users.Set(previous.ID, previous)
+		for _, post := range owned {
+			tx.posts.Set(post.ID, post)
+		}
+	})
+	return affected, nil
+}
+
+// CreatePost：撤销操作是删除新帖子
+func (tx *memoryTx) CreatePost(post *Post) error {
+	if err := tx.MemoryStore.CreatePost(post); err != nil {
+		return err
+	}
+	id := post.ID
+	tx.undo = append(tx.undo, func() { tx.posts.Delete(id) })
+	return nil
+}
+
+// UpdatePost：撤销操作是恢复修改前的帖子
+func (tx *memoryTx) UpdatePost(post *Post) error {
+	previous, _ := tx.posts.Get(post.ID)
+	if err := tx.MemoryStore.UpdatePost(post); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tx.posts.Set(previous.ID, previous) })
+	return nil
+}
+
+// DeletePost：撤销操作是恢复被删除的帖子
+func (tx *memoryTx) DeletePost(id, version int) error {
+	previous, _ := tx.posts.Get(id)
+	if err := tx.MemoryStore.DeletePost(id, version); err != nil {
+		return err
 	}
-	defer resp.Body.Close()  // defer确保响应体在函数退出时关闭，避免资源泄露
-	
-	fmt.Printf("健康检查响应状态: %s\n", resp.Status)
-	
-	// 测试获取用户列表API
-	resp, err = http.Get("http://localhost:8080/users")
+	tx.undo = append(tx.undo, func() { tx.posts.Set(previous.ID, previous) })
+	return nil
+}
+
+// RestoreUser：撤销操作是把用户和一同恢复的帖子放回回收站
+func (tx *memoryTx) RestoreUser(id int) (*User, []Post, error) {
+	previous, _ := tx.users.Get(id)
+	user, restored, err := tx.MemoryStore.RestoreUser(id)
 	if err != nil {
-		fmt.Printf("请求失败: %v\n", err)
-		return
+		return nil, nil, err
+	}
+	tx.undo = append(tx.undo, func() {
+		tx.users.Set(previous.ID, previous)
+		for _, post := range restored {
+			post.DeletedAt = previous.DeletedAt
+			post.Version--
+			tx.posts.Set(post.ID, post)
+		}
+	})
+	return user, restored, nil
+}
+
+// RestorePost：撤销操作是把帖子放回回收站
+func (tx *memoryTx) RestorePost(id int) (*Post, error) {
+	previous, _ := tx.posts.Get(id)
+	post, err := tx.MemoryStore.RestorePost(id)
+	if err != nil {
+		return nil, err
+	}
+	tx.undo = append(tx.undo, func() { tx.posts.Set(previous.ID, previous) })
+	return post, nil
+}
+
+// PurgeDeleted：撤销操作是放回被永久删除的记录
+func (tx *memoryTx) PurgeDeleted(before time.Time) (int, int, error) {
+	users, posts := tx.usersIn(true), tx.postsIn(true)
+	purgedUsers, purgedPosts, err := tx.MemoryStore.PurgeDeleted(before)
+	if err != nil {
+		return 0, 0, err
+	}
+	tx.undo = append(tx.undo, func() {
+		for _, user := range users {
+			tx.users.Set(user.ID, user)
+		}
+		for _, post := range posts {
+			tx.posts.Set(post.ID, post)
+		}
+	})
+	return purgedUsers, purgedPosts, nil
+}
+
+// Commit：保留全部修改并释放写锁
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.base.writers.Unlock()
+	return nil
+}
+
+// Rollback：按相反的顺序执行撤销操作并释放写锁；已经提交或回滚时不做任何事
+func (tx *memoryTx) Rollback() error {
+	if tx.done {
+		return nil
+	}
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.done = true
+	tx.base.writers.Unlock()
+	return nil
+}
+
+// Close：结束事务，未提交的修改被撤销
+func (tx *memoryTx) Close() error {
+	return tx.Rollback()
+}
+
+// SQLiteStore：基于SQLite的持久化存储，数据保存在磁盘文件中，重启后仍然存在
+// 设计与11-database.go中的DatabaseManager一致：结构体封装*sql.DB，通过方法提供数据操作
+type SQLiteStore struct {
+	db   *sql.DB // 数据库连接对象，*sql.DB是线程安全的，可在多个goroutine中共享
+	conn sqlConn // 执行查询的对象：平时就是db，事务中是*sql.Tx
+	tx   *sql.Tx // 当前事务，不在事务中时为nil
+}
+
+// NewSQLiteStore：打开（或创建）SQLite数据库文件并初始化表结构
+// 参数：dbPath - 数据库文件路径
+func NewSQLiteStore(dbPath string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开数据库: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("无法连接到数据库: %w", err)
+	}
+
+	// SQLite同一时刻只允许一个写事务，多个连接并发写入会得到"database is locked"错误
+	// 限制连接池只有一个连接，让database/sql在连接上排队，由它负责并发请求的串行化
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db, conn: db}
+	if err := s.InitializeSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// InitializeSchema：创建users和posts表（如果不存在）
+// 时间字段使用TEXT保存RFC3339字符串，与User.Created、Post.Date的格式保持一致
+func (s *SQLiteStore) InitializeSchema() error {
+	userTable := `
+    CREATE TABLE IF NOT EXISTS users (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,  -- 自增主键
+        name TEXT NOT NULL,                    -- 用户名
+        email TEXT NOT NULL,                   -- 用户邮箱
+        age INTEGER NOT NULL,                  -- 用户年龄
+        created TEXT NOT NULL,                 -- 创建时间（RFC3339）
+        version INTEGER NOT NULL DEFAULT 1,    -- 版本号，每次修改加一
+        deleted_at TEXT                        -- 删除时间（RFC3339），NULL表示未删除
+    );`
+
+	postTable := `
+    CREATE TABLE IF NOT EXISTS posts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,  -- 自增主键
+        title TEXT NOT NULL,                   -- 帖子标题
+        content TEXT NOT NULL,                 -- 帖子内容
+        author_id INTEGER NOT NULL,            -- 作者的用户ID
+        date TEXT NOT NULL,                    -- 发布时间（RFC3339）
+        version INTEGER NOT NULL DEFAULT 1,    -- 版本号，每次修改加一
+        deleted_at TEXT                        -- 删除时间（RFC3339），NULL表示未删除
+    );`
+
+	if _, err := s.db.Exec(userTable); err != nil {
+		return fmt.Errorf("创建用户表失败: %w", err)
+	}
+	if _, err := s.db.Exec(postTable); err != nil {
+		return fmt.Errorf("创建帖子表失败: %w", err)
+	}
+
+	// 旧版本创建的数据库文件没有version列，CREATE TABLE IF NOT EXISTS不会修改已有的表，需要单独补上
+	for _, table := range []string{"users", "posts"} {
+		if err := s.ensureColumn(table, "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+	}
+	if err := s.migratePostAuthors(); err != nil {
+		return err
+	}
+	// deleted_at同理；迁移帖子作者时重建的posts表没有这一列，所以放在迁移之后补
+	for _, table := range []string{"users", "posts"} {
+		if err := s.ensureColumn(table, "deleted_at", "TEXT"); err != nil {
+			return err
+		}
+	}
+	// 按作者查询帖子（用户的帖子列表、删除用户）使用的索引；重建posts表会丢失索引，同样放在迁移之后
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_posts_author_id ON posts (author_id)`); err != nil {
+		return fmt.Errorf("创建帖子作者索引失败: %w", err)
+	}
+	return nil
+}
+
+// hasColumn：判断表中是否有指定列
+// PRAGMA table_info返回表的每一列，第二个字段是列名
+func (s *SQLiteStore) hasColumn(table, column string) (bool, error) {
+	rows, err := s.db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return false, fmt.Errorf("读取%s表结构失败: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("读取%s表结构失败: %w", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("读取%s表结构失败: %w", table, err)
+	}
+	return false, nil
+}
+
+// ensureColumn：表中没有指定列时执行ALTER TABLE添加该列
+func (s *SQLiteStore) ensureColumn(table, column, definition string) error {
+	exists, err := s.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := s.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return fmt.Errorf("为%s表添加%s列失败: %w", table, column, err)
+	}
+	return nil
+}
+
+// migratePostAuthors：把旧数据库中posts表的author（作者名称）列迁移为author_id（用户ID）
+// SQLite不能直接修改或删除带NOT NULL约束的列，标准做法是在事务中新建表、复制数据、删除旧表再改名
+// 作者名称按users.name匹配用户ID；找不到同名用户的帖子author_id为0，表示作者未知
+func (s *SQLiteStore) migratePostAuthors() error {
+	legacy, err := s.hasColumn("posts", "author")
+	if err != nil || !legacy {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始迁移事务失败: %w", err)
+	}
+	defer tx.Rollback() // Commit成功后Rollback不会产生任何效果
+
+	// 作者名称找不到对应用户的帖子：为每个这样的名称创建一个占位用户，帖子归到占位用户名下
+	// 不能把author_id设为0：指向不存在用户的帖子破坏引用完整性，之后也无法再通过PUT、PATCH修改
+	// 占位用户的邮箱使用保留的.invalid域名，管理员可以之后修改用户信息，或用reassign策略把帖子转给真正的作者
+	if _, err := tx.Exec(`UPDATE posts SET author = '未知作者' WHERE TRIM(author) = ''`); err != nil {
+		return fmt.Errorf("迁移帖子作者失败: %w", err)
+	}
+	orphans, err := legacyOrphanAuthors(tx)
+	if err != nil {
+		return err
+	}
+	created := time.Now().Format(time.RFC3339)
+	for i, name := range orphans {
+		email := fmt.Sprintf("legacy-author-%d@example.invalid", i+1)
+		if _, err := tx.Exec(`INSERT INTO users (name, email, age, created) VALUES (?, ?, 0, ?)`, name, email, created); err != nil {
+			return fmt.Errorf("创建占位用户失败: %w", err)
+		}
+	}
+
+	// 每个作者名称现在都有对应的用户；author_id列是NOT NULL，子查询万一没有结果，插入会失败、整个迁移回滚
+	statements := []string{
+		`CREATE TABLE posts_new (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            title TEXT NOT NULL,
+            content TEXT NOT NULL,
+            author_id INTEGER NOT NULL,
+            date TEXT NOT NULL,
+            version INTEGER NOT NULL DEFAULT 1
+        )`,
+		`INSERT INTO posts_new (id, title, content, author_id, date, version)
+            SELECT p.id, p.title, p.content,
+                   (SELECT u.id FROM users u WHERE u.name = p.author ORDER BY u.id LIMIT 1),
+                   p.date, p.version
+            FROM posts p`,
+		`DROP TABLE posts`,
+		`ALTER TABLE posts_new RENAME TO posts`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("迁移帖子作者失败: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("迁移帖子作者失败: %w", err)
+	}
+	if len(orphans) > 0 {
+		fmt.Printf("迁移帖子作者：%d个作者名称没有对应的用户，已创建同名的占位用户: %s\n", len(orphans), strings.Join(orphans, "、"))
+	}
+	return nil
+}
+
+// legacyOrphanAuthors：旧posts表中找不到同名用户的作者名称
+func legacyOrphanAuthors(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT author FROM posts WHERE author NOT IN (SELECT name FROM users) ORDER BY author`)
+	if err != nil {
+		return nil, fmt.Errorf("查询帖子作者失败: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("查询帖子作者失败: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("查询帖子作者失败: %w", err)
+	}
+	return names, nil
+}
+
+// 查询用户和帖子时选择的列，顺序与scanUsers、scanPosts中Scan的参数一致
+// deleted_at为NULL表示未删除，COALESCE把它转换为空字符串，对应DeletedAt的零值
+const (
+	userColumns = `id, name, email, age, created, version, COALESCE(deleted_at, '')`
+	postColumns = `id, title, content, author_id, date, version, COALESCE(deleted_at, '')`
+)
+
+// ListUsers：查询所有未删除的用户
+func (s *SQLiteStore) ListUsers() ([]User, error) {
+	rows, err := s.conn.Query(`SELECT ` + userColumns + ` FROM users WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	return scanUsers(rows)
+}
+
+// ListUsersAfter：按主键做键集分页（keyset pagination）
+// 每批查询完成后立即释放连接，导出大量用户时不会长时间占用单连接的连接池
+func (s *SQLiteStore) ListUsersAfter(afterID, limit int) ([]User, error) {
+	rows, err := s.conn.Query(`SELECT `+userColumns+` FROM users WHERE id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?`, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	return scanUsers(rows)
+}
+
+// scanUsers：读取查询结果中的全部用户并关闭rows，供ListUsers和ListUsersAfter共用
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	defer rows.Close()
+
+	userList := make([]User, 0)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Age, &user.Created, &user.Version, &user.DeletedAt); err != nil {
+			return nil, fmt.Errorf("扫描用户失败: %w", err)
+		}
+		userList = append(userList, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行迭代错误: %w", err)
+	}
+	return userList, nil
+}
+
+// GetUser：根据ID查询未删除的用户，查询结果为空时返回ErrNotFound
+func (s *SQLiteStore) GetUser(id int) (*User, error) {
+	var user User
+	err := s.conn.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Age, &user.Created, &user.Version, &user.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	return &user, nil
+}
+
+// maxSQLVariables：一条SQL语句中绑定参数的数量上限
+// 旧版本SQLite默认最多允许999个，IN列表更长时分批查询
+const maxSQLVariables = 500
+
+// GetUsers：用WHERE id IN (...)一次查询一批用户
+func (s *SQLiteStore) GetUsers(ids []int) ([]User, error) {
+	users := make([]User, 0, len(ids))
+	for start := 0; start < len(ids); start += maxSQLVariables {
+		batch := ids[start:min(start+maxSQLVariables, len(ids))]
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := s.conn.Query(`SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders+`) AND deleted_at IS NULL`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("查询用户失败: %w", err)
+		}
+		found, err := scanUsers(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, found...)
+	}
+	return users, nil
+}
+
+// CreateUser：插入用户并把自增ID写回user
+func (s *SQLiteStore) CreateUser(user *User) error {
+	result, err := s.conn.Exec(`INSERT INTO users (name, email, age, created) VALUES (?, ?, ?, ?)`,
+		user.Name, user.Email, user.Age, user.Created)
+	if err != nil {
+		return fmt.Errorf("创建用户失败: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("获取用户ID失败: %w", err)
+	}
+	user.ID = int(id)
+	user.Version = 1
+	user.DeletedAt = ""
+	return nil
+}
+
+// UpdateUser：更新用户并把版本号加一
+// WHERE子句同时匹配ID和版本号，版本比较和写入在同一条UPDATE语句中完成，不会被其他请求插入
+func (s *SQLiteStore) UpdateUser(user *User) error {
+	result, err := s.conn.Exec(`UPDATE users SET name = ?, email = ?, age = ?, created = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+		user.Name, user.Email, user.Age, user.Created, user.ID, user.Version)
+	if err != nil {
+		return fmt.Errorf("更新用户失败: %w", err)
+	}
+	if err := checkVersionedWrite(s.conn, result, "users", user.ID); err != nil {
+		return err
+	}
+	user.Version++
+	return nil
+}
+
+// DeleteUser：在一个事务中按policy处理用户名下的帖子，并把指定版本的用户移入回收站
+// 事务保证"处理帖子"和"删除用户"要么都完成，要么都不发生
+func (s *SQLiteStore) DeleteUser(id, version int, policy UserDeletePolicy) ([]Post, error) {
+	var owned []Post
+	deletedAt := time.Now().UTC().Format(deletedAtLayout)
+	err := s.inTx(func(tx sqlConn) error {
+		var current int
+		err := tx.QueryRow(`SELECT version FROM users WHERE id = ? AND deleted_at IS NULL`, id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("查询用户失败: %w", err)
+		}
+		if current != version {
+			return ErrVersionConflict
+		}
+
+		rows, err := tx.Query(`SELECT `+postColumns+` FROM posts WHERE author_id = ? AND deleted_at IS NULL`, id)
+		if err != nil {
+			return fmt.Errorf("查询帖子失败: %w", err)
+		}
+		if owned, err = scanPosts(rows); err != nil {
+			return err
+		}
+
+		switch policy.Mode {
+		case deleteReject:
+			if len(owned) > 0 {
+				return ErrUserHasPosts
+			}
+		case deleteCascade:
+			if _, err := tx.Exec(`UPDATE posts SET deleted_at = ?, version = version + 1 WHERE author_id = ? AND deleted_at IS NULL`, deletedAt, id); err != nil {
+				return fmt.Errorf("删除帖子失败: %w", err)
+			}
+			for i := range owned {
+				owned[i].DeletedAt = deletedAt
+				owned[i].Version++
+			}
+		case deleteReassign:
+			var exists int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND deleted_at IS NULL`, policy.ReassignTo).Scan(&exists); err != nil {
+				return fmt.Errorf("查询用户失败: %w", err)
+			}
+			if exists == 0 || policy.ReassignTo == id {
+				return ErrAuthorNotFound
+			}
+			if _, err := tx.Exec(`UPDATE posts SET author_id = ?, version = version + 1 WHERE author_id = ? AND deleted_at IS NULL`, policy.ReassignTo, id); err != nil {
+				return fmt.Errorf("转移帖子失败: %w", err)
+			}
+			for i := range owned {
+				owned[i].AuthorID = policy.ReassignTo
+				owned[i].Version++
+			}
+		default:
+			return fmt.Errorf("未知的删除策略: %s", policy.Mode)
+		}
+
+		if _, err := tx.Exec(`UPDATE users SET deleted_at = ?, version = version + 1 WHERE id = ?`, deletedAt, id); err != nil {
+			return fmt.Errorf("删除用户失败: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
+
+// ListPosts：查询所有未删除的帖子
+func (s *SQLiteStore) ListPosts() ([]Post, error) {
+	rows, err := s.conn.Query(`SELECT ` + postColumns + ` FROM posts WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("查询帖子失败: %w", err)
+	}
+	return scanPosts(rows)
+}
+
+// ListPostsByAuthor：按author_id查询，posts表在author_id上建有索引
+func (s *SQLiteStore) ListPostsByAuthor(authorID int) ([]Post, error) {
+	rows, err := s.conn.Query(`SELECT `+postColumns+` FROM posts WHERE author_id = ? AND deleted_at IS NULL`, authorID)
+	if err != nil {
+		return nil, fmt.Errorf("查询帖子失败: %w", err)
+	}
+	return scanPosts(rows)
+}
+
+// scanPosts：读取查询结果中的全部帖子并关闭rows，供ListPosts、ListPostsByAuthor和DeleteUser共用
+func scanPosts(rows *sql.Rows) ([]Post, error) {
+	defer rows.Close()
+
+	postList := make([]Post, 0)
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.Date, &post.Version, &post.DeletedAt); err != nil {
+			return nil, fmt.Errorf("扫描帖子失败: %w", err)
+		}
+		postList = append(postList, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行迭代错误: %w", err)
+	}
+	return postList, nil
+}
+
+// GetPost：根据ID查询未删除的帖子，查询结果为空时返回ErrNotFound
+func (s *SQLiteStore) GetPost(id int) (*Post, error) {
+	var post Post
+	err := s.conn.QueryRow(`SELECT `+postColumns+` FROM posts WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.Date, &post.Version, &post.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询帖子失败: %w", err)
+	}
+	return &post, nil
+}
+
+// CreatePost：插入帖子并把自增ID写回post
+// INSERT ... SELECT ... WHERE EXISTS在一条语句中完成"检查作者存在"和"插入"，作者不存在时不插入任何行
+func (s *SQLiteStore) CreatePost(post *Post) error {
+	result, err := s.conn.Exec(`INSERT INTO posts (title, content, author_id, date)
+        SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL)`,
+		post.Title, post.Content, post.AuthorID, post.Date, post.AuthorID)
+	if err != nil {
+		return fmt.Errorf("创建帖子失败: %w", err)
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("获取影响行数失败: %w", err)
+	} else if inserted == 0 {
+		return ErrAuthorNotFound
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("获取帖子ID失败: %w", err)
+	}
+	post.ID = int(id)
+	post.Version = 1
+	post.DeletedAt = ""
+	return nil
+}
+
+// UpdatePost：在事务中检查作者存在后更新帖子，并把版本号加一
+func (s *SQLiteStore) UpdatePost(post *Post) error {
+	err := s.inTx(func(tx sqlConn) error {
+		result, err := tx.Exec(`UPDATE posts SET title = ?, content = ?, author_id = ?, date = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+			post.Title, post.Content, post.AuthorID, post.Date, post.ID, post.Version)
+		if err != nil {
+			return fmt.Errorf("更新帖子失败: %w", err)
+		}
+		if err := checkVersionedWrite(tx, result, "posts", post.ID); err != nil {
+			return err
+		}
+		var authors int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND deleted_at IS NULL`, post.AuthorID).Scan(&authors); err != nil {
+			return fmt.Errorf("查询用户失败: %w", err)
+		}
+		if authors == 0 {
+			return ErrAuthorNotFound // inTx会撤销上面的UPDATE
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	post.Version++
+	return nil
+}
+
+// DeletePost：把指定版本的帖子移入回收站
+func (s *SQLiteStore) DeletePost(id, version int) error {
+	result, err := s.conn.Exec(`UPDATE posts SET deleted_at = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+		time.Now().UTC().Format(deletedAtLayout), id, version)
+	if err != nil {
+		return fmt.Errorf("删除帖子失败: %w", err)
+	}
+	return checkVersionedWrite(s.conn, result, "posts", id)
+}
+
+// ListDeletedUsers：查询回收站中的用户
+func (s *SQLiteStore) ListDeletedUsers() ([]User, error) {
+	rows, err := s.conn.Query(`SELECT ` + userColumns + ` FROM users WHERE deleted_at IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	return scanUsers(rows)
+}
+
+// ListDeletedPosts：查询回收站中的帖子
+func (s *SQLiteStore) ListDeletedPosts() ([]Post, error) {
+	rows, err := s.conn.Query(`SELECT ` + postColumns + ` FROM posts WHERE deleted_at IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("查询帖子失败: %w", err)
+	}
+	return scanPosts(rows)
+}
+
+// RestoreUser：在一个事务中恢复用户，以及deleted_at与用户相同（即随用户级联删除）的帖子
+func (s *SQLiteStore) RestoreUser(id int) (*User, []Post, error) {
+	var user User
+	var restored []Post
+	err := s.inTx(func(tx sqlConn) error {
+		err := tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ? AND deleted_at IS NOT NULL`, id).
+			Scan(&user.ID, &user.Name, &user.Email, &user.Age, &user.Created, &user.Version, &user.DeletedAt)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("查询用户失败: %w", err)
+		}
+
+		rows, err := tx.Query(`SELECT `+postColumns+` FROM posts WHERE author_id = ? AND deleted_at = ? ORDER BY id`, id, user.DeletedAt)
+		if err != nil {
+			return fmt.Errorf("查询帖子失败: %w", err)
+		}
+		if restored, err = scanPosts(rows); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE posts SET deleted_at = NULL, version = version + 1 WHERE author_id = ? AND deleted_at = ?`, id, user.DeletedAt); err != nil {
+			return fmt.Errorf("恢复帖子失败: %w", err)
+		}
+		if _, err := tx.Exec(`UPDATE users SET deleted_at = NULL, version = version + 1 WHERE id = ?`, id); err != nil {
+			return fmt.Errorf("恢复用户失败: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range restored {
+		restored[i].DeletedAt = ""
+		restored[i].Version++
+	}
+	user.DeletedAt = ""
+	user.Version++
+	return &user, restored, nil
+}
+
+// RestorePost：恢复帖子，UPDATE的条件同时检查帖子在回收站中、作者存在且未删除
+// 没有命中时再查询一次，区分"帖子不在回收站中"和"作者不存在"
+func (s *SQLiteStore) RestorePost(id int) (*Post, error) {
+	var post Post
+	err := s.inTx(func(tx sqlConn) error {
+		result, err := tx.Exec(`UPDATE posts SET deleted_at = NULL, version = version + 1
+            WHERE id = ? AND deleted_at IS NOT NULL
+            AND EXISTS (SELECT 1 FROM users WHERE users.id = posts.author_id AND users.deleted_at IS NULL)`, id)
+		if err != nil {
+			return fmt.Errorf("恢复帖子失败: %w", err)
+		}
+		restored, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("获取影响行数失败: %w", err)
+		}
+		if restored == 0 {
+			var trashed int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM posts WHERE id = ? AND deleted_at IS NOT NULL`, id).Scan(&trashed); err != nil {
+				return fmt.Errorf("查询帖子失败: %w", err)
+			}
+			if trashed == 0 {
+				return ErrNotFound
+			}
+			return ErrAuthorNotFound
+		}
+		err = tx.QueryRow(`SELECT `+postColumns+` FROM posts WHERE id = ?`, id).
+			Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.Date, &post.Version, &post.DeletedAt)
+		if err != nil {
+			return fmt.Errorf("查询帖子失败: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// PurgeDeleted：在一个事务中永久删除过期的回收站记录
+// 先删除帖子（包括即将被永久删除的用户名下的帖子），再删除用户
+// deleted_at按字符串比较：写入时和这里的cutoff都是UTC的deletedAtLayout格式，字符串顺序就是时间顺序
+func (s *SQLiteStore) PurgeDeleted(before time.Time) (int, int, error) {
+	cutoff := before.UTC().Format(deletedAtLayout)
+	var users, posts int64
+	err := s.inTx(func(tx sqlConn) error {
+		result, err := tx.Exec(`DELETE FROM posts WHERE deleted_at IS NOT NULL
+            AND (deleted_at < ? OR author_id IN (SELECT id FROM users WHERE deleted_at < ?))`, cutoff, cutoff)
+		if err != nil {
+			return fmt.Errorf("清理帖子失败: %w", err)
+		}
+		if posts, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("获取影响行数失败: %w", err)
+		}
+		result, err = tx.Exec(`DELETE FROM users WHERE deleted_at < ?`, cutoff)
+		if err != nil {
+			return fmt.Errorf("清理用户失败: %w", err)
+		}
+		if users, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("获取影响行数失败: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(users), int(posts), nil
+}
+
+// Close：关闭数据库连接
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Count：用COUNT(*)在数据库中计数，不把记录读入内存
+// 与Ping一样使用s.db并遵守ctx：批量操作的事务占用唯一的连接时，查询在ctx超时后返回错误，而不是一直等待
+func (s *SQLiteStore) Count(ctx context.Context) (users, posts int, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT
+	    (SELECT COUNT(*) FROM users WHERE deleted_at IS NULL),
+	    (SELECT COUNT(*) FROM posts WHERE deleted_at IS NULL)`).Scan(&users, &posts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("统计记录数失败: %w", err)
+	}
+	return users, posts, nil
+}
+
+// Ping：执行一条最简单的查询，确认数据库可以读取
+// 连接池只有一个连接，长事务占用连接时查询会等待，ctx超时后返回错误，就绪探针据此报告存储不可用
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	var one int
+	if err := s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("数据库不可用: %w", err)
+	}
+	return nil
+}
+
+// sqlConn：*sql.DB和*sql.Tx共有的查询方法，SQLiteStore的方法和辅助函数在事务内外使用同一套代码
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// inTx：在事务中执行fn，fn返回错误时撤销fn所做的全部修改
+// 不在事务中时开启一个新事务；已经处于事务中（批量操作）时使用保存点（SAVEPOINT），只撤销fn自己的修改，外层事务继续
+// 注意：连接池只有一个连接，事务进行期间只能通过tx执行语句，使用s.db会一直等待连接而死锁
+func (s *SQLiteStore) inTx(fn func(tx sqlConn) error) error {
+	if s.tx != nil {
+		if _, err := s.tx.Exec(`SAVEPOINT store_op`); err != nil {
+			return fmt.Errorf("创建保存点失败: %w", err)
+		}
+		if err := fn(s.tx); err != nil {
+			s.tx.Exec(`ROLLBACK TO store_op`)
+			s.tx.Exec(`RELEASE store_op`)
+			return err
+		}
+		if _, err := s.tx.Exec(`RELEASE store_op`); err != nil {
+			return fmt.Errorf("释放保存点失败: %w", err)
+		}
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+	return nil
+}
+
+// Begin：开始事务，返回的事务与SQLiteStore共用同一套方法，只是语句在*sql.Tx上执行
+// 事务占用连接池中唯一的连接，其他请求在事务结束前排队等待
+func (s *SQLiteStore) Begin() (Tx, error) {
+	if s.tx != nil {
+		return nil, errNestedTx
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("开始事务失败: %w", err)
+	}
+	return &sqliteTx{&SQLiteStore{db: s.db, conn: tx, tx: tx}}, nil
+}
+
+// sqliteTx：SQLite存储的事务
+type sqliteTx struct {
+	*SQLiteStore
+}
+
+// Commit：提交事务
+func (tx *sqliteTx) Commit() error {
+	if err := tx.tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+	return nil
+}
+
+// Rollback：回滚事务；已经提交或回滚时不做任何事
+func (tx *sqliteTx) Rollback() error {
+	if err := tx.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return fmt.Errorf("回滚事务失败: %w", err)
+	}
+	return nil
+}
+
+// Close：结束事务，未提交的修改被撤销；不能关闭共享的数据库连接
+func (tx *sqliteTx) Close() error {
+	return tx.Rollback()
+}
+
+// checkVersionedWrite：检查带版本条件的UPDATE是否命中记录
+// 未命中有两种原因：记录不存在或在回收站中（ErrNotFound），或版本号已经变化（ErrVersionConflict），再查询一次加以区分
+func checkVersionedWrite(q sqlConn, result sql.Result, table string, id int) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %w", err)
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	var exists int
+	err = q.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE id = ? AND deleted_at IS NULL`, id).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("查询记录失败: %w", err)
+	}
+	if exists == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
+
+// newStore：根据存储类型创建对应的Store实现
+// 参数：kind - "memory"或"sqlite"；dbPath - SQLite数据库文件路径（仅sqlite使用）
+func newStore(kind, dbPath string) (Store, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		return NewSQLiteStore(dbPath)
+	default:
+		return nil, fmt.Errorf("未知的存储类型: %s（可选值: memory、sqlite）", kind)
+	}
+}
+
+// 3. 中间件
+// 中间件（Middleware）是Go Web开发中的重要概念，用于在请求到达处理器之前或之后添加额外逻辑
+// 典型用途：日志记录、身份验证、跨域处理、错误处理等
+// 实现原理：接收一个http.HandlerFunc作为参数，返回一个新的http.HandlerFunc
+
+// logger：结构化日志记录器，每条日志输出为一行JSON，便于日志系统采集和检索
+// slog的用法与12-advanced-topics.go中的Logger接口一致：消息加若干键值对字段
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// requestIDKey：请求ID在context中的键
+type requestIDKey struct{}
+
+// maxRequestIDLength：客户端传入的X-Request-ID的最大长度，超长或含非法字符时重新生成
+const maxRequestIDLength = 128
+
+// requestIDFrom：从context中取出请求ID，没有时返回空字符串
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger：返回带有请求ID字段的日志记录器，处理器用它记录的日志可以与访问日志关联起来
+func requestLogger(r *http.Request) *slog.Logger {
+	return logger.With("request_id", requestIDFrom(r.Context()))
+}
+
+// newRequestID：生成16字节随机数的十六进制字符串作为请求ID
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// validRequestID：只接受长度合理、由可见ASCII字符组成的请求ID，防止客户端向日志中注入换行等控制字符
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder：包装http.ResponseWriter，记录处理器写出的状态码和响应体字节数
+// 原始的ResponseWriter不提供读取这些信息的方法，中间件只能通过包装来获得
+type responseRecorder struct {
+	http.ResponseWriter
+	status int // 响应状态码，处理器没有调用WriteHeader时为200
+	bytes  int // 已写出的响应体字节数
+}
+
+// WriteHeader：记录状态码后转发给原始的ResponseWriter
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write：累计写出的字节数；没有显式调用WriteHeader时，第一次Write隐含200状态码
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap：返回原始的ResponseWriter，http.ResponseController通过它找到Flush、SetWriteDeadline等能力
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// loggingMiddleware：日志中间件，为每个请求分配请求ID并输出一行JSON访问日志
+// 功能：记录请求方法、路径、状态码、响应字节数、耗时、客户端地址、User-Agent和请求ID
+// 请求ID优先使用客户端（或上游网关）传入的X-Request-ID，没有时生成新的；
+// 它会写入响应头，并保存在请求的context中，处理器通过requestLogger(r)记录的日志会带上同一个ID
+// 日志在defer中输出（与metricsMiddleware相同）：处理器以panic中断响应时（例如流式导出中途出错）也会留下一行aborted为true的日志
+// 参数：next http.HandlerFunc - 下一个要执行的处理器函数
+// 返回值：包装后的处理器函数
+func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	// 返回一个匿名函数作为新的处理器
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now() // 记录请求处理开始时间
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			aborted := recover()
+			if rec.status == 0 {
+				rec.status = http.StatusOK // 处理器什么都没写，net/http会返回200
+			}
+			level, attrs := slog.LevelInfo, []slog.Attr{
+				slog.String("request_id", id),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status),
+				slog.Int("bytes", rec.bytes),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			}
+			if aborted != nil {
+				level, attrs = slog.LevelError, append(attrs, slog.Bool("aborted", true))
+			}
+			logger.LogAttrs(r.Context(), level, "access", attrs...)
+			if aborted != nil {
+				panic(aborted) // 记录之后继续向上传递，由net/http中断连接
+			}
+		}()
+		next(rec, r) // 调用下一个处理器，继续处理请求（核心：中间件链的传递）
+	}
+}
+
+// CORSPolicy：跨域资源共享（CORS）策略，决定哪些网页可以跨域调用API
+// 浏览器发起跨域请求时会带上Origin请求头，服务器通过Access-Control-*响应头告诉浏览器是否允许页面读取响应
+// 策略可以作为全局默认值，也可以通过Route.CORS为单条路由单独指定
+type CORSPolicy struct {
+	AllowedOrigins   []string      // 允许的源：精确值（https://app.example.com）、通配子域名（https://*.example.com）或"*"（任意源）
+	AllowedHeaders   []string      // 预检请求中允许的请求头
+	ExposedHeaders   []string      // 允许页面脚本读取的响应头（默认只能读取Content-Type等少数几个）
+	AllowCredentials bool          // 是否允许携带Cookie、Authorization等凭证
+	MaxAge           time.Duration // 浏览器缓存预检结果的时间，0表示不缓存
+}
+
+// NewCORSPolicy：根据源列表创建策略，请求头和暴露的响应头使用本服务的默认值
+// 规范禁止在允许凭证时使用"*"：否则任意网站都能以用户身份调用API，这里直接返回错误
+func NewCORSPolicy(origins []string, allowCredentials bool, maxAge time.Duration) (*CORSPolicy, error) {
+	for _, origin := range origins {
+		if origin == "*" && allowCredentials {
+			return nil, errors.New("允许携带凭证时不能使用\"*\"作为允许的源，请列出具体的源")
+		}
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return nil, fmt.Errorf("无效的源 %q：需要包含协议，例如https://app.example.com", origin)
+		}
+	}
+	return &CORSPolicy{
+		AllowedOrigins:   origins,
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "If-Match", "If-None-Match", "X-Request-ID", "Last-Event-ID", idempotencyHeader},
+		ExposedHeaders:   []string{"ETag", "Link", "X-Total-Count", "X-Request-ID", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", idempotentReplayedHeader},
+		AllowCredentials: allowCredentials,
+		MaxAge:           maxAge,
+	}, nil
+}
+
+// allowsOrigin：判断源是否在允许列表中
+// 源的格式为"协议://主机[:端口]"，比较时忽略大小写；通配子域名只匹配子域名，不匹配主域名本身
+// 例如https://*.example.com匹配https://app.example.com，但不匹配https://example.com和http://app.example.com
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(allowed, "*.")
+		if !ok || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, "."+suffix) {
+			continue
+		}
+		// 通配符部分只能是主机名中的标签（字母、数字、连字符和点），防止匹配到https://evil.com/.example.com之类的值
+		label := origin[len(prefix) : len(origin)-len(suffix)-1]
+		if label != "" && strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-.") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin：策略是否允许任意源（此时可以直接返回"*"）
+func (p *CORSPolicy) anyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// setOriginHeaders：为允许的源写入Access-Control-Allow-Origin和Access-Control-Allow-Credentials
+func (p *CORSPolicy) setOriginHeaders(h http.Header, origin string) {
+	if p.anyOrigin() && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// 回显具体的源：允许凭证时规范要求如此，使用允许列表时也只能这样表达
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// sameOriginOnly：不允许任何跨域访问的策略，用于只给服务端或同源页面使用的路由
+var sameOriginOnly = &CORSPolicy{}
+
+// corsMiddleware：跨域资源共享中间件，按请求匹配到的路由选择CORS策略
+// 路由没有单独指定策略时使用defaultPolicy
+//   - 普通跨域请求：源在允许列表中时写入Access-Control-Allow-Origin等响应头，然后照常处理请求
+//   - 预检请求（带Access-Control-Request-Method头的OPTIONS请求）：浏览器在发送非简单请求前先询问服务器，
+//     这里按"将要发送的方法"查找路由和策略，直接返回204，不会进入认证和处理器
+//
+// 响应内容随Origin请求头变化，因此总是带上Vary: Origin，防止共享缓存把一个源的响应返回给另一个源
+func corsMiddleware(router *Router, defaultPolicy *CORSPolicy) Middleware {
+	policyFor := func(r *http.Request) *CORSPolicy {
+		if route := router.Lookup(r); route != nil && route.cors != nil {
+			return route.cors
+		}
+		return defaultPolicy
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if origin == "" {
+				next(w, r) // 不是跨域请求（或不是浏览器发出的请求）
+				return
+			}
+
+			requestedMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method == http.MethodOptions && requestedMethod != "" {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+
+				// 用浏览器将要发送的方法查找路由，得到该路由的策略
+				actual := r.Clone(r.Context())
+				actual.Method = requestedMethod
+				route := router.Lookup(actual)
+				policy := policyFor(actual)
+				if route == nil || !policy.allowsOrigin(origin) {
+					// 不写CORS响应头，浏览器会拒绝随后的实际请求
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+
+				policy.setOriginHeaders(h, origin)
+				h.Set("Access-Control-Allow-Methods", requestedMethod)
+				h.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+				if policy.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge/time.Second)))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if policy := policyFor(r); policy.allowsOrigin(origin) {
+				policy.setOriginHeaders(h, origin)
+				if len(policy.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next(w, r) // 继续处理请求；源不被允许时同样处理，只是浏览器不会把响应交给页面脚本
+		}
+	}
+}
+
+// 3.1 请求校验与错误响应
+// 校验错误沿用8-error-handling.go中的ValidationError和ValidationErrors：
+// 单个字段的问题用ValidationError描述，多个问题聚合为ValidationErrors一次性返回，
+// 客户端因此可以一次看到所有无效字段，而不是修改一个再发现下一个
+
+// ValidationError：字段验证错误，包含具体字段名和错误信息
+type ValidationError struct {
+	Field   string // 出错的字段名（使用JSON字段名，便于客户端对应表单字段）
+	Message string // 错误描述信息
+}
+
+// Error()方法：实现error接口，返回格式化的错误信息
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("字段 %s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors：验证错误聚合类型，实现error接口
+// 用途：一次性返回多个验证错误，便于批量处理
+type ValidationErrors struct {
+	Errors []error // 存储多个错误的切片
+}
+
+// Error()方法：实现error接口，将所有错误信息合并为一个字符串
+func (e *ValidationErrors) Error() string {
+	var messages []string
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	// 用分号分隔多个错误信息
+	return fmt.Sprintf("验证失败: %s", strings.Join(messages, "; "))
+}
+
+// Add：追加一个字段错误
+func (e *ValidationErrors) Add(field, message string) {
+	e.Errors = append(e.Errors, &ValidationError{Field: field, Message: message})
+}
+
+// Unwrap：返回全部字段错误，errors.As(err, &ve)可以直接取出其中第一个*ValidationError
+func (e *ValidationErrors) Unwrap() []error {
+	return e.Errors
+}
+
+// Err：没有任何错误时返回nil，否则返回自身
+// 注意：必须显式返回nil，直接返回值为nil的*ValidationErrors会得到"非nil的error接口"
+func (e *ValidationErrors) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate：校验用户数据，返回所有不合法的字段
+func (u *User) Validate() error {
+	errs := &ValidationErrors{}
+	name := strings.TrimSpace(u.Name)
+	if name == "" {
+		errs.Add("name", "不能为空")
+	} else if len([]rune(name)) > 50 {
+		errs.Add("name", "长度不能超过50个字符")
+	}
+
+	// 邮箱必须恰好包含一个@，且@两侧都不为空
+	if u.Email == "" {
+		errs.Add("email", "不能为空")
+	} else if parts := strings.Split(u.Email, "@"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		errs.Add("email", "格式不正确")
+	}
+
+	if u.Age < 0 || u.Age > 150 {
+		errs.Add("age", "必须在0到150之间")
+	}
+	return errs.Err()
+}
+
+// Validate：校验帖子数据，返回所有不合法的字段
+func (p *Post) Validate() error {
+	errs := &ValidationErrors{}
+	title := strings.TrimSpace(p.Title)
+	if title == "" {
+		errs.Add("title", "不能为空")
+	} else if len([]rune(title)) > 100 {
+		errs.Add("title", "长度不能超过100个字符")
+	}
+	if strings.TrimSpace(p.Content) == "" {
+		errs.Add("content", "不能为空")
+	}
+	if p.AuthorID <= 0 {
+		errs.Add("author_id", "必须是已存在用户的ID")
+	}
+	return errs.Err()
+}
+
+// decodeJSONBody：严格解析JSON请求体到dst（结构体指针）
+// 与直接json.NewDecoder(r.Body).Decode不同：
+// - JSON格式错误返回普通error（对应400）
+// - 未知字段、字段类型不匹配都收集为ValidationErrors（对应422），并列出全部问题
+func decodeJSONBody(body io.Reader, dst interface{}) error {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return decodeJSONObject(raw, dst)
+}
+
+// decodeJSONObject：decodeJSONBody的核心逻辑，也被合并补丁复用
+func decodeJSONObject(raw []byte, dst interface{}) error {
+	// 先解码为字段名到原始JSON的映射，逐个字段检查
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return fmt.Errorf("无效的JSON数据: %w", err)
+	}
+	if fields == nil {
+		return errors.New("无效的JSON数据: 请求体必须是JSON对象")
+	}
+
+	known := jsonFieldNames(dst)
+	errs := &ValidationErrors{}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names) // 按字段名排序，保证错误列表顺序稳定
+	for _, name := range names {
+		if !known[name] {
+			errs.Add(name, "未知字段")
+			continue
+		}
+		// 单独解码每个已知字段，把类型错误定位到具体字段
+		single, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+		if err := json.Unmarshal(single, dst); err != nil {
+			errs.Add(name, "类型不正确")
+		}
+	}
+	return errs.Err()
+}
+
+// validatable：能够自我校验的数据模型（User、Post）
+type validatable interface {
+	Validate() error
+}
+
+// checkPayload：合并"解析阶段"和"取值校验阶段"的错误，一次性列出所有无效字段
+// 参数：decodeErr - decodeJSONBody的返回值；v - 已解码的数据
+// JSON格式错误直接返回；否则在解析错误之外再运行Validate，已经报告过的字段不重复报告
+func checkPayload(decodeErr error, v validatable) error {
+	errs := &ValidationErrors{}
+	if decodeErr != nil {
+		if !errors.As(decodeErr, &errs) {
+			return decodeErr
+		}
+	}
+
+	reported := make(map[string]bool)
+	for _, err := range errs.Errors {
+		var ve *ValidationError
+		if errors.As(err, &ve) {
+			reported[ve.Field] = true
+		}
+	}
+
+	var validateErrs *ValidationErrors
+	if errors.As(v.Validate(), &validateErrs) {
+		for _, err := range validateErrs.Errors {
+			var ve *ValidationError
+			if errors.As(err, &ve) && !reported[ve.Field] {
+				errs.Errors = append(errs.Errors, ve)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// jsonFieldNames：通过反射读取结构体的json标签，返回允许出现的JSON字段名集合
+func jsonFieldNames(v interface{}) map[string]bool {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Problem：RFC 7807定义的错误响应格式（Content-Type: application/problem+json）
+// 所有API错误都使用这种统一的JSON结构，客户端可以按status和type编程处理，而不是解析纯文本
+type Problem struct {
+	Type   string           `json:"type"`             // 错误类型URI，通用错误为"about:blank"
+	Title  string           `json:"title"`            // 错误类型的简短描述
+	Status int              `json:"status"`           // HTTP状态码
+	Detail string           `json:"detail,omitempty"` // 本次错误的具体说明
+	Errors []problemField   `json:"errors,omitempty"` // 扩展字段：校验失败时列出每个无效字段
+	Rows   []ImportRowError `json:"rows,omitempty"`   // 扩展字段：批量导入失败时列出每个出错的行
+}
+
+// problemField：Problem中单个无效字段的描述
+type problemField struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeProblem：写入通用的problem+json错误响应
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	writeProblemJSON(w, Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// writeValidationProblem：写入422校验错误，列出err中包含的所有字段错误
+func writeValidationProblem(w http.ResponseWriter, err error) {
+	problem := Problem{
+		Type:   "/problems/validation-error",
+		Title:  "请求数据校验失败",
+		Status: http.StatusUnprocessableEntity,
+		Detail: err.Error(),
+		Errors: validationFields(err),
+	}
+	writeProblemJSON(w, problem)
+}
+
+// validationFields：展开校验错误，使用errors.As取出每个字段错误；err不是校验错误时返回nil
+func validationFields(err error) []problemField {
+	fieldErrs := []error{err}
+	var multi *ValidationErrors
+	if errors.As(err, &multi) {
+		fieldErrs = multi.Errors
+	}
+	var fields []problemField
+	for _, fieldErr := range fieldErrs {
+		var ve *ValidationError
+		if errors.As(fieldErr, &ve) {
+			fields = append(fields, problemField{Field: ve.Field, Message: ve.Message})
+		}
+	}
+	return fields
+}
+
+// writeRequestError：根据错误类型写入响应
+// 校验错误返回422，其余（JSON格式错误等）返回400
+func writeRequestError(w http.ResponseWriter, err error) {
+	var ve *ValidationError
+	var multi *ValidationErrors
+	if errors.As(err, &multi) || errors.As(err, &ve) {
+		writeValidationProblem(w, err)
+		return
+	}
+	writeProblem(w, http.StatusBadRequest, err.Error())
+}
+
+// writeProblemJSON：序列化Problem并设置正确的Content-Type和状态码
+func writeProblemJSON(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// 3.2 API密钥认证与授权
+// 认证（Authentication）回答"你是谁"：客户端在请求头中携带API密钥，服务器据此识别调用方
+// 授权（Authorization）回答"你能做什么"：每个密钥带有若干权限范围（scope），路由声明自己需要哪些scope
+// - 未携带密钥访问受保护的路由：401 Unauthorized
+// - 携带了密钥但缺少所需scope：403 Forbidden
+// 密钥只在签发时以明文返回一次，服务器只保存它的SHA-256哈希：即使存储泄露，攻击者也无法还原出可用的密钥
+
+// 权限范围（scope）常量
+const (
+	scopeUsersWrite   = "users:write"   // 创建、修改、删除用户
+	scopePostsWrite   = "posts:write"   // 创建、修改、删除帖子
+	scopeAPIKeysAdmin = "apikeys:admin" // 签发、吊销、查看API密钥
+	scopeTrashAdmin   = "trash:admin"   // 查看回收站，恢复已删除的用户和帖子
+)
+
+// knownScopes：允许签发的全部scope，用于校验签发请求
+var knownScopes = map[string]bool{
+	scopeUsersWrite:   true,
+	scopePostsWrite:   true,
+	scopeAPIKeysAdmin: true,
+	scopeTrashAdmin:   true,
+}
+
+// APIKey：API密钥的元数据，不包含明文密钥
+type APIKey struct {
+	ID      string   `json:"id"`                         // 公开的密钥标识，用于吊销和审计，例如"key_1"
+	Name    string   `json:"name"`                       // 密钥用途说明，例如"admin-dashboard"
+	Scopes  []string `json:"scopes"`                     // 密钥拥有的权限范围
+	Created string   `json:"created" format:"date-time"` // 签发时间（RFC3339）
+	Revoked bool     `json:"revoked"`                    // 是否已被吊销
+	hash    string   // 明文密钥的SHA-256哈希（十六进制），未导出字段不会被序列化到JSON
+	seq     int      // 签发序号，用于按签发顺序列出密钥
+}
+
+// HasScope：判断密钥是否拥有指定scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore：并发安全的API密钥存储
+type APIKeyStore struct {
+	mu     sync.RWMutex
+	byID   map[string]*APIKey // 按密钥ID索引，用于吊销和列出
+	byHash map[string]*APIKey // 按哈希索引，用于认证时查找
+	nextID *SafeCounter       // 密钥ID分配器
+}
+
+// NewAPIKeyStore：创建空的密钥存储
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{
+		byID:   make(map[string]*APIKey),
+		byHash: make(map[string]*APIKey),
+		nextID: NewSafeCounter(0),
+	}
+}
+
+// hashAPIKey：计算明文密钥的SHA-256哈希
+// API密钥本身是高熵的随机字符串，不需要像密码那样使用加盐的慢哈希
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue：签发新密钥
+// 返回值：明文密钥（只在此时返回一次）；密钥元数据；可能的错误
+func (s *APIKeyStore) Issue(name string, scopes []string) (string, APIKey, error) {
+	// 使用crypto/rand生成32字节随机数，编码后加上前缀便于识别
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", APIKey{}, fmt.Errorf("生成密钥失败: %w", err)
+	}
+	plaintext := "sk_" + base64.RawURLEncoding.EncodeToString(buf)
+	return plaintext, s.Import(name, plaintext, scopes), nil
+}
+
+// Import：登记一个已有的明文密钥（例如从环境变量读取的管理员密钥），只保存其哈希
+func (s *APIKeyStore) Import(name, plaintext string, scopes []string) APIKey {
+	seq := s.nextID.Next()
+	key := &APIKey{
+		ID:      fmt.Sprintf("key_%d", seq),
+		Name:    name,
+		Scopes:  append([]string(nil), scopes...),
+		Created: time.Now().Format(time.RFC3339),
+		hash:    hashAPIKey(plaintext),
+		seq:     seq,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[key.ID] = key
+	s.byHash[key.hash] = key
+	return *key
+}
+
+// Revoke：吊销密钥，密钥不存在时返回ErrNotFound
+// 吊销后保留元数据（Revoked=true）以便审计，但认证时不再接受该密钥
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.byID[id]
+	if !exists {
+		return ErrNotFound
+	}
+	key.Revoked = true
+	return nil
+}
+
+// Authenticate：根据明文密钥查找未吊销的密钥
+func (s *APIKeyStore) Authenticate(plaintext string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, exists := s.byHash[hashAPIKey(plaintext)]
+	if !exists || key.Revoked {
+		return nil, false
+	}
+	copied := *key
+	return &copied, true
+}
+
+// List：按ID顺序返回所有密钥的元数据
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]APIKey, 0, len(s.byID))
+	for _, key := range s.byID {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].seq < keys[j].seq })
+	return keys
+}
+
+// apiKeys：服务器使用的密钥存储
+var apiKeys = NewAPIKeyStore()
+
+// identityKey：在请求上下文中保存调用方身份的键
+type identityKey struct{}
+
+// identityFrom：从请求上下文中读取调用方身份，匿名请求返回nil
+// 处理器可以用它记录"谁做了这个操作"
+func identityFrom(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(identityKey{}).(*APIKey)
+	return key
+}
+
+// apiKeyFromRequest：从请求头中读取明文密钥
+// 支持"Authorization: Bearer <key>"和"X-API-Key: <key>"两种写法
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authMiddleware：认证中间件，识别调用方并把身份放入请求上下文
+// 没有携带密钥的请求按匿名处理，是否允许匿名访问由各路由的requireScopes决定
+// 携带了无效或已吊销的密钥时直接返回401，避免客户端误以为自己已通过认证
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		plaintext := apiKeyFromRequest(r)
+		if plaintext == "" {
+			next(w, r)
+			return
+		}
+
+		key, ok := apiKeys.Authenticate(plaintext)
+		if !ok {
+			writeUnauthorized(w, "API密钥无效或已被吊销")
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityKey{}, key)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requireScopes：路由级授权中间件，要求调用方拥有全部指定的scope
+// 用法：router.Handle("POST /users", createUser, requireScopes(scopeUsersWrite))
+func requireScopes(scopes ...string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := identityFrom(r)
+			if key == nil {
+				writeUnauthorized(w, "需要API密钥")
+				return
+			}
+			for _, scope := range scopes {
+				if !key.HasScope(scope) {
+					writeProblem(w, http.StatusForbidden, fmt.Sprintf("API密钥 %s 缺少权限: %s", key.ID, scope))
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+// writeUnauthorized：返回401，并通过WWW-Authenticate头告诉客户端应使用的认证方式
+func writeUnauthorized(w http.ResponseWriter, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeProblem(w, http.StatusUnauthorized, detail)
+}
+
+// bootstrapAdminKey：启动时准备管理员密钥
+// 密钥不打印到控制台：标准输出通常会被日志系统收集，打印出来等于每次启动都把密钥写进日志
+// - 设置了环境变量API_ADMIN_KEY时使用该值
+// - 否则读取keyFile；文件不存在时随机签发一个，写入只有所有者可以读写（0600）的新文件，控制台只显示文件路径
+// 两种方式下重启后密钥都保持不变
+func bootstrapAdminKey(keyFile string) error {
+	scopes := []string{scopeUsersWrite, scopePostsWrite, scopeAPIKeysAdmin, scopeTrashAdmin}
+	if plaintext := os.Getenv("API_ADMIN_KEY"); plaintext != "" {
+		apiKeys.Import("admin", plaintext, scopes)
+		fmt.Println("已从环境变量API_ADMIN_KEY加载管理员密钥")
+		return nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		plaintext := strings.TrimSpace(string(data))
+		if plaintext == "" {
+			return fmt.Errorf("密钥文件%s为空", keyFile)
+		}
+		apiKeys.Import("admin", plaintext, scopes)
+		fmt.Printf("已从%s加载管理员密钥\n", keyFile)
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+
+	plaintext, _, err := apiKeys.Issue("admin", scopes)
+	if err != nil {
+		return err
+	}
+	// O_EXCL：文件已存在时失败，既不会覆盖别人写入的密钥，也不会沿用已有文件的宽松权限
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("创建密钥文件失败: %w", err)
+	}
+	if _, err := fmt.Fprintln(file, plaintext); err != nil {
+		file.Close()
+		return fmt.Errorf("写入密钥文件失败: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("写入密钥文件失败: %w", err)
+	}
+	fmt.Printf("已生成管理员API密钥并写入%s（仅所有者可读），使用方式: API_KEY=$(cat %s)\n", keyFile, keyFile)
+	return nil
+}
+
+// listAPIKeys：列出所有密钥的元数据（GET /apikeys）
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys.List())
+}
+
+// IssueAPIKeyRequest：签发密钥的请求体，例如{"name": "dashboard", "scopes": ["users:write"]}
+type IssueAPIKeyRequest struct {
+	Name   string   `json:"name"`   // 密钥用途说明
+	Scopes []string `json:"scopes"` // 申请的权限范围
+}
+
+// IssuedAPIKey：签发密钥的响应体，在密钥信息之外附带明文密钥
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key"` // 明文密钥，只在签发时返回这一次
+}
+
+// issueAPIKey：签发新密钥（POST /apikeys）
+// 响应中的key字段是明文密钥，服务器不会保存，也无法再次查看
+func issueAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req IssueAPIKeyRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	errs := &ValidationErrors{}
+	if strings.TrimSpace(req.Name) == "" {
+		errs.Add("name", "不能为空")
+	}
+	if len(req.Scopes) == 0 {
+		errs.Add("scopes", "至少需要一个权限范围")
+	}
+	for _, scope := range req.Scopes {
+		if !knownScopes[scope] {
+			errs.Add("scopes", "未知的权限范围: "+scope)
+		}
+	}
+	if err := errs.Err(); err != nil {
+		writeValidationProblem(w, err)
+		return
+	}
+
+	plaintext, key, err := apiKeys.Issue(req.Name, req.Scopes)
+	if err != nil {
+		requestLogger(r).Error("签发API密钥失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(IssuedAPIKey{key, plaintext})
+}
+
+// revokeAPIKey：吊销密钥（DELETE /apikeys/{id}）
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := apiKeys.Revoke(pathParam(r, "id")); err != nil {
+		writeProblem(w, http.StatusNotFound, "API密钥不存在")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 3.3 限流
+// 限流器沿用12-advanced-topics.go中的RateLimiter（滑动窗口日志算法）：
+// 为每个键记录窗口内的请求时间，窗口内请求数达到上限即拒绝
+// 在此基础上增加Take方法，额外返回剩余次数和窗口重置时间，用于生成标准的RateLimit-*响应头
+
+// RateLimiter：按键限流的滑动窗口限流器
+type RateLimiter struct {
+	requests  map[string][]time.Time
+	limit     int
+	window    time.Duration
+	mu        sync.RWMutex
+	lastSweep time.Time // 上次清理空闲键的时间，见sweep
+}
+
+// NewRateLimiter：创建限流器，每个键在window时间内最多允许limit个请求
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    limit,
+		window:   window,
+	}
+}
+
+// Allow：判断该键的请求是否被允许
+func (rl *RateLimiter) Allow(key string) bool {
+	allowed, _, _ := rl.Take(key)
+	return allowed
+}
+
+// Take：尝试为该键消耗一次请求额度
+// 返回值：allowed - 是否允许；remaining - 本次之后窗口内还剩的次数；reset - 距离最早的请求移出窗口（额度恢复）的时间
+func (rl *RateLimiter) Take(key string) (allowed bool, remaining int, reset time.Duration) {
+	return rl.TakeN(key, 1)
+}
+
+// TakeN：尝试为该键一次消耗n次请求额度，剩余额度不足n次时一次也不消耗
+func (rl *RateLimiter) TakeN(key string, n int) (allowed bool, remaining int, reset time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	// 清理过期的请求记录
+	validRequests := make([]time.Time, 0, len(rl.requests[key])+n)
+	for _, reqTime := range rl.requests[key] {
+		if now.Sub(reqTime) <= rl.window {
+			validRequests = append(validRequests, reqTime)
+		}
+	}
+
+	// 检查是否超过限制
+	allowed = len(validRequests)+n <= rl.limit
+	if allowed {
+		// 记录当前请求
+		for i := 0; i < n; i++ {
+			validRequests = append(validRequests, now)
+		}
+	}
+
+	if len(validRequests) == 0 {
+		delete(rl.requests, key) // 没有记录的键直接删除，避免map无限增长
+		return allowed, rl.limit, rl.window
+	}
+	rl.requests[key] = validRequests
+	return allowed, rl.limit - len(validRequests), validRequests[0].Add(rl.window).Sub(now)
+}
+
+// sweep：删除窗口内已经没有请求的键，调用方必须持有rl.mu
+// Take只清理当前键的过期记录，之后再也没有出现的客户端IP或密钥会一直留在map中；
+// 这里每隔一个窗口遍历一次所有键，与IdempotencyStore.purgeExpired一样把清理的开销分摊到请求中
+// 每个键的记录按时间顺序追加，最后一条都已移出窗口时整个键都可以删除
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rl.window {
+		return
+	}
+	rl.lastSweep = now
+	for key, times := range rl.requests {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) > rl.window {
+			delete(rl.requests, key)
+		}
+	}
+}
+
+// RateLimitPolicy：限流策略，决定"按什么计数"以及使用哪个限流器
+type RateLimitPolicy struct {
+	Limiter *RateLimiter                 // 限流器
+	KeyFunc func(r *http.Request) string // 从请求中计算限流键
+}
+
+// clientIP：获取客户端真实IP
+// 直接连接的对端地址（RemoteAddr）可能是反向代理。只有当对端属于受信任的代理时，
+// 才从右往左解析X-Forwarded-For，跳过受信任的代理，第一个不受信任的地址就是客户端
+// 不能无条件信任X-Forwarded-For：客户端可以随意伪造这个请求头来绕过限流
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	isTrusted := func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		for _, network := range trustedProxies {
+			if parsed != nil && network.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrusted(hop) {
+			return hop
+		}
+		host = hop // 全部都是受信任代理时，使用最左边的地址
+	}
+	return host
+}
+
+// parseTrustedProxies：解析逗号分隔的受信任代理列表，支持CIDR（10.0.0.0/8）和单个IP
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的受信任代理地址 %q: %w", item, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// rateLimitKeyFunc：根据配置创建限流键函数
+// 参数：kind - "ip"按客户端IP、"apikey"按API密钥（匿名请求和密钥无效的请求退回按IP）、"route"按路由（所有客户端共享额度）
+// 限流在认证之前执行（见withMiddleware），这里还拿不到identityFrom，apikey模式自己验证一次密钥：
+// 只有有效的密钥才按密钥计数，否则攻击者每次换一个随机密钥就能得到一份新的额度
+func rateLimitKeyFunc(kind string, trustedProxies []*net.IPNet, router *Router) (func(r *http.Request) string, error) {
+	switch kind {
+	case "ip":
+		return func(r *http.Request) string {
+			return "ip:" + clientIP(r, trustedProxies)
+		}, nil
+	case "apikey":
+		return func(r *http.Request) string {
+			if plaintext := apiKeyFromRequest(r); plaintext != "" {
+				if key, ok := apiKeys.Authenticate(plaintext); ok {
+					return "key:" + key.ID
+				}
+			}
+			return "ip:" + clientIP(r, trustedProxies)
+		}, nil
+	case "route":
+		return func(r *http.Request) string {
+			// 使用路由模式而不是实际路径，/users/1和/users/2共享"GET /users/{id:int}"的额度
+			if route := router.Lookup(r); route != nil {
+				return "route:" + route.Method + " " + route.Pattern
+			}
+			return "route:unmatched"
+		}, nil
+	default:
+		return nil, fmt.Errorf("未知的限流键类型: %s（可选值: ip、apikey、route）", kind)
+	}
+}
+
+// rateLimitMiddleware：限流中间件
+// 每个响应都带有RateLimit-Limit、RateLimit-Remaining、RateLimit-Reset（秒）响应头，
+// 超过限额时返回429 Too Many Requests，并通过Retry-After告诉客户端多少秒后重试
+// 健康检查探针不限流：编排系统和负载均衡器会频繁调用它们，被429拒绝会被误判为实例故障
+func rateLimitMiddleware(policy *RateLimitPolicy) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if probePaths[r.URL.Path] {
+				next(w, r)
+				return
+			}
+			key := policy.KeyFunc(r)
+			allowed, remaining, reset := policy.Limiter.Take(key)
+			resetSeconds := setRateLimitHeaders(w, policy.Limiter.limit, remaining, reset)
+			if !allowed {
+				w.Header().Set("Retry-After", resetSeconds)
+				writeProblem(w, http.StatusTooManyRequests, fmt.Sprintf("请求过于频繁，请在%s秒后重试", resetSeconds))
+				return
+			}
+			ctx := context.WithValue(r.Context(), rateLimitKey{}, &rateLimitCharge{policy: policy, key: key})
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// setRateLimitHeaders：写入RateLimit-*响应头，返回向上取整到秒的重置时间，避免客户端在额度恢复前重试
+func setRateLimitHeaders(w http.ResponseWriter, limit, remaining int, reset time.Duration) string {
+	resetSeconds := strconv.Itoa(int((reset + time.Second - 1) / time.Second))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", resetSeconds)
+	return resetSeconds
+}
+
+// rateLimitKey：在请求上下文中保存本次请求的限流策略和限流键
+type rateLimitKey struct{}
+
+// rateLimitCharge：处理器需要按实际工作量追加扣除额度时使用（见chargeRateLimit）
+type rateLimitCharge struct {
+	policy *RateLimitPolicy
+	key    string
+}
+
+// chargeRateLimit：为当前请求追加消耗n次限流额度，额度不足时返回429并返回false
+// 限流中间件只为每个HTTP请求扣除一次额度；批量操作的子请求直接交给路由器执行，不经过限流中间件，
+// 不追加扣除的话一次请求的额度就能换来上百次操作。没有启用限流时总是返回true
+func chargeRateLimit(w http.ResponseWriter, r *http.Request, n int) bool {
+	charge, _ := r.Context().Value(rateLimitKey{}).(*rateLimitCharge)
+	if charge == nil || n <= 0 {
+		return true
+	}
+	allowed, remaining, reset := charge.policy.Limiter.TakeN(charge.key, n)
+	resetSeconds := setRateLimitHeaders(w, charge.policy.Limiter.limit, remaining, reset)
+	if !allowed {
+		w.Header().Set("Retry-After", resetSeconds)
+		writeProblem(w, http.StatusTooManyRequests, fmt.Sprintf("剩余的限流额度不足以执行%d个子请求，请在%s秒后重试或减少子请求数", n+1, resetSeconds))
+		return false
+	}
+	return true
+}
+
+// 3.4 幂等键（Idempotency-Key）
+// 移动端在POST /users超时后重试，如果第一次请求其实已经成功，服务器会再创建一个用户
+// 创建类接口支持Idempotency-Key请求头（IETF草案draft-ietf-httpapi-idempotency-key-header）：
+// - 客户端为每个"逻辑上的一次创建"生成唯一的键（例如UUID），重试时携带同一个键
+// - 服务器保存每个键第一次请求的响应，在有效期内收到相同的请求时直接重放该响应（带Idempotent-Replayed: true），不再执行处理器
+// - 同一个键用于内容不同的请求时返回422，说明客户端错误地复用了键
+// - 第一次请求尚未完成时收到重试返回409，客户端稍后再试即可拿到重放的响应
+// 键按API密钥隔离：不同调用方使用相同的键互不影响；匿名请求和没有携带该请求头的请求照常处理
+// 5xx响应不保存：服务器内部错误之后的重试应当真正重新执行
+
+const (
+	idempotencyHeader        = "Idempotency-Key"     // 请求头名称
+	idempotentReplayedHeader = "Idempotent-Replayed" // 重放的响应带有这个响应头，跨域页面需要CORS暴露后才能读取
+	maxIdempotencyKeyLen     = 255                   // 键的最大长度
+	idempotencyPurge         = time.Minute           // 清理过期记录的最小间隔
+)
+
+// idempotentHeaders：重放时恢复的响应头
+// 请求ID、限流额度等由外层中间件为每个请求单独生成的响应头不保存
+var idempotentHeaders = []string{"Content-Type", "ETag", "Location", "X-Content-Type-Options"}
+
+// idempotencyKey：幂等记录的键，由调用方的API密钥ID和客户端提供的键组成
+type idempotencyKey struct {
+	owner string // API密钥ID
+	key   string // Idempotency-Key请求头的值
+}
+
+// idempotentResponse：一个键对应的记录
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte // 请求的指纹：方法、路径和请求体的SHA-256，用于识别"同一个键、不同的请求"
+	done        bool              // 第一次请求是否已经完成；未完成时只占位，没有响应内容
+	status      int               // 响应状态码
+	header      http.Header       // 需要重放的响应头
+	body        []byte            // 响应体
+	expires     time.Time         // 过期时间，从第一次请求完成时开始计算
+}
+
+// IdempotencyStore：保存幂等记录，记录保存在12-advanced-topics.go的泛型Cache中
+// 过期的记录在查询时视为不存在，并在写入新记录时顺便清理（与RateLimiter相同，不需要后台goroutine）
+type IdempotencyStore struct {
+	responses *Cache[idempotencyKey, idempotentResponse]
+	ttl       time.Duration // 记录的有效期
+
+	mu        sync.Mutex // 保护lastPurge
+	lastPurge time.Time  // 上一次清理过期记录的时间
+}
+
+// NewIdempotencyStore：创建幂等记录存储，ttl为每条记录的有效期
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{responses: NewCache[idempotencyKey, idempotentResponse](), ttl: ttl}
+}
+
+// idempotencyKeys：服务器使用的幂等记录存储，main函数按配置的有效期重新创建
+var idempotencyKeys = NewIdempotencyStore(24 * time.Hour)
+
+// begin：为key占位，返回已有的记录
+// 返回值：started为true表示占位成功，调用方应执行处理器并在完成后调用finish或abort；
+// 否则existing是已有的记录（可能已完成，也可能正在处理）
+func (s *IdempotencyStore) begin(key idempotencyKey, fingerprint [sha256.Size]byte) (existing idempotentResponse, started bool) {
+	s.purgeExpired()
+	placeholder := idempotentResponse{fingerprint: fingerprint}
+	for {
+		existing, loaded := s.responses.LoadOrStore(key, placeholder)
+		if !loaded {
+			return idempotentResponse{}, true
+		}
+		if !existing.done || time.Now().Before(existing.expires) {
+			return existing, false
+		}
+		// 记录已过期：删除后重新占位；删除前再次检查，避免删掉其他请求刚刚写入的新记录
+		s.responses.DeleteIf(key, func(current idempotentResponse) error {
+			if current.done && !time.Now().Before(current.expires) {
+				return nil
+			}
+			return errors.New("记录已被更新")
+		})
+	}
+}
+
+// finish：保存第一次请求的响应，之后相同的请求将重放它
+func (s *IdempotencyStore) finish(key idempotencyKey, response idempotentResponse) {
+	response.done = true
+	response.expires = time.Now().Add(s.ttl)
+	s.responses.Replace(key, response)
+}
+
+// abort：删除占位记录，用于处理器返回5xx或panic的情况，客户端重试时重新执行
+func (s *IdempotencyStore) abort(key idempotencyKey) {
+	s.responses.DeleteIf(key, func(current idempotentResponse) error {
+		if current.done {
+			return errors.New("记录已完成")
+		}
+		return nil
+	})
+}
+
+// purgeExpired：删除过期的记录，两次清理之间至少间隔idempotencyPurge
+func (s *IdempotencyStore) purgeExpired() {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastPurge) < idempotencyPurge {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPurge = now
+	s.mu.Unlock()
+
+	s.responses.DeleteFunc(func(_ idempotencyKey, response idempotentResponse) bool {
+		return response.done && !now.Before(response.expires)
+	})
+}
+
+// idempotencyRecorder：在转发响应的同时保存一份副本，用于之后重放
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header // 调用WriteHeader时的响应头快照
+	body   bytes.Buffer
+}
+
+// WriteHeader：记录状态码和需要重放的响应头
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = http.Header{}
+		for _, name := range idempotentHeaders {
+			if values := rec.Header().Values(name); len(values) > 0 {
+				rec.header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+			}
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write：没有显式调用WriteHeader时，第一次Write隐含200状态码
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap：返回原始的ResponseWriter，供http.ResponseController使用
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requireIdempotency：路由级中间件，为携带Idempotency-Key的请求提供幂等保证
+func requireIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientKey := r.Header.Get(idempotencyHeader)
+		owner := identityFrom(r)
+		if clientKey == "" || owner == nil {
+			next(w, r)
+			return
+		}
+		if len(clientKey) > maxIdempotencyKeyLen {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("%s不能超过%d个字符", idempotencyHeader, maxIdempotencyKeyLen))
+			return
+		}
+
+		// 读取请求体计算指纹，再换成新的Reader交给处理器；上限与批量导入相同
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			writeImportError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + string(body)))
+
+		key := idempotencyKey{owner: owner.ID, key: clientKey}
+		existing, started := idempotencyKeys.begin(key, fingerprint)
+		if !started {
+			switch {
+			case existing.fingerprint != fingerprint:
+				writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("%s已用于另一个内容不同的请求，每次新的创建请求必须使用新的键", idempotencyHeader))
+			case !existing.done:
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, http.StatusConflict, fmt.Sprintf("使用相同%s的请求正在处理，请稍后重试", idempotencyHeader))
+			default:
+				for name, values := range existing.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(existing.status)
+				w.Write(existing.body)
+			}
+			return
+		}
+
+		// 处理器panic时也要删除占位记录，否则这个键在有效期内永远返回409
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				idempotencyKeys.abort(key)
+			}
+		}()
+		next(rec, r)
+
+		// 429同样不保存：处理器追加扣除限流额度失败时（见chargeRateLimit），额度恢复后的重试应当真正执行
+		if rec.status == 0 || rec.status >= 500 || rec.status == http.StatusTooManyRequests {
+			return
+		}
+		idempotencyKeys.finish(key, idempotentResponse{fingerprint: fingerprint, status: rec.status, header: rec.header, body: rec.body.Bytes()})
+		completed = true
+	}
+}
+
+// 4. 用户管理处理器
+// 处理器（Handler）是处理HTTP请求的函数，遵循http.HandlerFunc类型定义
+// 签名为：func(w http.ResponseWriter, r *http.Request)
+// w：用于构建响应，r：包含请求信息
+// 实现RESTful API的核心思想：同一资源路径根据不同HTTP方法执行不同操作
+// 方法与处理器的对应关系在newRouter中声明（例如"PUT /users/{id:int}"对应updateUser）
+
+// getUsers：处理获取用户列表的请求（GET /users）
+// 功能：从存储中读取用户，经过滤、排序、分页后以JSON格式返回
+// 示例：GET /users?age_min=20&sort=-created&limit=10；管理员可以加上include=deleted同时列出回收站中的用户
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params, err := parseListParams(query, userSortKeys, "id")
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	// 通过Store接口读取用户列表，不关心底层是内存还是SQLite
+	userList, err := storeFrom(r).ListUsers()
+	if err == nil && include {
+		var deleted []User
+		deleted, err = storeFrom(r).ListDeletedUsers()
+		userList = append(userList, deleted...)
+	}
+	if err != nil {
+		// 存储层出错属于服务器内部错误，返回500
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	userList, err = filterUsers(userList, query)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, next := paginate(userList, params, userSortKeys, func(u User) int { return u.ID })
+
+	// writeList：将当前页的用户编码为JSON，设置Content-Type和ETag后写入响应
+	writeListHeaders(w, r, len(userList), next)
+	writeList(w, r, page)
+}
+
+// getUser：处理获取单个用户的请求（GET /users/{id}）
+// 功能：根据URL路径中的ID查找用户，以JSON格式返回
+func getUser(w http.ResponseWriter, r *http.Request) {
+	// 从路径参数中读取用户ID，非整数ID已由路由器返回400
+	id := pathInt(r, "id")
+
+	user, err := storeFrom(r).GetUser(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	// 单个资源的ETag由版本号生成，客户端修改用户时需要在If-Match中带上它
+	writeEntity(w, r, http.StatusOK, user, user.Version)
+}
+
+// createUser：处理创建新用户的请求（POST /users）
+// 功能：解析请求体中的JSON数据，创建新用户并保存到存储
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var user User // 声明一个User类型变量，用于接收解析后的请求数据
+
+	// 严格解析请求体中的JSON数据到user变量，并校验字段取值（姓名、邮箱格式、年龄范围）
+	// JSON格式错误返回400；未知字段、类型错误和取值错误一起作为422返回
+	if err := checkPayload(decodeJSONBody(r.Body, &user), &user); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// 设置创建时间，ID由存储层分配
+	user.Created = time.Now().Format(time.RFC3339) // 格式化当前时间为RFC3339标准格式
+
+	// 将新用户保存到存储，CreateUser会把分配的ID写回user
+	if err := storeFrom(r).CreateUser(&user); err != nil {
+		requestLogger(r).Error("创建用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	publishEvent(r, "user.created", user)
+
+	// 返回创建的用户信息，201 Created表示资源创建成功
+	writeEntity(w, r, http.StatusCreated, user, user.Version)
+}
+
+// updateUser：处理更新用户的请求（PUT /users/{id}）
+// 功能：根据URL路径中的ID查找用户，更新其信息并保存
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	// 从路径参数中读取用户ID（例如从"/users/123"中得到123）
+	// 路由声明为{id:int}，ID不是数字时路由器已经返回400 Bad Request
+	id := pathInt(r, "id")
+
+	// 先读取原用户：既用于判断是否存在，也用于保留服务器维护的创建时间
+	// 与patchUser相同，先确认用户存在、版本匹配，再校验请求体：用户不存在时无论请求体如何都返回404
+	existing, err := storeFrom(r).GetUser(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// 用户不存在，返回404 Not Found
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	// 客户端必须证明它看到的是最新版本，否则可能覆盖别人刚刚做出的修改
+	if !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	// 解析请求体中的JSON数据到临时user变量
+	var user User
+	if err := checkPayload(decodeJSONBody(r.Body, &user), &user); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// ID、创建时间和版本号由服务器维护：请求中省略时沿用原值，显式修改则返回错误
+	// 注意：解码到结构体后无法区分"省略"和"零值"，因此零值视为省略
+	if user.ID != 0 && user.ID != id {
+		writeImmutableFieldError(w, "id")
+		return
+	}
+	if user.Created != "" && user.Created != existing.Created {
+		writeImmutableFieldError(w, "created")
+		return
+	}
+	if user.Version != 0 && user.Version != existing.Version {
+		writeImmutableFieldError(w, "version")
+		return
+	}
+	if user.DeletedAt != "" {
+		writeImmutableFieldError(w, "deleted_at") // existing未删除，出现任何取值都是修改
+		return
+	}
+	user.ID = id
+	user.Created = existing.Created
+	user.Version = existing.Version // 存储层只在版本号仍为existing.Version时才写入
+	saveUser(w, r, &user)
+}
+
+// patchUser：处理部分更新用户的请求（PATCH /users/{id}）
+// 功能：按RFC 7396 JSON Merge Patch规则把请求体合并到原用户上
+// 例如{"age": 26}只修改年龄，{"email": null}会把邮箱清空为零值
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	existing, err := storeFrom(r).GetUser(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	if !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	var user User
+	if !applyMergePatch(w, r, existing, &user, userImmutableFields) {
+		return
+	}
+	saveUser(w, r, &user)
+}
+
+// saveUser：保存更新后的用户并返回JSON，供updateUser和patchUser共用
+func saveUser(w http.ResponseWriter, r *http.Request, user *User) {
+	// 更新存储中的用户信息，存储层会在用户不存在时返回ErrNotFound
+	// 检查If-Match之后、写入之前用户仍可能被其他请求修改，存储层发现版本不一致时返回ErrVersionConflict
+	if err := storeFrom(r).UpdateUser(user); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			writePreconditionFailed(w)
+			return
+		}
+		requestLogger(r).Error("更新用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	publishEvent(r, "user.updated", user)
+
+	// 返回更新后的用户信息，ETag对应新的版本号
+	writeEntity(w, r, http.StatusOK, user, user.Version)
+}
+
+// deleteUser：处理删除用户的请求（DELETE /users/{id}）
+// 功能：根据URL路径中的ID查找用户并移入回收站，之后可以通过POST /users/{id}:restore恢复
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	// 从路径参数中读取用户ID
+	id := pathInt(r, "id")
+
+	existing, err := storeFrom(r).GetUser(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	if !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	// 名下帖子的处理策略：默认使用启动配置，也可以通过posts、reassign_to参数为本次删除单独指定
+	policy, err := userDeletePolicyFrom(r.URL.Query())
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// 把指定版本的用户移入回收站，用户不存在时返回404，版本已变化时返回412
+	affected, err := storeFrom(r).DeleteUser(id, existing.Version, policy)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			writePreconditionFailed(w)
+			return
+		}
+		if errors.Is(err, ErrUserHasPosts) {
+			writeProblem(w, http.StatusConflict, "用户名下仍有帖子，请先删除或转移这些帖子，或使用posts=cascade、posts=reassign参数")
+			return
+		}
+		if errors.Is(err, ErrAuthorNotFound) {
+			writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("接收帖子的用户%d不存在或就是被删除的用户", policy.ReassignTo))
+			return
+		}
+		requestLogger(r).Error("删除用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	// 发布删除事件：名下帖子先于用户被删除或转移，事件顺序与存储中的操作顺序一致
+	// 级联删除的帖子还要从搜索索引中移除，转移作者不改变帖子文本，索引无需更新
+	for _, post := range affected {
+		if policy.Mode == deleteCascade {
+			postID := post.ID
+			afterCommit(r, func() { searchIndex.Remove(postID) })
+			publishEvent(r, "post.deleted", map[string]int{"id": postID})
+		} else {
+			publishEvent(r, "post.updated", post)
+		}
+	}
+	publishEvent(r, "user.deleted", map[string]int{"id": id})
+	// 返回204 No Content，表示删除成功且无响应体
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 5. 帖子管理处理器
+// 与用户处理器相同，/posts对应帖子集合，/posts/{id}对应单个帖子
+// 帖子通过author_id引用作者，/users/{id}/posts是某个用户名下帖子的嵌套集合
+
+// getPosts：处理获取帖子列表的请求（GET /posts）
+// 功能：从存储中读取帖子，经过滤、排序、分页后以JSON格式返回
+// 示例：GET /posts?author_id=1&sort=-date&expand=author；include=deleted与/users相同
+func getPosts(w http.ResponseWriter, r *http.Request) {
+	include, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	postList, err := storeFrom(r).ListPosts()
+	if err == nil && include {
+		var deleted []Post
+		deleted, err = storeFrom(r).ListDeletedPosts()
+		postList = append(postList, deleted...)
+	}
+	if err != nil {
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	writePostList(w, r, postList)
+}
+
+// userDeletePolicyFrom：从查询参数得到本次删除使用的策略
+// 例如：DELETE /users/1?posts=reassign&reassign_to=2；没有posts参数时使用默认策略
+func userDeletePolicyFrom(query url.Values) (UserDeletePolicy, error) {
+	mode := query.Get("posts")
+	if mode == "" {
+		return userDeletePolicy, nil
+	}
+	reassignTo := 0
+	if s := query.Get("reassign_to"); s != "" {
+		value, err := strconv.Atoi(s)
+		if err != nil {
+			return UserDeletePolicy{}, errors.New("reassign_to必须是整数")
+		}
+		reassignTo = value
+	}
+	return NewUserDeletePolicy(mode, reassignTo)
+}
+
+// getUserPosts：处理获取用户帖子列表的请求（GET /users/{id}/posts）
+// 功能：返回指定用户名下的帖子，支持与/posts相同的分页、排序和expand参数；用户不存在时返回404
+func getUserPosts(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	// 先确认用户存在：区分"用户不存在"（404）和"用户没有帖子"（200和空数组）
+	if _, err := storeFrom(r).GetUser(id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "用户不存在")
+			return
+		}
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	owned, err := storeFrom(r).ListPostsByAuthor(id)
+	if err != nil {
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	writePostList(w, r, owned)
+}
+
+// writePostList：对帖子列表做过滤、排序、分页和作者展开后写入响应，供getPosts和getUserPosts共用
+func writePostList(w http.ResponseWriter, r *http.Request, postList []Post) {
+	query := r.URL.Query()
+	params, err := parseListParams(query, postSortKeys, "id")
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expand, err := parseExpand(query)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	postList, err = filterPosts(postList, query)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, next := paginate(postList, params, postSortKeys, func(p Post) int { return p.ID })
+
+	writeListHeaders(w, r, len(postList), next)
+	if !expand {
+		writeList(w, r, page)
+		return
+	}
+	expanded, err := expandAuthors(storeFrom(r), page)
+	if err != nil {
+		requestLogger(r).Error("查询作者失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	writeList(w, r, expanded)
+}
+
+// parseExpand：解析expand参数，返回是否需要展开作者
+// 目前只支持expand=author；拼错的取值返回错误，而不是悄悄返回未展开的数据
+func parseExpand(query url.Values) (bool, error) {
+	switch query.Get("expand") {
+	case "":
+		return false, nil
+	case "author":
+		return true, nil
+	default:
+		return false, fmt.Errorf("不支持的expand取值: %s（可选值: author）", query.Get("expand"))
+	}
+}
+
+// expandAuthors：为每个帖子附上作者详情
+// 收集这一页帖子的作者ID，一次查询取回这些作者，避免每个帖子单独查询一次（N+1查询问题），也不读取其他用户
+func expandAuthors(st Store, posts []Post) ([]PostWithAuthor, error) {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, post := range posts {
+		if !seen[post.AuthorID] {
+			seen[post.AuthorID] = true
+			ids = append(ids, post.AuthorID)
+		}
+	}
+	users, err := st.GetUsers(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+
+	expanded := make([]PostWithAuthor, len(posts))
+	for i, post := range posts {
+		expanded[i].Post = post
+		if author, ok := byID[post.AuthorID]; ok {
+			expanded[i].Author = &author
+		}
+	}
+	return expanded, nil
+}
+
+// getPost：处理获取单个帖子的请求（GET /posts/{id}）
+// 功能：根据URL路径中的ID查找帖子，以JSON格式返回
+func getPost(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	post, err := storeFrom(r).GetPost(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	expand, err := parseExpand(r.URL.Query())
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !expand {
+		writeEntity(w, r, http.StatusOK, post, post.Version)
+		return
+	}
+
+	// 展开后的响应还包含作者数据，作者修改后内容会变化，不能再用帖子的版本号作为ETag，改为按内容计算
+	expanded, err := expandAuthors(storeFrom(r), []Post{*post})
+	if err != nil {
+		requestLogger(r).Error("查询作者失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	writeList(w, r, expanded[0])
+}
+
+// createPost：处理创建新帖子的请求（POST /posts）
+// 功能：解析请求体中的JSON数据，创建新帖子并保存到存储
+func createPost(w http.ResponseWriter, r *http.Request) {
+	var post Post
+
+	// 严格解析请求体中的JSON数据并校验字段
+	if err := checkPayload(decodeJSONBody(r.Body, &post), &post); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// 设置发布时间，ID由存储层分配
+	post.Date = time.Now().Format(time.RFC3339)
+
+	// 保存新帖子，author_id指向的用户不存在时返回422
+	if err := storeFrom(r).CreatePost(&post); err != nil {
+		if errors.Is(err, ErrAuthorNotFound) {
+			writeAuthorNotFound(w)
+			return
+		}
+		requestLogger(r).Error("创建帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	afterCommit(r, func() { searchIndex.Index(post) }) // 写入成功（批量操作中为提交）后再更新索引，保证索引中不会出现存储里没有的帖子
+	publishEvent(r, "post.created", post)
+
+	// 返回创建的帖子信息
+	writeEntity(w, r, http.StatusCreated, post, post.Version)
+}
+
+// updatePost：处理整体替换帖子的请求（PUT /posts/{id}）
+// 功能：用请求体中的帖子替换已有帖子，ID以URL为准，发布时间沿用原帖子
+func updatePost(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	// 读取原帖子：既用于判断是否存在，也用于保留服务器生成的发布时间；与updateUser相同，先于请求体校验
+	existing, err := storeFrom(r).GetPost(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	if !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	var post Post
+	if err := checkPayload(decodeJSONBody(r.Body, &post), &post); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// ID、发布时间和版本号由服务器维护：请求中省略时沿用原值，显式修改则返回错误
+	if post.ID != 0 && post.ID != id {
+		writeImmutableFieldError(w, "id")
+		return
+	}
+	if post.Date != "" && post.Date != existing.Date {
+		writeImmutableFieldError(w, "date")
+		return
+	}
+	if post.Version != 0 && post.Version != existing.Version {
+		writeImmutableFieldError(w, "version")
+		return
+	}
+	if post.DeletedAt != "" {
+		writeImmutableFieldError(w, "deleted_at")
+		return
+	}
+	post.ID = id
+	post.Date = existing.Date
+	post.Version = existing.Version
+	savePost(w, r, &post)
+}
+
+// patchPost：处理部分更新帖子的请求（PATCH /posts/{id}）
+// 功能：按RFC 7396 JSON Merge Patch规则把请求体合并到原帖子上，请求中没有出现的字段保持不变
+func patchPost(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	post, err := storeFrom(r).GetPost(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	if !checkIfMatch(w, r, post.Version) {
+		return
+	}
+
+	var patched Post
+	if !applyMergePatch(w, r, post, &patched, postImmutableFields) {
+		return
+	}
+	savePost(w, r, &patched)
+}
+
+// savePost：保存更新后的帖子并返回JSON，供updatePost和patchPost共用
+func savePost(w http.ResponseWriter, r *http.Request, post *Post) {
+	if err := storeFrom(r).UpdatePost(post); err != nil {
+		// 读取之后、写入之前帖子可能已被其他请求删除，此时同样返回404
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			writePreconditionFailed(w)
+			return
+		}
+		if errors.Is(err, ErrAuthorNotFound) {
+			writeAuthorNotFound(w)
+			return
+		}
+		requestLogger(r).Error("更新帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	saved := *post
+	afterCommit(r, func() { searchIndex.Index(saved) })
+	publishEvent(r, "post.updated", post)
+
+	writeEntity(w, r, http.StatusOK, post, post.Version)
+}
+
+// writeAuthorNotFound：帖子的author_id指向不存在的用户时返回422，错误格式与字段校验错误一致
+func writeAuthorNotFound(w http.ResponseWriter) {
+	writeValidationProblem(w, &ValidationError{Field: "author_id", Message: "用户不存在"})
+}
+
+// deletePost：处理删除帖子的请求（DELETE /posts/{id}）
+// 功能：根据URL路径中的ID把帖子移入回收站，成功返回204
+func deletePost(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	existing, err := storeFrom(r).GetPost(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	if !checkIfMatch(w, r, existing.Version) {
+		return
+	}
+
+	if err := storeFrom(r).DeletePost(id, existing.Version); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "帖子不存在")
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			writePreconditionFailed(w)
+			return
+		}
+		requestLogger(r).Error("删除帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	afterCommit(r, func() { searchIndex.Remove(id) })
+	publishEvent(r, "post.deleted", map[string]int{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 5.1 JSON Merge Patch（RFC 7396）
+// Merge Patch用一个JSON对象描述"要改什么"，合并规则很简单：
+// - 补丁中的字段覆盖原值
+// - 补丁中值为null的字段从原对象中删除（解码回结构体后即为零值）
+// - 补丁中没有出现的字段保持不变
+// - 值为对象时递归合并
+// 请求的Content-Type应为application/merge-patch+json，为了方便使用curl调试，这里也接受application/json
+
+// 由服务器维护、客户端不能修改的字段（使用JSON字段名）
+// deleted_at只能通过DELETE和:restore改变
+var (
+	userImmutableFields = []string{"id", "created", "version", "deleted_at"}
+	postImmutableFields = []string{"id", "date", "version", "deleted_at"}
+)
+
+// mergePatch：RFC 7396定义的合并算法，target和patch都是json解码后的通用值
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		// 补丁不是对象（数组、字符串、数字等）时直接替换整个目标
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key) // null表示删除该字段
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// applyMergePatch：读取请求体中的合并补丁，应用到current上，结果解码到out并校验
+// 参数：current - 原资源；out - 接收合并结果的结构体指针；immutable - 不允许修改的字段
+// 返回值：成功返回true；失败时已写入错误响应并返回false，调用方直接return即可
+func applyMergePatch(w http.ResponseWriter, r *http.Request, current interface{}, out validatable, immutable []string) bool {
+	// 检查Content-Type（忽略"; charset=utf-8"之类的参数）
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if contentType != "" && contentType != "application/merge-patch+json" && contentType != "application/json" {
+		writeProblem(w, http.StatusUnsupportedMediaType, "PATCH请求的Content-Type必须是application/merge-patch+json")
+		return false
+	}
+
+	// 解码补丁，UseNumber让数字保持json.Number，避免整数被转成float64后丢失精度
+	var patch interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&patch); err != nil {
+		writeProblem(w, http.StatusBadRequest, "无效的JSON数据")
+		return false
+	}
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		writeProblem(w, http.StatusBadRequest, "合并补丁必须是JSON对象")
+		return false
+	}
+
+	// 把原资源转换为通用的map，便于按字段合并
+	var original map[string]interface{}
+	raw, err := json.Marshal(current)
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		err = decoder.Decode(&original)
+	}
+	if err != nil {
+		requestLogger(r).Error("序列化资源失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return false
+	}
+
+	// 补丁中出现了服务器维护的字段，且值与原值不同（包括设为null），则拒绝整个补丁
+	for _, field := range immutable {
+		value, present := patchObj[field]
+		if present && !jsonEqual(value, original[field]) {
+			writeImmutableFieldError(w, field)
+			return false
+		}
+	}
+
+	// 合并后再严格解码回结构体并校验，得到完整的更新结果
+	// 补丁中的未知字段、类型不匹配（例如把age改为字符串）、非法取值都会作为校验错误返回422
+	merged, err := json.Marshal(mergePatch(original, patchObj))
+	if err != nil {
+		requestLogger(r).Error("序列化合并结果失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return false
+	}
+	if err := checkPayload(decodeJSONObject(merged, out), out); err != nil {
+		writeRequestError(w, err)
+		return false
+	}
+	return true
+}
+
+// jsonEqual：比较两个JSON值是否相等（通过重新序列化比较，避免json.Number与字符串等类型差异）
+func jsonEqual(a, b interface{}) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(rawA, rawB)
+}
+
+// writeImmutableFieldError：客户端试图修改服务器维护的字段时返回422 Unprocessable Entity
+func writeImmutableFieldError(w http.ResponseWriter, field string) {
+	writeValidationProblem(w, &ValidationError{Field: field, Message: "由服务器维护，不允许修改"})
+}
+
+// 5.2 列表查询：分页、过滤和排序
+// 存储中的数据没有固定顺序（map遍历顺序是随机的），列表接口需要：
+// - 稳定排序：sort=name升序、sort=-created降序；排序值相同时再按ID排序，保证结果确定
+// - 游标分页：limit指定每页数量，cursor指向上一页最后一条记录
+// - 字段过滤：/users支持age_min、age_max、email（邮箱域名），/posts支持author_id
+// 响应体仍然是JSON数组，分页信息放在响应头中：
+// - X-Total-Count：过滤后的总记录数
+// - Link（RFC 8288）：rel="first"指向第一页，rel="next"指向下一页
+
+const (
+	defaultPageLimit = 100  // 未指定limit时每页返回的记录数
+	maxPageLimit     = 1000 // limit允许的最大值，防止一次请求返回过多数据
+)
+
+// sortValue：排序键，数字字段使用Num，字符串字段使用Str
+type sortValue struct {
+	Num int    `json:"n,omitempty"`
+	Str string `json:"s,omitempty"`
+}
+
+// compare：比较两个排序键，返回-1、0或1
+func (a sortValue) compare(b sortValue) int {
+	if a.Num != b.Num {
+		if a.Num < b.Num {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.Str, b.Str)
+}
+
+// pageCursor：分页游标，记录上一页最后一条记录的排序键和ID
+// 使用"键集分页"（keyset pagination）而不是偏移量：翻页期间有新记录插入时，后续页面不会重复或遗漏
+type pageCursor struct {
+	Sort string    `json:"sort"` // 生成游标时使用的排序方式，翻页时必须保持一致
+	Key  sortValue `json:"key"`  // 最后一条记录的排序键
+	ID   int       `json:"id"`   // 最后一条记录的ID，用于区分排序键相同的记录
+}
+
+// encode：把游标编码为URL安全的不透明字符串，客户端只需原样传回
+func (c *pageCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor：解析客户端传回的游标字符串
+func decodeCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// listParams：从查询参数中解析出的分页和排序参数
+type listParams struct {
+	Limit  int         // 每页数量
+	Sort   string      // 排序方式，如"name"、"-created"
+	Cursor *pageCursor // 分页游标，第一页为nil
+}
+
+// parseListParams：解析limit、sort、cursor参数
+// 参数：sortKeys - 允许排序的字段；defaultSort - 未指定sort时的默认排序
+func parseListParams[T any](query url.Values, sortKeys map[string]func(T) sortValue, defaultSort string) (listParams, error) {
+	params := listParams{Limit: defaultPageLimit, Sort: defaultSort}
+
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return params, fmt.Errorf("limit必须是1到%d之间的整数", maxPageLimit)
+		}
+		params.Limit = limit
+	}
+
+	if s := query.Get("sort"); s != "" {
+		if _, ok := sortKeys[strings.TrimPrefix(s, "-")]; !ok {
+			return params, fmt.Errorf("不支持的排序字段: %s", s)
+		}
+		params.Sort = s
+	}
+
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			return params, errors.New("无效的cursor")
+		}
+		if cursor.Sort != params.Sort {
+			return params, errors.New("cursor与当前sort参数不一致，请从第一页重新开始")
+		}
+		params.Cursor = cursor
+	}
+	return params, nil
+}
+
+// paginate：对记录排序并截取一页
+// 参数：items - 过滤后的全部记录；sortKeys - 排序字段到排序键的映射；idOf - 获取记录ID
+// 返回值：当前页的记录；下一页的游标（已是最后一页时为nil）
+func paginate[T any](items []T, params listParams, sortKeys map[string]func(T) sortValue, idOf func(T) int) ([]T, *pageCursor) {
+	desc := strings.HasPrefix(params.Sort, "-")
+	keyOf := sortKeys[strings.TrimPrefix(params.Sort, "-")]
+
+	// compare：先比较排序键，相同时比较ID；降序时整体取反
+	compare := func(keyA sortValue, idA int, keyB sortValue, idB int) int {
+		c := keyA.compare(keyB)
+		if c == 0 {
+			c = sortValue{Num: idA}.compare(sortValue{Num: idB})
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return compare(keyOf(items[i]), idOf(items[i]), keyOf(items[j]), idOf(items[j])) < 0
+	})
+
+	// 有游标时，用二分查找定位第一条排在游标之后的记录
+	start := 0
+	if params.Cursor != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return compare(keyOf(items[i]), idOf(items[i]), params.Cursor.Key, params.Cursor.ID) > 0
+		})
+	}
+	end := start + params.Limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := items[start:end]
+	if end == len(items) {
+		return page, nil
+	}
+	last := page[len(page)-1]
+	return page, &pageCursor{Sort: params.Sort, Key: keyOf(last), ID: idOf(last)}
+}
+
+// writeListHeaders：写入X-Total-Count和Link响应头
+// Link中的URL保留客户端原有的过滤和排序参数，只替换cursor
+func writeListHeaders(w http.ResponseWriter, r *http.Request, total int, next *pageCursor) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	pageURL := func(cursor *pageCursor) string {
+		query := r.URL.Query()
+		query.Del("cursor")
+		if cursor != nil {
+			query.Set("cursor", cursor.encode())
+		}
+		if len(query) == 0 {
+			return r.URL.Path
+		}
+		return r.URL.Path + "?" + query.Encode()
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(nil))}
+	if next != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(next)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// 用户和帖子允许排序的字段
+// created、date是RFC3339格式字符串，同一时区下按字符串比较即按时间先后排序
+var (
+	userSortKeys = map[string]func(User) sortValue{
+		"id":      func(u User) sortValue { return sortValue{Num: u.ID} },
+		"name":    func(u User) sortValue { return sortValue{Str: u.Name} },
+		"email":   func(u User) sortValue { return sortValue{Str: u.Email} },
+		"age":     func(u User) sortValue { return sortValue{Num: u.Age} },
+		"created": func(u User) sortValue { return sortValue{Str: u.Created} },
+	}
+	postSortKeys = map[string]func(Post) sortValue{
+		"id":        func(p Post) sortValue { return sortValue{Num: p.ID} },
+		"title":     func(p Post) sortValue { return sortValue{Str: p.Title} },
+		"author_id": func(p Post) sortValue { return sortValue{Num: p.AuthorID} },
+		"date":      func(p Post) sortValue { return sortValue{Str: p.Date} },
+	}
+)
+
+// filterUsers：按age_min、age_max、email（邮箱域名）过滤用户
+// 例如：/users?age_min=18&age_max=30&email=example.com
+func filterUsers(users []User, query url.Values) ([]User, error) {
+	ageMin, ageMax := -1, -1
+	for name, target := range map[string]*int{"age_min": &ageMin, "age_max": &ageMax} {
+		if s := query.Get(name); s != "" {
+			value, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s必须是整数", name)
+			}
+			*target = value
+		}
+	}
+	// email参数是域名，允许带或不带"@"前缀，比较时忽略大小写
+	domain := strings.ToLower(strings.TrimPrefix(query.Get("email"), "@"))
+
+	filtered := make([]User, 0, len(users))
+	for _, user := range users {
+		if ageMin >= 0 && user.Age < ageMin {
+			continue
+		}
+		if ageMax >= 0 && user.Age > ageMax {
+			continue
+		}
+		if domain != "" && !strings.HasSuffix(strings.ToLower(user.Email), "@"+domain) {
+			continue
+		}
+		filtered = append(filtered, user)
+	}
+	return filtered, nil
+}
+
+// filterPosts：按author_id（作者的用户ID）过滤帖子
+// 旧版本的author参数按作者名称过滤，帖子改为引用用户ID后已经移除；
+// 未知的查询参数通常被忽略，但静默忽略author会让旧客户端拿到未经过滤的全部帖子，因此明确返回400
+func filterPosts(posts []Post, query url.Values) ([]Post, error) {
+	if query.Has("author") {
+		return nil, errors.New("author参数已移除，请改用author_id（作者的用户ID），例如/posts?author_id=1；也可以使用/users/{id}/posts")
+	}
+	s := query.Get("author_id")
+	if s == "" {
+		return posts, nil
+	}
+	authorID, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, errors.New("author_id必须是整数")
+	}
+	filtered := make([]Post, 0, len(posts))
+	for _, post := range posts {
+		if post.AuthorID == authorID {
+			filtered = append(filtered, post)
+		}
+	}
+	return filtered, nil
+}
+
+// 5.3 条件请求：ETag、If-None-Match和If-Match
+// 每个响应都带有强ETag（strong ETag），客户端可以用它做两件事：
+// - 缓存校验：GET时携带If-None-Match，资源没有变化则返回304 Not Modified，不必重新传输响应体
+// - 乐观锁：PUT、PATCH、DELETE必须携带If-Match，资源在读取之后被其他客户端修改过则返回412 Precondition Failed，
+//   避免两个客户端同时编辑时后提交的一方悄悄覆盖前一方的修改（"丢失更新"问题）
+// 单个资源的ETag由版本号生成；列表包含多个资源并且受分页、过滤参数影响，ETag取响应体的SHA-256哈希
+
+// versionETag：由版本号生成单个资源的ETag，例如"v3"
+func versionETag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// contentETag：由响应体内容生成ETag，内容逐字节相同时ETag才相同，因此是强ETag
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches：判断If-Match或If-None-Match请求头是否与etag匹配
+// 请求头可以是"*"或逗号分隔的多个ETag；weak为true时使用弱比较（忽略W/前缀），If-None-Match按规范使用弱比较
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue // 强比较时弱ETag永远不匹配
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag：写入带ETag的JSON响应
+// GET和HEAD请求的If-None-Match命中时只返回304和ETag，不返回响应体
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, status int, etag string, body []byte) {
+	w.Header().Set("ETag", etag)
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeEntity：写入单个资源，ETag由版本号生成
+func writeEntity(w http.ResponseWriter, r *http.Request, status int, entity interface{}, version int) {
+	body, err := json.Marshal(entity)
+	if err != nil {
+		requestLogger(r).Error("序列化资源失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	writeJSONWithETag(w, r, status, versionETag(version), append(body, '\n'))
+}
+
+// writeList：写入资源列表，ETag由响应体内容生成
+func writeList(w http.ResponseWriter, r *http.Request, list interface{}) {
+	body, err := json.Marshal(list)
+	if err != nil {
+		requestLogger(r).Error("序列化列表失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	body = append(body, '\n')
+	writeJSONWithETag(w, r, http.StatusOK, contentETag(body), body)
+}
+
+// checkIfMatch：检查写操作的If-Match前提条件，不满足时写入错误响应并返回false
+// 缺少If-Match返回428 Precondition Required：强制客户端先GET资源，拿到ETag后再修改
+// ETag与当前版本不一致返回412 Precondition Failed，并通过ETag响应头告知当前版本
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		writeProblem(w, http.StatusPreconditionRequired, "修改资源需要携带If-Match请求头（取值为GET响应中的ETag）")
+		return false
+	}
+	if !etagMatches(header, versionETag(version), false) {
+		w.Header().Set("ETag", versionETag(version))
+		writePreconditionFailed(w)
+		return false
+	}
+	return true
+}
+
+// writePreconditionFailed：资源已被其他请求修改，返回412
+func writePreconditionFailed(w http.ResponseWriter) {
+	writeProblem(w, http.StatusPreconditionFailed, "资源已被修改，请重新获取最新版本后再提交")
+}
+
+// 5.4 全文搜索
+// 5-arrays-slices-maps.go中的wordFrequency按空格切分单词，对中文完全无效：中文句子中词与词之间没有空格
+// 这里实现一个进程内的倒排索引（inverted index），支持中英文混合的帖子搜索：
+// - 分词：ASCII等字母文字按单词切分并转为小写；中日韩文字（CJK）切成相邻两个字的二元组（bigram），
+//   例如"语言编程"切成"语言"、"言编"、"编程"，不需要词典也能匹配任意两个字以上的中文词
+// - 倒排索引：词项 -> 包含该词项的帖子及词频，查询时只需访问查询词对应的帖子，而不必扫描全部帖子
+// - 排序：BM25算法，综合考虑词频、词项的稀有程度（逆文档频率）和文档长度
+// - 摘要：在标题和正文中用<mark>标出命中的词项
+// 索引只保存词项统计，不保存帖子本身；搜索结果中的帖子从存储中读取，保证与其他接口返回的数据一致
+// 创建、修改、删除帖子的处理器在写入存储成功后同步更新索引，启动时从存储中的全部帖子重建索引
+
+// BM25的两个参数，取常用的默认值
+// k1控制词频饱和的速度：同一个词出现10次并不比出现3次相关10/3倍
+// b控制文档长度归一化的程度：长文档天然包含更多词，需要适当降低其得分
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+const (
+	defaultSearchLimit = 20 // 未指定limit时返回的结果数
+	snippetRunes       = 80 // 正文摘要的最大长度（字符数）
+	snippetLead        = 20 // 摘要中第一个命中词之前保留的字符数
+)
+
+// token：分词结果中的一个词项，记录它在原文中的位置，用于生成高亮摘要
+type token struct {
+	Term       string // 词项：小写的单词或CJK二元组
+	Start, End int    // 在原文中的字节偏移，原文[Start:End]即词项对应的文本
+}
+
+// isCJK：判断字符是否属于中日韩文字，这些文字的词与词之间没有空格
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize：把文本切分为词项
+// 连续的字母和数字组成一个单词（转为小写）；连续的CJK字符切成二元组，只有一个字时保留单字
+// 标点、空白等其他字符作为分隔符
+func tokenize(text string) []token {
+	var tokens []token
+	wordStart := -1 // 当前单词的起始偏移，-1表示不在单词中
+	var run []token // 当前连续CJK字符，每个字符作为一个token记录位置
+
+	flushWord := func(end int) {
+		if wordStart >= 0 {
+			tokens = append(tokens, token{Term: strings.ToLower(text[wordStart:end]), Start: wordStart, End: end})
+			wordStart = -1
+		}
+	}
+	flushRun := func() {
+		if len(run) == 1 {
+			tokens = append(tokens, run[0])
+		}
+		for i := 1; i < len(run); i++ {
+			tokens = append(tokens, token{Term: run[i-1].Term + run[i].Term, Start: run[i-1].Start, End: run[i].End})
+		}
+		run = run[:0]
+	}
+
+	for i, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord(i)
+			run = append(run, token{Term: string(r), Start: i, End: i + utf8.RuneLen(r)})
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushRun()
+			if wordStart < 0 {
+				wordStart = i
+			}
+		default:
+			flushWord(i)
+			flushRun()
+		}
+	}
+	flushWord(len(text))
+	flushRun()
+	return tokens
+}
+
+// SearchIndex：帖子的倒排索引，读写锁保证搜索与更新可以并发进行
+type SearchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int]int // 词项 -> 帖子ID -> 词频
+	terms    map[int][]string       // 帖子ID -> 帖子包含的不同词项，删除帖子时据此清理倒排表
+	lengths  map[int]int            // 帖子ID -> 帖子的词项总数（文档长度）
+	total    int                    // 所有帖子的文档长度之和，用于计算平均文档长度
+}
+
+// searchIndex：全局的帖子搜索索引，在main函数中由存储中的帖子重建
+var searchIndex = NewSearchIndex()
+
+// NewSearchIndex：创建空索引
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[int]int),
+		terms:    make(map[int][]string),
+		lengths:  make(map[int]int),
+	}
+}
+
+// Rebuild：清空索引并重新索引给定的全部帖子
+func (idx *SearchIndex) Rebuild(posts []Post) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.postings = make(map[string]map[int]int)
+	idx.terms = make(map[int][]string)
+	idx.lengths = make(map[int]int)
+	idx.total = 0
+	for _, post := range posts {
+		idx.add(post)
+	}
+}
+
+// Index：索引帖子；帖子已在索引中时先移除旧内容，因此创建和修改都调用它
+func (idx *SearchIndex) Index(post Post) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(post.ID)
+	idx.add(post)
+}
+
+// Remove：从索引中移除帖子
+func (idx *SearchIndex) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+// add：把帖子的标题和正文加入索引，调用方必须持有写锁
+func (idx *SearchIndex) add(post Post) {
+	counts := make(map[string]int)
+	length := 0
+	for _, field := range []string{post.Title, post.Content} {
+		for _, tok := range tokenize(field) {
+			counts[tok.Term]++
+			length++
+		}
+	}
+
+	terms := make([]string, 0, len(counts))
+	for term, count := range counts {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[int]int)
+		}
+		idx.postings[term][post.ID] = count
+		terms = append(terms, term)
+	}
+	idx.terms[post.ID] = terms
+	idx.lengths[post.ID] = length
+	idx.total += length
+}
+
+// remove：从索引中移除帖子，调用方必须持有写锁
+func (idx *SearchIndex) remove(id int) {
+	for _, term := range idx.terms[id] {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term) // 不再有帖子包含的词项，避免倒排表只增不减
+		}
+	}
+	idx.total -= idx.lengths[id]
+	delete(idx.terms, id)
+	delete(idx.lengths, id)
+}
+
+// searchMatch：一条搜索命中，只包含帖子ID和BM25得分
+type searchMatch struct {
+	ID    int
+	Score float64
+}
+
+// Search：按BM25得分从高到低返回与查询相关的帖子，至多limit条
+// 返回值：命中列表；匹配到的索引词项（用于高亮）
+// 帖子只要包含任意一个查询词项就算命中，包含的词项越多、越稀有，得分越高
+func (idx *SearchIndex) Search(query string, limit int) ([]searchMatch, map[string]bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	matched := make(map[string]bool)
+	for _, tok := range tokenize(query) {
+		if _, exists := idx.postings[tok.Term]; exists {
+			matched[tok.Term] = true
+		}
+		// 单个汉字在索引中只出现在二元组里，例如搜索"语"应当匹配"语言"、"汉语"
+		if utf8.RuneCountInString(tok.Term) == 1 && isCJK([]rune(tok.Term)[0]) {
+			for term := range idx.postings {
+				if utf8.RuneCountInString(term) == 2 && strings.Contains(term, tok.Term) {
+					matched[term] = true
+				}
+			}
+		}
+	}
+	if len(matched) == 0 || len(idx.lengths) == 0 {
+		return nil, matched
+	}
+
+	// BM25：score = Σ IDF(t) × tf × (k1+1) / (tf + k1 × (1 - b + b × 文档长度/平均长度))
+	// IDF(t) = ln(1 + (N - n + 0.5) / (n + 0.5))，N为帖子总数，n为包含词项t的帖子数
+	docs := float64(len(idx.lengths))
+	avgLength := float64(idx.total) / docs
+	scores := make(map[int]float64)
+	for term := range matched {
+		posting := idx.postings[term]
+		n := float64(len(posting))
+		idf := math.Log(1 + (docs-n+0.5)/(n+0.5))
+		for id, count := range posting {
+			tf := float64(count)
+			norm := 1 - bm25B + bm25B*float64(idx.lengths[id])/avgLength
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	matches := make([]searchMatch, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, searchMatch{ID: id, Score: score})
+	}
+	// 得分相同时按ID排序，保证结果稳定
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, matched
+}
+
+// SearchHit：搜索接口返回的一条结果
+type SearchHit struct {
+	Post
+	Score     float64         `json:"score"`     // BM25得分，越大越相关
+	Highlight SearchHighlight `json:"highlight"` // 标出命中词项的标题和正文摘要
+}
+
+// SearchHighlight：高亮后的文本，已做HTML转义，命中的部分包在<mark>标签中，可以直接插入网页
+type SearchHighlight struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// highlight：在text中用<mark>标出属于terms的词项
+// maxRunes大于0时只截取第一个命中词附近的一段作为摘要，被截断的一端用"…"表示
+func highlight(text string, terms map[string]bool, maxRunes int) string {
+	// 收集命中词项的区间；相邻二元组互相重叠（"语言"和"言编"共享"言"），合并为一个区间
+	var spans [][2]int
+	for _, tok := range tokenize(text) {
+		if !terms[tok.Term] {
+			continue
+		}
+		if n := len(spans); n > 0 && tok.Start <= spans[n-1][1] {
+			if tok.End > spans[n-1][1] {
+				spans[n-1][1] = tok.End
+			}
+			continue
+		}
+		spans = append(spans, [2]int{tok.Start, tok.End})
+	}
+
+	start, end := 0, len(text)
+	if maxRunes > 0 && utf8.RuneCountInString(text) > maxRunes {
+		// 从第一个命中词往前退snippetLead个字符，再往后取maxRunes个字符
+		if len(spans) > 0 {
+			start = spans[0][0]
+			for i := 0; i < snippetLead && start > 0; i++ {
+				_, size := utf8.DecodeLastRuneInString(text[:start])
+				start -= size
+			}
+		}
+		end = start
+		for i := 0; i < maxRunes && end < len(text); i++ {
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, span := range spans {
+		// 只处理落在摘要范围内的部分
+		if span[1] <= start || span[0] >= end {
+			continue
+		}
+		from, to := max(span[0], start), min(span[1], end)
+		b.WriteString(html.EscapeString(text[pos:from]))
+		b.WriteString("<mark>" + html.EscapeString(text[from:to]) + "</mark>")
+		pos = to
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// searchPosts：处理全文搜索请求（GET /posts/search?q=关键词）
+// 功能：在倒排索引中查找与q相关的帖子，按相关度从高到低返回，并附上高亮摘要
+// 示例：GET /posts/search?q=Go语言&limit=10
+func searchPosts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeProblem(w, http.StatusBadRequest, "缺少搜索关键词q")
+		return
+	}
+	limit := defaultSearchLimit
+	if s := query.Get("limit"); s != "" {
+		value, err := strconv.Atoi(s)
+		if err != nil || value < 1 || value > maxPageLimit {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("limit必须是1到%d之间的整数", maxPageLimit))
+			return
+		}
+		limit = value
+	}
+
+	matches, terms := searchIndex.Search(q, limit)
+	hits := make([]SearchHit, 0, len(matches))
+	for _, match := range matches {
+		post, err := storeFrom(r).GetPost(match.ID)
+		if errors.Is(err, ErrNotFound) {
+			continue // 搜索期间帖子被删除，索引尚未更新
+		}
+		if err != nil {
+			requestLogger(r).Error("查询帖子失败", "error", err)
+			writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+			return
+		}
+		hits = append(hits, SearchHit{
+			Post:  *post,
+			Score: math.Round(match.Score*1000) / 1000, // 保留三位小数，完整精度对客户端没有意义
+			Highlight: SearchHighlight{
+				Title:   highlight(post.Title, terms, 0),
+				Content: highlight(post.Content, terms, snippetRunes),
+			},
+		})
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(hits)))
+	writeList(w, r, hits)
+}
+
+// 5.5 变更事件流（Server-Sent Events）
+// 管理后台原先每隔几秒轮询一次/users；改为订阅/events，服务器在数据变化时主动推送事件：
+// user.created、user.updated、user.deleted、user.restored、post.created、post.updated、post.deleted、post.restored
+// SSE基于普通的HTTP响应：响应头为text/event-stream，响应体是持续写出的文本，每个事件形如
+//   id: 42
+//   event: user.created
+//   data: {"id":3,"name":"王五",...}
+// 浏览器的EventSource断线后会自动重连，并在Last-Event-ID请求头中带上最后收到的事件ID；
+// 服务器在内存中保留最近的事件（重放缓冲区），据此补发断线期间错过的事件
+// 事件由写操作的处理器在写入存储成功后发布，与返回给客户端的响应来自同一份数据
+
+const (
+	eventReplaySize   = 1000             // 重放缓冲区保留的事件数
+	eventClientBuffer = 64               // 每个订阅者的待发送队列长度，队列满说明客户端读取太慢
+	eventHeartbeat    = 15 * time.Second // 心跳间隔，防止代理因连接长时间没有数据而断开
+	eventWriteTimeout = 10 * time.Second // 单次写出的超时时间，客户端停止读取时及时断开
+	eventRetry        = 3 * time.Second  // 建议客户端断线后等待多久重连
+)
+
+// Event：一条变更事件
+type Event struct {
+	ID   uint64          // 事件ID，单调递增
+	Type string          // 事件类型，如"user.created"
+	Data json.RawMessage // 事件数据（JSON），created、updated、restored为资源本身，deleted为{"id":...}
+}
+
+// eventSubscriber：一个/events连接
+// 发布事件时只向ch投递，真正写出网络由连接自己的goroutine完成，慢客户端不会拖慢发布者
+type eventSubscriber struct {
+	ch chan Event
+}
+
+// EventBroker：事件的发布与订阅中心
+type EventBroker struct {
+	mu          sync.Mutex
+	nextID      uint64                        // 下一个事件的ID，从1开始
+	buffer      []Event                       // 最近的事件，按ID升序，至多eventReplaySize条
+	subscribers map[*eventSubscriber]struct{} // 当前连接的订阅者
+	closed      bool                          // 服务器正在关闭，不再接受新的订阅
+}
+
+// events：全局的事件中心，处理器通过它发布数据变更
+var events = NewEventBroker()
+
+// NewEventBroker：创建事件中心
+func NewEventBroker() *EventBroker {
+	return &EventBroker{nextID: 1, subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+// Publish：发布事件，写入重放缓冲区并投递给所有订阅者
+// 订阅者的队列已满时不等待，而是断开该订阅者：它重连后可以通过Last-Event-ID从缓冲区补齐事件
+func (b *EventBroker) Publish(eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logger.Error("序列化事件失败", "type", eventType, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	event := Event{ID: b.nextID, Type: eventType, Data: payload}
+	b.nextID++
+	b.buffer = append(b.buffer, event)
+	if len(b.buffer) > eventReplaySize {
+		b.buffer = b.buffer[len(b.buffer)-eventReplaySize:]
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			logger.Warn("事件订阅者读取过慢，断开连接", "event_id", event.ID)
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe：注册订阅者，并返回需要补发的事件
+// 参数：lastID - 客户端最后收到的事件ID；resume - 客户端是否携带了Last-Event-ID
+// 返回值：订阅者（服务器正在关闭时为nil）；需要补发的事件；
+// complete为false表示错过的事件已不在缓冲区中（或lastID来自重启之前），客户端应重新拉取完整数据
+// 查询缓冲区和注册订阅者在同一把锁内完成，两者之间发布的事件既不会丢失也不会重复
+func (b *EventBroker) Subscribe(lastID uint64, resume bool) (sub *eventSubscriber, replay []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, false
+	}
+
+	complete = true
+	if resume {
+		oldest := b.nextID // 缓冲区为空时，只有lastID恰好是最后一个事件才算连续
+		if len(b.buffer) > 0 {
+			oldest = b.buffer[0].ID
+		}
+		if lastID+1 < oldest || lastID >= b.nextID {
+			complete = false
+		}
+		for _, event := range b.buffer {
+			if complete && event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	sub = &eventSubscriber{ch: make(chan Event, eventClientBuffer)}
+	b.subscribers[sub] = struct{}{}
+	return sub, replay, complete
+}
+
+// Unsubscribe：连接结束时注销订阅者；已被Publish断开的订阅者不会重复关闭
+func (b *EventBroker) Unsubscribe(sub *eventSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.subscribers[sub]; exists {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Close：断开所有订阅者并拒绝新的订阅
+// 优雅关闭时server.Shutdown会等待所有请求结束，而事件流永远不会自己结束，必须由服务器主动断开
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// writeEvent：按SSE格式写出一条事件
+func writeEvent(w io.Writer, event Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// handleEvents：处理事件流请求（GET /events）
+// 功能：先补发Last-Event-ID之后的事件，再持续推送新事件，空闲时定期发送心跳
+// 示例：curl -N http://localhost:8080/events
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	var lastID uint64
+	header := r.Header.Get("Last-Event-ID")
+	if header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "Last-Event-ID必须是事件ID")
+			return
+		}
+		lastID = id
+	}
+
+	sub, replay, complete := events.Subscribe(lastID, header != "")
+	if sub == nil {
+		writeProblem(w, http.StatusServiceUnavailable, "服务器正在关闭")
+		return
+	}
+	defer events.Unsubscribe(sub)
+
+	// http.ResponseController通过Unwrap穿过中间件的responseRecorder，找到底层连接的Flush和SetWriteDeadline
+	rc := http.NewResponseController(w)
+	// write：写出一段数据并立即发送给客户端
+	// 服务器的WriteTimeout从读完请求头开始计算，对长连接来说总会到期，所以每次写之前单独设置截止时间：
+	// 正常的客户端永远不会超时，停止读取的客户端会在eventWriteTimeout之后被断开
+	write := func(fn func() error) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // 告诉Nginx不要缓冲响应，否则事件会攒到一起才发出
+	w.WriteHeader(http.StatusOK)
+
+	err := write(func() error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+		if err != nil || complete {
+			return err
+		}
+		// 错过的事件已无法补发：通知客户端重新拉取列表，再从当前位置继续接收
+		_, err = fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		return err
+	})
+	for _, event := range replay {
+		if err != nil {
+			break
+		}
+		err = write(func() error { return writeEvent(w, event) })
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return // 客户端断开连接
+		case event, ok := <-sub.ch:
+			if !ok {
+				return // 读取过慢被断开，或服务器正在关闭
+			}
+			err = write(func() error { return writeEvent(w, event) })
+		case <-heartbeat.C:
+			// 以冒号开头的行是注释，EventSource会忽略它
+			err = write(func() error {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				return err
+			})
+		}
+	}
+	requestLogger(r).Info("事件流写出失败，断开连接", "error", err)
+}
+
+// 5.6 批量导入与流式导出
+// 团队每周要从电子表格迁移用户名单，逐条POST既慢又难以定位出错的行：
+// - POST /users:import、POST /posts:import：请求体为CSV（text/csv，第一行是表头）或NDJSON（application/x-ndjson，每行一个JSON对象）
+//   先校验全部行，任何一行有问题就返回422并列出每个出错行的字段错误，不导入任何数据，修正后整体重新提交即可，不会产生重复记录
+//   校验通过的行在同一个存储事务中写入（见inRequestTx），中途出现存储错误时已写入的行也会撤销
+// - GET /users:export?format=csv|ndjson：按ID分批从存储读取并立即写出，内存占用与用户总数无关
+// 路径中的":import"是Google API设计指南中的自定义方法写法，整段"users:import"是一个字面量路由段
+
+const (
+	maxImportBytes     = 10 << 20         // 导入请求体的最大字节数（10MB）
+	maxImportErrors    = 100              // 最多报告的出错行数，超出部分只计数
+	exportBatchSize    = 500              // 导出时每批从存储读取的用户数
+	exportWriteTimeout = 30 * time.Second // 导出时每批数据的写出超时
+)
+
+// ImportRowError：导入数据中一行的错误
+type ImportRowError struct {
+	Row    int            `json:"row"`    // 行号：CSV为电子表格中的行号（表头是第1行），NDJSON为文本行号
+	Errors []problemField `json:"errors"` // 该行的字段错误；整行无法解析时field为空
+}
+
+// ImportResult：导入成功时的响应
+type ImportResult struct {
+	Imported int   `json:"imported"` // 导入的记录数
+	IDs      []int `json:"ids"`      // 新记录的ID，顺序与输入行一致
+}
+
+// importRow：解码并通过校验的一行数据
+type importRow[T any] struct {
+	row    int
+	record T
+}
+
+// importColumn：CSV中一列的解析函数，把单元格的文本写入记录的对应字段
+type importColumn[T any] func(record *T, value string) error
+
+// userImportColumns、postImportColumns：CSV导入支持的列，表头必须包含全部这些列（顺序不限）
+var (
+	userImportColumns = map[string]importColumn[User]{
+		"name":  func(u *User, v string) error { u.Name = strings.TrimSpace(v); return nil },
+		"email": func(u *User, v string) error { u.Email = strings.TrimSpace(v); return nil },
+		"age":   func(u *User, v string) error { return parseIntCell(v, &u.Age) },
+	}
+	postImportColumns = map[string]importColumn[Post]{
+		"title":     func(p *Post, v string) error { p.Title = strings.TrimSpace(v); return nil },
+		"content":   func(p *Post, v string) error { p.Content = v; return nil },
+		"author_id": func(p *Post, v string) error { return parseIntCell(v, &p.AuthorID) },
+	}
+)
+
+// serverImportColumns：由服务器维护的列，导入时忽略其中的值
+// 这样GET /users:export导出的文件可以原样重新导入，不必先删除这几列
+var serverImportColumns = map[string]bool{"id": true, "created": true, "date": true, "version": true, "deleted_at": true}
+
+// parseIntCell：解析整数单元格；电子表格导出的数字可能带空格
+func parseIntCell(value string, dst *int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return errors.New("必须是整数")
+	}
+	*dst = n
+	return nil
+}
+
+// errImportBody：请求体整体不可用（格式无法识别、表头不正确等），对应400；与逐行的校验错误区分
+type errImportBody struct{ msg string }
+
+func (e *errImportBody) Error() string { return e.msg }
+
+// readImport：按Content-Type解码请求体中的全部行并逐行校验
+// 返回值：通过校验的行；出错的行（至多maxImportErrors个）；出错的总行数；请求体整体错误
+func readImport[T any, PT interface {
+	*T
+	validatable
+}](r *http.Request, columns map[string]importColumn[T]) (rows []importRow[T], rowErrs []ImportRowError, failed int, err error) {
+	// addError：记录一行的错误，把ValidationErrors展开为字段列表
+	addError := func(row int, err error) {
+		failed++
+		if len(rowErrs) >= maxImportErrors {
+			return
+		}
+		rowErr := ImportRowError{Row: row, Errors: validationFields(err)}
+		if rowErr.Errors == nil {
+			rowErr.Errors = []problemField{{Message: err.Error()}} // 整行无法解析，例如JSON格式错误、列数不符
+		}
+		rowErrs = append(rowErrs, rowErr)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		reader := csv.NewReader(r.Body)
+		reader.FieldsPerRecord = -1 // 列数不符作为该行的错误报告，而不是中断整个导入
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil, nil, 0, &errImportBody{"CSV数据为空，第一行必须是表头"}
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		// 解析表头：Excel保存的"CSV UTF-8"文件以BOM开头，需要去掉；列名不区分大小写
+		setters := make([]importColumn[T], len(header))
+		seen := make(map[string]bool)
+		for i, name := range header {
+			name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+			header[i] = name
+			if serverImportColumns[name] {
+				setters[i] = func(*T, string) error { return nil }
+				continue
+			}
+			setter, ok := columns[name]
+			if !ok || seen[name] {
+				return nil, nil, 0, &errImportBody{fmt.Sprintf("表头第%d列 %q 无效（可用的列: %s）", i+1, name, strings.Join(sortedKeys(columns), ", "))}
+			}
+			seen[name] = true
+			setters[i] = setter
+		}
+		if len(seen) != len(columns) {
+			return nil, nil, 0, &errImportBody{fmt.Sprintf("表头必须包含以下全部列: %s", strings.Join(sortedKeys(columns), ", "))}
+		}
+
+		for row := 2; ; row++ {
+			cells, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					return nil, nil, 0, err // 读取请求体失败（例如超过大小限制）
+				}
+				return nil, nil, 0, &errImportBody{fmt.Sprintf("第%d行CSV格式错误: %v", row, parseErr.Err)}
+			}
+			if len(cells) != len(setters) {
+				addError(row, fmt.Errorf("应有%d列，实际为%d列", len(setters), len(cells)))
+				continue
+			}
+
+			var record T
+			errs := &ValidationErrors{}
+			for i, cell := range cells {
+				if err := setters[i](&record, cell); err != nil {
+					errs.Add(header[i], err.Error())
+				}
+			}
+			if err := checkPayload(errs.Err(), PT(&record)); err != nil {
+				addError(row, err)
+				continue
+			}
+			rows = append(rows, importRow[T]{row, record})
+		}
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes) // 单行可能很长，默认的64KB上限不够
+		for row := 1; scanner.Scan(); row++ {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue // 允许空行，例如文件末尾多出的换行
+			}
+			var record T
+			if err := checkPayload(decodeJSONObject(line, PT(&record)), PT(&record)); err != nil {
+				addError(row, err)
+				continue
+			}
+			rows = append(rows, importRow[T]{row, record})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, 0, err
+		}
+	default:
+		return nil, nil, 0, errUnsupportedImportType
+	}
+	return rows, rowErrs, failed, nil
+}
+
+// errUnsupportedImportType：Content-Type既不是CSV也不是NDJSON，对应415
+var errUnsupportedImportType = errors.New("Content-Type必须是text/csv或application/x-ndjson")
+
+// errImportRejected：有行没有通过需要查询存储的检查（例如作者不存在），撤销事务并返回422
+var errImportRejected = errors.New("导入数据未通过校验")
+
+// sortedKeys：返回map的键并排序，用于生成稳定的错误信息
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeImportError：写入readImport返回的请求体整体错误
+func writeImportError(w http.ResponseWriter, err error) {
+	var bodyErr *errImportBody
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUnsupportedImportType):
+		writeProblem(w, http.StatusUnsupportedMediaType, err.Error())
+	case errors.As(err, &tooLarge):
+		writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("导入数据不能超过%dMB，请分批导入", maxImportBytes>>20))
+	case errors.As(err, &bodyErr):
+		writeProblem(w, http.StatusBadRequest, err.Error())
+	default:
+		writeProblem(w, http.StatusBadRequest, "读取请求体失败: "+err.Error())
+	}
+}
+
+// writeImportRowErrors：有行未通过校验时返回422，列出每个出错的行
+func writeImportRowErrors(w http.ResponseWriter, rowErrs []ImportRowError, failed int) {
+	detail := fmt.Sprintf("%d行数据未通过校验，没有导入任何数据", failed)
+	if failed > len(rowErrs) {
+		detail += fmt.Sprintf("（只列出前%d行）", len(rowErrs))
+	}
+	writeProblemJSON(w, Problem{
+		Type:   "/problems/import-error",
+		Title:  "导入数据校验失败",
+		Status: http.StatusUnprocessableEntity,
+		Detail: detail,
+		Rows:   rowErrs,
+	})
+}
+
+// importUsers：处理批量导入用户的请求（POST /users:import）
+// 示例：curl -X POST --data-binary @users.csv -H "Content-Type: text/csv" http://localhost:8080/users:import
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	rows, rowErrs, failed, err := readImport(r, userImportColumns)
+	if err != nil {
+		writeImportError(w, err)
+		return
+	}
+	if failed > 0 {
+		writeImportRowErrors(w, rowErrs, failed)
+		return
+	}
+
+	// 所有行在同一个事务中写入：任何一行写入失败都会撤销之前的行，客户端修正后可以直接重新提交整个文件
+	result := ImportResult{IDs: make([]int, 0, len(rows))}
+	err = inRequestTx(r, func(r *http.Request) error {
+		for _, row := range rows {
+			user := row.record
+			user.Created = time.Now().Format(time.RFC3339)
+			if err := storeFrom(r).CreateUser(&user); err != nil {
+				return fmt.Errorf("第%d行: %w", row.row, err)
+			}
+			publishEvent(r, "user.created", user)
+			result.Imported++
+			result.IDs = append(result.IDs, user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		// 校验已经全部通过，写入失败只可能是存储故障
+		requestLogger(r).Error("导入用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误，没有导入任何数据")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// importPosts：处理批量导入帖子的请求（POST /posts:import）
+// 除字段校验外还要检查author_id指向的用户是否存在
+// 作者检查和写入在同一个事务中进行，检查之后作者不会被其他请求删除
+func importPosts(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	rows, rowErrs, failed, err := readImport(r, postImportColumns)
+	if err != nil {
+		writeImportError(w, err)
+		return
+	}
+
+	result := ImportResult{IDs: make([]int, 0, len(rows))}
+	err = inRequestTx(r, func(r *http.Request) error {
+		// 检查作者：每个不同的author_id只查询一次
+		authorExists := make(map[int]bool)
+		for _, row := range rows {
+			exists, checked := authorExists[row.record.AuthorID]
+			if !checked {
+				_, err := storeFrom(r).GetUser(row.record.AuthorID)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return err
+				}
+				exists = err == nil
+				authorExists[row.record.AuthorID] = exists
+			}
+			if !exists {
+				failed++
+				if len(rowErrs) < maxImportErrors {
+					rowErrs = append(rowErrs, ImportRowError{Row: row.row, Errors: []problemField{{Field: "author_id", Message: "用户不存在"}}})
+				}
+			}
+		}
+		if failed > 0 {
+			return errImportRejected
+		}
+
+		for _, row := range rows {
+			post := row.record
+			post.Date = time.Now().Format(time.RFC3339)
+			if err := storeFrom(r).CreatePost(&post); err != nil {
+				return fmt.Errorf("第%d行: %w", row.row, err)
+			}
+			imported := post
+			afterCommit(r, func() { searchIndex.Index(imported) })
+			publishEvent(r, "post.created", post)
+			result.Imported++
+			result.IDs = append(result.IDs, post.ID)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errImportRejected):
+		sort.Slice(rowErrs, func(i, j int) bool { return rowErrs[i].Row < rowErrs[j].Row })
+		writeImportRowErrors(w, rowErrs, failed)
+		return
+	case err != nil:
+		requestLogger(r).Error("导入帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误，没有导入任何数据")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// exportUsers：处理导出用户的请求（GET /users:export?format=csv|ndjson）
+// 功能：每次从存储读取exportBatchSize个用户，写出后立即发送给客户端，再读取下一批
+// 示例：curl -o users.csv "http://localhost:8080/users:export?format=csv"
+func exportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	// writeUser：按格式写出一个用户；flush：把缓冲的数据交给ResponseWriter
+	var writeUser func(User) error
+	var flush func() error
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "name", "email", "age", "created", "version"}) // 表头，导出的文件可以直接用于POST /users:import
+		writeUser = func(u User) error {
+			return cw.Write([]string{strconv.Itoa(u.ID), u.Name, u.Email, strconv.Itoa(u.Age), u.Created, strconv.Itoa(u.Version)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "ndjson":
+		encoder := json.NewEncoder(w) // Encode在每个值之后写出换行，正好是NDJSON格式
+		writeUser = func(u User) error { return encoder.Encode(u) }
+		flush = func() error { return nil }
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("不支持的导出格式: %s（可选值: csv、ndjson）", format))
+		return
+	}
+
+	// 先读取第一批：存储出错时还能返回正常的错误响应
+	batch, err := storeFrom(r).ListUsersAfter(0, exportBatchSize)
+	if err != nil {
+		requestLogger(r).Error("导出用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	for {
+		// 与事件流相同：为每一批单独设置写出截止时间，导出总耗时不受服务器WriteTimeout限制
+		rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		for _, user := range batch {
+			if err := writeUser(user); err != nil {
+				return // 客户端断开
+			}
+		}
+		if err := flush(); err != nil {
+			return
+		}
+		rc.Flush()
+		if len(batch) < exportBatchSize {
+			return
+		}
+
+		batch, err = storeFrom(r).ListUsersAfter(batch[len(batch)-1].ID, exportBatchSize)
+		if err != nil {
+			// 响应头已经发出，无法再改为错误响应；中断连接，让客户端知道数据不完整，而不是收到一个看似正常结束的文件
+			requestLogger(r).Error("导出用户失败", "error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// 5.7 批量操作
+// 初始化测试数据需要几十次往返：先创建用户，拿到ID后才能创建引用它的帖子
+// POST /batch在一个请求中按顺序执行多个子请求（method、path、body），子请求经过与普通请求完全相同的路由、权限检查和处理器
+// - mode=atomic（默认）：所有子请求在同一个存储事务中执行，任何一个失败（状态码>=400）就回滚全部修改，之后的子请求不再执行
+// - mode=best_effort：子请求各自独立执行，失败的子请求不影响其他子请求
+// - 引用：子请求可以用id命名，之后的子请求在path、headers和body中用"${名称.字段}"引用它的响应体中的字段，
+//   例如先创建用户{"id":"alice",...}，再创建帖子{"body":{"author_id":"${alice.id}",...}}
+//   body中的字符串恰好是一个引用时替换为原始的JSON值（数字仍是数字），否则按文本替换
+// - 事务中产生的变更事件和搜索索引更新通过afterCommit推迟到提交之后，回滚的修改不会被订阅者看到
+// 全部子请求成功时返回200，否则返回207 Multi-Status；每个子请求的状态码和响应体在results中按顺序列出
+// 资源限制：请求体不超过maxImportBytes；每个子请求消耗一次限流额度；atomic模式的事务会阻塞其他写操作，只允许携带API密钥的调用方使用
+
+const maxBatchOperations = 100 // 单个批量请求最多包含的子请求数
+
+// 批量操作的两种模式
+const (
+	batchAtomic     = "atomic"      // 全部成功或全部撤销
+	batchBestEffort = "best_effort" // 逐个执行，互不影响
+)
+
+// BatchRequest：批量操作的请求体
+type BatchRequest struct {
+	Mode       string           `json:"mode"`       // atomic或best_effort，默认atomic
+	Operations []BatchOperation `json:"operations"` // 按顺序执行的子请求
+}
+
+// BatchOperation：一个子请求
+type BatchOperation struct {
+	ID      string            `json:"id,omitempty"`      // 名称，供之后的子请求引用
+	Method  string            `json:"method"`            // HTTP方法
+	Path    string            `json:"path"`              // 路径，可以带查询参数，例如"/users/1?posts=cascade"
+	Headers map[string]string `json:"headers,omitempty"` // 额外的请求头，例如If-Match
+	Body    json.RawMessage   `json:"body,omitempty"`    // JSON请求体
+}
+
+// BatchResponse：批量操作的响应体
+type BatchResponse struct {
+	Mode      string          `json:"mode"`
+	Committed bool            `json:"committed"` // 修改是否已经保存：atomic模式下全部成功时为true；best_effort模式总是true
+	Results   []BatchOpResult `json:"results"`
+}
+
+// BatchOpResult：一个子请求的执行结果
+type BatchOpResult struct {
+	ID         string          `json:"id,omitempty"`
+	Status     int             `json:"status"`                // 子请求的状态码；atomic模式下因前面的失败而没有执行的子请求为424
+	ETag       string          `json:"etag,omitempty"`        // 子请求响应中的ETag
+	Body       json.RawMessage `json:"body,omitempty"`        // 子请求的响应体
+	RolledBack bool            `json:"rolled_back,omitempty"` // 执行成功但随整个事务一起被撤销
+}
+
+// batchRefPattern：子请求中对之前响应的引用，例如${alice.id}
+var batchRefPattern = regexp.MustCompile(`\$\{([A-Za-z0-9_-]+)\.([A-Za-z0-9_]+)\}`)
+
+// batchRefs：已经执行成功的子请求的响应体，按名称保存
+type batchRefs map[string]map[string]json.RawMessage
+
+// lookup：取出引用的字段的原始JSON值
+func (refs batchRefs) lookup(name, field string) (json.RawMessage, error) {
+	fields, ok := refs[name]
+	if !ok {
+		return nil, fmt.Errorf("引用的子请求 %q 不存在、尚未执行或没有成功", name)
+	}
+	value, ok := fields[field]
+	if !ok {
+		return nil, fmt.Errorf("子请求 %q 的响应中没有字段 %q", name, field)
+	}
+	return value, nil
+}
+
+// expand：替换文本中的全部引用；字符串值去掉引号，其他值（数字、布尔）使用JSON文本
+func (refs batchRefs) expand(text string) (string, error) {
+	var firstErr error
+	expanded := batchRefPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		match := batchRefPattern.FindStringSubmatch(ref)
+		value, err := refs.lookup(match[1], match[2])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return ref
+		}
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			return str
+		}
+		return string(value)
+	})
+	return expanded, firstErr
+}
+
+// expandJSON：替换JSON值中的引用
+// 字符串恰好是一个引用时替换为原始的JSON值，这样"${alice.id}"得到数字而不是字符串，author_id才能通过类型检查
+func (refs batchRefs) expandJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if match := batchRefPattern.FindStringSubmatch(v); match != nil && match[0] == v {
+			raw, err := refs.lookup(match[1], match[2])
+			return raw, err
+		}
+		return refs.expand(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			expanded, err := refs.expandJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, item := range v {
+			expanded, err := refs.expandJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+// batchAllowed：子请求只能访问用户和帖子的接口
+// 事件流等长连接接口会一直占用事务，嵌套的/batch没有意义，都不允许
+// 流式导出（/users:export）也不允许：它出错时只能中断连接（panic(http.ErrAbortHandler)），在批量请求中会毁掉整个批量响应
+func batchAllowed(path string) bool {
+	segments := splitPath(path)
+	if len(segments) == 0 || strings.HasSuffix(segments[0], ":export") {
+		return false
+	}
+	for _, resource := range []string{"users", "posts"} {
+		if segments[0] == resource || strings.HasPrefix(segments[0], resource+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSubRequest：展开引用并构造子请求
+// 子请求继承批量请求的上下文，因此沿用同一个调用方身份和请求ID；ctx中还可能带有事务
+func buildSubRequest(ctx context.Context, op BatchOperation, refs batchRefs) (*http.Request, error) {
+	method := strings.ToUpper(op.Method)
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return nil, fmt.Errorf("不支持的方法: %q", op.Method)
+	}
+	target, err := refs.expand(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(target)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || u.Host != "" {
+		return nil, fmt.Errorf("无效的路径: %q", op.Path)
+	}
+	if !batchAllowed(u.Path) {
+		return nil, fmt.Errorf("批量操作只能访问/users和/posts下的接口（不包括流式导出）: %s", u.Path)
+	}
+
+	var body io.Reader = http.NoBody
+	if len(op.Body) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(op.Body))
+		decoder.UseNumber() // 保留数字的原始写法，避免大整数经过float64丢失精度
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("无效的body: %w", err)
+		}
+		if value, err = refs.expandJSON(value); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = "batch"
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range op.Headers {
+		if value, err = refs.expand(value); err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value)
+	}
+	// 子请求的幂等键没有意义：atomic模式下保存的响应可能随事务回滚而失效。需要幂等时在/batch请求本身携带Idempotency-Key
+	req.Header.Del(idempotencyHeader)
+	return req, nil
+}
+
+// batchResponseWriter：在内存中缓冲一个子请求的完整响应（状态码、响应头、响应体），供handleBatch汇总到results中
+// 子请求不连接客户端，不需要Flush等能力；允许的接口都不是流式的（见batchAllowed）
+type batchResponseWriter struct {
+	header http.Header
+	status int // 响应状态码，处理器没有调用WriteHeader时为200
+	body   bytes.Buffer
+}
+
+func newBatchResponseWriter() *batchResponseWriter {
+	return &batchResponseWriter{header: http.Header{}}
+}
+
+// Header：返回子请求的响应头
+func (rec *batchResponseWriter) Header() http.Header {
+	return rec.header
+}
+
+// WriteHeader：只记录第一次设置的状态码，与net/http的行为一致
+func (rec *batchResponseWriter) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// Write：没有显式调用WriteHeader时，第一次Write隐含200状态码
+func (rec *batchResponseWriter) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// Status：返回子请求的状态码；处理器什么都没有写出时为200
+func (rec *batchResponseWriter) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// handleBatch：处理批量操作请求（POST /batch），子请求交给router执行
+func handleBatch(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var batch BatchRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&batch); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("批量请求不能超过%dMB", maxImportBytes>>20))
+				return
+			}
+			writeProblem(w, http.StatusBadRequest, "无效的JSON数据: "+err.Error())
+			return
+		}
+		if batch.Mode == "" {
+			batch.Mode = batchAtomic
+		}
+		if batch.Mode != batchAtomic && batch.Mode != batchBestEffort {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("未知的mode: %s（可选值: %s、%s）", batch.Mode, batchAtomic, batchBestEffort))
+			return
+		}
+		if len(batch.Operations) == 0 || len(batch.Operations) > maxBatchOperations {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("operations必须包含1到%d个子请求", maxBatchOperations))
+			return
+		}
+		names := make(map[string]bool)
+		for i, op := range batch.Operations {
+			if op.ID == "" {
+				continue
+			}
+			if names[op.ID] {
+				writeProblem(w, http.StatusBadRequest, fmt.Sprintf("第%d个子请求的id %q 重复", i+1, op.ID))
+				return
+			}
+			names[op.ID] = true
+		}
+		// 限流中间件已经为/batch本身扣除了一次额度，这里为其余的子请求补扣
+		if !chargeRateLimit(w, r, len(batch.Operations)-1) {
+			return
+		}
+
+		// atomic模式：开始事务，子请求通过上下文中的事务访问存储（见storeFrom）
+		// defer的Rollback保证子请求panic时也会回滚并释放事务占用的锁或连接，提交之后调用没有任何效果
+		ctx := r.Context()
+		var rtx *requestTx
+		if batch.Mode == batchAtomic {
+			// 事务进行期间其他写操作都要等待（内存存储的写锁、SQLite唯一的连接），只允许已认证的调用方开启
+			if identityFrom(r) == nil {
+				writeUnauthorized(w, "atomic模式需要API密钥")
+				return
+			}
+			tx, err := storeFrom(r).Begin()
+			if err != nil {
+				requestLogger(r).Error("开始事务失败", "error", err)
+				writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+				return
+			}
+			defer tx.Rollback()
+			rtx = &requestTx{tx: tx}
+			ctx = context.WithValue(ctx, txKey{}, rtx)
+		}
+
+		response := BatchResponse{Mode: batch.Mode, Committed: true, Results: make([]BatchOpResult, len(batch.Operations))}
+		refs := make(batchRefs)
+		failed := false
+		for i, op := range batch.Operations {
+			result := &response.Results[i]
+			result.ID = op.ID
+			if failed && batch.Mode == batchAtomic {
+				result.Status = http.StatusFailedDependency
+				continue
+			}
+
+			req, err := buildSubRequest(ctx, op, refs)
+			if err != nil {
+				result.Status = http.StatusBadRequest
+				result.Body, _ = json.Marshal(Problem{Type: "about:blank", Title: http.StatusText(http.StatusBadRequest), Status: http.StatusBadRequest, Detail: err.Error()})
+				failed = true
+				continue
+			}
+			rec := newBatchResponseWriter()
+			router.ServeHTTP(rec, req)
+
+			result.Status = rec.Status()
+			result.ETag = rec.Header().Get("ETag")
+			if body := bytes.TrimSpace(rec.body.Bytes()); len(body) > 0 {
+				if json.Valid(body) {
+					result.Body = body
+				} else {
+					result.Body, _ = json.Marshal(string(body)) // 非JSON响应（如导出的CSV）作为字符串返回
+				}
+			}
+			if result.Status >= 400 {
+				failed = true
+				continue
+			}
+			if op.ID != "" {
+				var fields map[string]json.RawMessage
+				json.Unmarshal(result.Body, &fields)
+				refs[op.ID] = fields
+			}
+		}
+
+		if rtx != nil {
+			if failed {
+				rtx.tx.Rollback()
+				response.Committed = false
+				for i := range response.Results {
+					if status := response.Results[i].Status; status < 400 {
+						response.Results[i].RolledBack = true
+					}
+				}
+			} else {
+				if err := rtx.tx.Commit(); err != nil {
+					requestLogger(r).Error("提交批量操作失败", "error", err)
+					writeProblem(w, http.StatusInternalServerError, "服务器内部错误，所有修改均未保存")
+					return
+				}
+				for _, hook := range rtx.hooks {
+					hook()
+				}
+			}
+		}
+
+		status := http.StatusOK
+		if failed {
+			status = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// 5.8 回收站（软删除）
+// DELETE不再直接删除记录，而是给它打上deleted_at并移入回收站，误删之后还可以恢复：
+// - 普通的列表和查询看不到回收站中的记录；管理员可以通过GET /trash或列表的include=deleted参数查看
+// - POST /users/{id}:restore、POST /posts/{id}:restore把记录恢复原状，随用户级联删除的帖子与用户一起恢复
+// - 后台任务定期永久删除在回收站中超过保留时长（-trash-retention）的记录
+// 查看和恢复都需要trash:admin权限
+
+// trashRetention：记录在回收站中保留多久，在main函数中根据配置初始化
+var trashRetention = 30 * 24 * time.Hour
+
+// Trash：回收站的内容（GET /trash）
+type Trash struct {
+	Users     []User `json:"users"`     // 回收站中的用户，最近删除的在前
+	Posts     []Post `json:"posts"`     // 回收站中的帖子，最近删除的在前
+	Retention string `json:"retention"` // 保留时长，例如"720h0m0s"，超过后记录被永久删除
+}
+
+// includeDeleted：解析列表接口的include参数，include=deleted表示同时返回回收站中的记录
+// 查看回收站需要trash:admin权限，复用requireScopes返回401或403
+// 返回值：include - 是否包含回收站中的记录；ok - 为false时已写入错误响应，调用方直接return即可
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	switch value := r.URL.Query().Get("include"); value {
+	case "":
+		return false, true
+	case "deleted":
+	default:
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("不支持的include取值: %s（可选值: deleted）", value))
+		return false, false
+	}
+	requireScopes(scopeTrashAdmin)(func(http.ResponseWriter, *http.Request) { ok = true })(w, r)
+	return true, ok
+}
+
+// getTrash：处理查看回收站的请求（GET /trash）
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	users, err := storeFrom(r).ListDeletedUsers()
+	if err != nil {
+		requestLogger(r).Error("查询用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	posts, err := storeFrom(r).ListDeletedPosts()
+	if err != nil {
+		requestLogger(r).Error("查询帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+
+	// deleted_at是UTC、固定宽度的时间字符串，按字符串降序即按删除时间从近到远
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].DeletedAt != users[j].DeletedAt {
+			return users[i].DeletedAt > users[j].DeletedAt
+		}
+		return users[i].ID > users[j].ID
+	})
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].DeletedAt != posts[j].DeletedAt {
+			return posts[i].DeletedAt > posts[j].DeletedAt
+		}
+		return posts[i].ID > posts[j].ID
+	})
+	writeList(w, r, Trash{Users: users, Posts: posts, Retention: trashRetention.String()})
+}
+
+// restoreUser：处理恢复用户的请求（POST /users/{id}:restore）
+// 删除用户时级联删除的帖子一并恢复，重新加入搜索索引
+func restoreUser(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	user, posts, err := storeFrom(r).RestoreUser(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "回收站中没有该用户")
+			return
+		}
+		requestLogger(r).Error("恢复用户失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	// 先发布用户的事件再发布帖子的事件：订阅者收到帖子时，它引用的作者已经存在
+	publishEvent(r, "user.restored", user)
+	for _, post := range posts {
+		restored := post
+		afterCommit(r, func() { searchIndex.Index(restored) })
+		publishEvent(r, "post.restored", restored)
+	}
+	writeEntity(w, r, http.StatusOK, user, user.Version)
+}
+
+// restorePost：处理恢复帖子的请求（POST /posts/{id}:restore）
+// 作者也在回收站中时返回409，需要先恢复作者
+func restorePost(w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	post, err := storeFrom(r).RestorePost(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeProblem(w, http.StatusNotFound, "回收站中没有该帖子")
+			return
+		}
+		if errors.Is(err, ErrAuthorNotFound) {
+			writeProblem(w, http.StatusConflict, "帖子的作者不存在或仍在回收站中，请先恢复作者")
+			return
+		}
+		requestLogger(r).Error("恢复帖子失败", "error", err)
+		writeProblem(w, http.StatusInternalServerError, "服务器内部错误")
+		return
+	}
+	restored := *post
+	afterCommit(r, func() { searchIndex.Index(restored) })
+	publishEvent(r, "post.restored", post)
+	writeEntity(w, r, http.StatusOK, post, post.Version)
+}
+
+// purgeStatus：最近一次清理回收站的结果，由健康检查读取
+var purgeStatus struct {
+	sync.Mutex
+	err error
+}
+
+// lastPurgeError：返回最近一次清理回收站的错误，尚未清理过或上次成功时返回nil
+func lastPurgeError() error {
+	purgeStatus.Lock()
+	defer purgeStatus.Unlock()
+	return purgeStatus.err
+}
+
+// purgeTrash：后台清理任务，每隔interval永久删除一次在回收站中超过trashRetention的记录，ctx取消时返回
+// 被清理的记录早已从列表、搜索索引中消失，因此不需要发布事件
+func purgeTrash(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		users, posts, err := store.PurgeDeleted(time.Now().Add(-trashRetention))
+		purgeStatus.Lock()
+		purgeStatus.err = err
+		purgeStatus.Unlock()
+		if err != nil {
+			logger.Error("清理回收站失败", "error", err)
+			continue
+		}
+		if users > 0 || posts > 0 {
+			logger.Info("已清理回收站", "users", users, "posts", posts)
+		}
+	}
+}
+
+// 6. 健康检查
+// HealthChecker沿用12-advanced-topics.go中的设计：按名称注册检查函数，CheckAll执行全部检查并返回每个组件的结果
+// 在它的基础上做了几点改进，使它可以直接用作Kubernetes等编排系统的探针：
+// - 检查并发执行，每个检查有自己的超时时间，一个卡住的依赖不会拖慢其他检查
+// - 结果缓存一小段时间，探针和负载均衡器频繁请求时不会给数据库带来额外压力；同一时刻只有一轮检查在执行
+// - 组件分为关键和非关键：关键组件不可用时服务不再就绪，非关键组件不可用只把状态降级为degraded
+// - 优雅关闭开始后立即报告未就绪，负载均衡器据此停止转发新请求
+// 两个探针的含义不同：/livez只回答"进程是否还活着"，不检查任何依赖，否则数据库故障会让编排系统不断重启所有实例；
+// /readyz回答"现在能否处理请求"，不就绪时返回503，实例暂时从负载均衡中摘除，恢复后自动重新加入
+
+// 组件和服务的健康状态
+const (
+	componentUp   = "up"   // 组件可用
+	componentDown = "down" // 组件不可用或检查超时
+
+	healthOK          = "ok"            // 所有组件可用
+	healthDegraded    = "degraded"      // 只有非关键组件不可用，仍然就绪
+	healthUnavailable = "unavailable"   // 关键组件不可用，不就绪
+	healthDraining    = "shutting_down" // 正在优雅关闭，不就绪
+)
+
+// healthCacheTTL：检查结果的缓存时间
+const healthCacheTTL = 2 * time.Second
+
+// ComponentHealth：单个组件的检查结果
+type ComponentHealth struct {
+	Status    string  `json:"status"`                        // up或down
+	Critical  bool    `json:"critical"`                      // 是否为关键组件
+	Error     string  `json:"error,omitempty"`               // 不可用的原因
+	LatencyMS float64 `json:"latency_ms"`                    // 检查耗时（毫秒）
+	CheckedAt string  `json:"checked_at" format:"date-time"` // 检查时间，结果来自缓存时早于响应时间
+}
+
+// HealthReport：/livez和/readyz的响应体
+type HealthReport struct {
+	Status     string                     `json:"status"`                       // ok、degraded、unavailable或shutting_down
+	Version    string                     `json:"version"`                      // 服务版本，构建时通过-ldflags注入（见apiVersion）
+	Timestamp  string                     `json:"timestamp" format:"date-time"` // 响应时间
+	Uptime     string                     `json:"uptime"`                       // 进程已运行的时间
+	Components map[string]ComponentHealth `json:"components,omitempty"`         // 各组件的检查结果，/livez不包含
+}
+
+// healthCheck：一个注册的检查
+type healthCheck struct {
+	name     string
+	critical bool
+	timeout  time.Duration
+	check    func(ctx context.Context) error
+}
+
+// HealthChecker：并发执行健康检查并缓存结果
+type HealthChecker struct {
+	checks []healthCheck // 注册的检查，只在启动时注册，之后只读
+	ttl    time.Duration // 结果的缓存时间
+
+	runMu    sync.Mutex                 // 保证同一时刻只有一轮检查，并发的请求等待并共享这一轮的结果
+	mu       sync.Mutex                 // 保护下面的字段
+	results  map[string]ComponentHealth // 最近一轮的结果
+	expires  time.Time                  // 结果的过期时间
+	draining bool                       // 是否已经开始优雅关闭
+}
+
+// NewHealthChecker：创建健康检查器，结果缓存ttl
+func NewHealthChecker(ttl time.Duration) *HealthChecker {
+	return &HealthChecker{ttl: ttl}
+}
+
+// Register：注册检查函数
+// 参数：critical - 是否为关键组件；timeout - 检查的超时时间，check应当遵守ctx的取消，超时后结果按不可用处理
+func (hc *HealthChecker) Register(name string, critical bool, timeout time.Duration, check func(ctx context.Context) error) {
+	hc.checks = append(hc.checks, healthCheck{name: name, critical: critical, timeout: timeout, check: check})
+}
+
+// SetDraining：标记服务器开始优雅关闭，之后Ready总是返回不就绪
+func (hc *HealthChecker) SetDraining() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.draining = true
+}
+
+// CheckAll：返回全部组件的检查结果，缓存未过期时直接使用缓存
+// 组件的状态发生变化时记录日志，便于事后排查服务何时、因为什么不可用
+func (hc *HealthChecker) CheckAll() map[string]ComponentHealth {
+	hc.runMu.Lock()
+	defer hc.runMu.Unlock()
+
+	hc.mu.Lock()
+	previous := hc.results
+	fresh := time.Now().Before(hc.expires)
+	hc.mu.Unlock()
+	if fresh {
+		return copyComponents(previous)
+	}
+
+	results := make(map[string]ComponentHealth, len(hc.checks))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range hc.checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			result := c.run()
+			resultsMu.Lock()
+			results[c.name] = result
+			resultsMu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	for name, result := range results {
+		before, seen := previous[name]
+		switch {
+		case result.Status == componentDown && (!seen || before.Status != componentDown):
+			logger.Warn("组件不可用", "component", name, "critical", result.Critical, "error", result.Error)
+		case result.Status == componentUp && seen && before.Status == componentDown:
+			logger.Info("组件已恢复", "component", name)
+		}
+	}
+
+	hc.mu.Lock()
+	hc.results = results
+	hc.expires = time.Now().Add(hc.ttl)
+	hc.mu.Unlock()
+	return copyComponents(results)
+}
+
+// Ready：执行检查（或使用缓存）并汇总为就绪报告，第二个返回值表示是否就绪
+func (hc *HealthChecker) Ready() (HealthReport, bool) {
+	report := newHealthReport(healthOK)
+	report.Components = hc.CheckAll()
+	for _, component := range report.Components {
+		if component.Status != componentDown {
+			continue
+		}
+		if component.Critical {
+			report.Status = healthUnavailable
+			break
+		}
+		report.Status = healthDegraded
+	}
+
+	hc.mu.Lock()
+	if hc.draining {
+		report.Status = healthDraining
+	}
+	hc.mu.Unlock()
+	return report, report.Status == healthOK || report.Status == healthDegraded
+}
+
+// run：在超时时间内执行一次检查
+// 检查函数在单独的goroutine中执行：即使它不遵守ctx而一直阻塞，探针也会在超时后返回
+func (c healthCheck) run() ComponentHealth {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1) // 带缓冲：超时后检查函数仍能写入结果并退出，不会永远阻塞
+	go func() {
+		done <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("检查超时（%v）", c.timeout)
+	}
+
+	result := ComponentHealth{
+		Status:    componentUp,
+		Critical:  c.critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: start.Format(time.RFC3339),
+	}
+	if err != nil {
+		result.Status = componentDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// copyComponents：复制检查结果，调用方修改返回的map不会影响缓存
+func copyComponents(results map[string]ComponentHealth) map[string]ComponentHealth {
+	copied := make(map[string]ComponentHealth, len(results))
+	for name, result := range results {
+		copied[name] = result
+	}
+	return copied
+}
+
+// newHealthReport：创建不含组件信息的报告
+func newHealthReport(status string) HealthReport {
+	return HealthReport{
+		Status:    status,
+		Version:   apiVersion,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+}
+
+// probePaths：健康检查探针的路径
+var probePaths = map[string]bool{"/livez": true, "/readyz": true, "/health": true}
+
+// healthChecker：服务器的健康检查器，检查项在main函数中由registerHealthChecks注册
+var healthChecker = NewHealthChecker(healthCacheTTL)
+
+// registerHealthChecks：注册服务器依赖的组件
+// - store（关键）：存储不可用时任何API都无法工作
+// - trash_purge（非关键）：回收站清理失败不影响处理请求，只是过期记录暂时没有删除
+func registerHealthChecks(hc *HealthChecker, s Store) {
+	hc.Register("store", true, time.Second, s.Ping)
+	hc.Register("trash_purge", false, time.Second, func(ctx context.Context) error {
+		return lastPurgeError()
+	})
+}
+
+// writeHealthReport：输出健康报告，探针的结果必须是实时的，禁止任何缓存
+func writeHealthReport(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleLivez：存活探针（GET /livez）
+// 只要进程能处理HTTP请求就返回200，优雅关闭期间也一样：进程正在退出，不需要编排系统再重启它
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, http.StatusOK, newHealthReport(healthOK))
+}
+
+// handleReadyz：就绪探针（GET /readyz）
+// 就绪时返回200（非关键组件不可用时status为degraded），关键组件不可用或正在优雅关闭时返回503
+// 响应总是包含每个组件的检查结果，503时也一样，便于直接看出是哪个组件出了问题
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report, ready := healthChecker.Ready()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthReport(w, status, report)
+}
+
+// 7. 监控指标
+// /metrics以Prometheus文本格式（text/plain; version=0.0.4）输出监控指标，可以直接被Prometheus抓取
+// 只使用标准库实现：计数器、直方图和仪表盘（gauge）都是简单的数值，按文本格式逐行输出即可
+// 指标按路由模式（如/users/{id}）而不是实际路径分组，否则每个ID都会产生一组新的时间序列
+
+// latencyBuckets：请求耗时直方图的桶上界（秒），与Prometheus客户端库的默认值相同
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeLabel：指标的路由维度
+type routeLabel struct {
+	method string // HTTP方法
+	route  string // 路由模式，没有匹配的路由时为"unmatched"
+}
+
+// histogram：累积直方图，counts[i]是耗时不超过latencyBuckets[i]的请求数
+type histogram struct {
+	counts []uint64
+	sum    float64 // 所有请求耗时之和（秒）
+	count  uint64  // 请求总数
+}
+
+// observe：记录一次耗时
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Metrics：HTTP请求指标，所有方法都是并发安全的
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[routeLabel]map[string]uint64 // 路由 -> 状态码类别（2xx、4xx等） -> 请求数
+	latencies map[routeLabel]*histogram        // 路由 -> 耗时直方图
+	inFlight  map[routeLabel]int64             // 路由 -> 正在处理的请求数
+}
+
+// NewMetrics：创建空的指标集合
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[routeLabel]map[string]uint64),
+		latencies: make(map[routeLabel]*histogram),
+		inFlight:  make(map[routeLabel]int64),
+	}
+}
+
+// metrics：全局指标集合
+var metrics = NewMetrics()
+
+// begin：请求开始时调用，正在处理的请求数加一
+func (m *Metrics) begin(label routeLabel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[label]++
+}
+
+// end：请求结束时调用，记录状态码类别和耗时
+func (m *Metrics) end(label routeLabel, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[label]--
+	if m.requests[label] == nil {
+		m.requests[label] = make(map[string]uint64)
+	}
+	m.requests[label][fmt.Sprintf("%dxx", status/100)]++
+	if m.latencies[label] == nil {
+		m.latencies[label] = &histogram{counts: make([]uint64, len(latencyBuckets))}
+	}
+	m.latencies[label].observe(elapsed.Seconds())
+}
+
+// metricsMiddleware：记录每个请求的指标，通过router.Lookup找到请求对应的路由模式
+// 它放在中间件链的最外层，被CORS、认证、限流拒绝的请求同样会被统计
+func metricsMiddleware(m *Metrics, router *Router) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			label := routeLabel{method: r.Method, route: "unmatched"}
+			if route := router.Lookup(r); route != nil {
+				label.route = route.openAPIPath()
+			}
+
+			start := time.Now()
+			m.begin(label)
+			rec := &responseRecorder{ResponseWriter: w}
+			defer func() {
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				m.end(label, status, time.Since(start))
+			}()
+			next(rec, r)
+		}
+	}
+}
+
+// labelEscaper：按Prometheus文本格式转义标签值中的反斜杠、双引号和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedLabels：按方法和路由排序，保证每次输出的顺序一致
+func sortedLabels[V any](m map[routeLabel]V) []routeLabel {
+	labels := make([]routeLabel, 0, len(m))
+	for label := range m {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		return labels[i].method < labels[j].method
+	})
+	return labels
+}
+
+// WritePrometheus：按Prometheus文本格式输出HTTP请求指标
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labelsOf := func(label routeLabel) string {
+		return fmt.Sprintf(`method="%s",route="%s"`, labelEscaper.Replace(label.method), labelEscaper.Replace(label.route))
+	}
+
+	fmt.Fprintln(w, "# HELP http_requests_total 按路由和状态码类别统计的HTTP请求总数")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, label := range sortedLabels(m.requests) {
+		classes := make([]string, 0, len(m.requests[label]))
+		for class := range m.requests[label] {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "http_requests_total{%s,code=\"%s\"} %d\n", labelsOf(label), class, m.requests[label][class])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP请求处理耗时（秒）")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, label := range sortedLabels(m.latencies) {
+		h := m.latencies[label]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labelsOf(label), strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labelsOf(label), h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %g\n", labelsOf(label), h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labelsOf(label), h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP http_requests_in_flight 正在处理的HTTP请求数")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	for _, label := range sortedLabels(m.inFlight) {
+		fmt.Fprintf(w, "http_requests_in_flight{%s} %d\n", labelsOf(label), m.inFlight[label])
+	}
+}
+
+// writeGauge：输出一个不带标签的gauge指标
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+// handleMetrics：处理监控指标请求（GET /metrics）
+// 功能：输出HTTP请求指标、Go运行时指标和业务数据量
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	users, posts, countErr := countRecords(r.Context())
+	if countErr != nil {
+		requestLogger(r).Warn("统计记录数失败", "error", countErr)
+	}
+
+	// runtime.ReadMemStats：读取内存分配器和GC的统计信息
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WritePrometheus(w)
+
+	// Go运行时指标，名称与Prometheus官方Go客户端保持一致
+	fmt.Fprintln(w, "# HELP go_info Go运行时版本信息")
+	fmt.Fprintln(w, "# TYPE go_info gauge")
+	fmt.Fprintf(w, "go_info{version=\"%s\"} 1\n", runtime.Version())
+	writeGauge(w, "go_goroutines", "当前goroutine数量", float64(runtime.NumGoroutine()))
+	writeGauge(w, "go_memstats_alloc_bytes", "已分配且仍在使用的堆内存字节数", float64(mem.HeapAlloc))
+	writeGauge(w, "go_memstats_sys_bytes", "从操作系统获得的内存字节数", float64(mem.Sys))
+	writeGauge(w, "go_memstats_heap_objects", "堆上已分配的对象数", float64(mem.HeapObjects))
+	fmt.Fprintf(w, "# HELP go_gc_cycles_total 已完成的GC次数\n# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total %d\n", mem.NumGC)
+	writeGauge(w, "process_start_time_seconds", "进程启动时间（Unix时间戳，秒）", float64(startTime.Unix()))
+
+	// 业务指标：取代原来/stats接口中的用户数量和帖子数量
+	// 存储暂时无法计数（而且之前从未成功过）时省略这两项，其余指标照常输出：存储出问题时正是最需要看监控的时候
+	if users >= 0 {
+		writeGauge(w, "webserver_users", "用户数量", float64(users))
+		writeGauge(w, "webserver_posts", "帖子数量", float64(posts))
+	}
+}
+
+// metricsCountTimeout：抓取指标时等待存储计数的最长时间
+const metricsCountTimeout = 500 * time.Millisecond
+
+// lastCounts：最近一次成功统计的用户数和帖子数，-1表示还没有成功过
+var lastCounts = struct {
+	sync.Mutex
+	users, posts int
+}{users: -1, posts: -1}
+
+// countRecords：在metricsCountTimeout内从存储统计记录数
+// 超时或出错时返回上一次成功的结果和错误，例如SQLite的唯一连接被批量操作的事务占用时，/metrics不会跟着卡住
+func countRecords(ctx context.Context) (users, posts int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, metricsCountTimeout)
+	defer cancel()
+	users, posts, err = store.Count(ctx)
+
+	lastCounts.Lock()
+	defer lastCounts.Unlock()
+	if err != nil {
+		return lastCounts.users, lastCounts.posts, err
+	}
+	lastCounts.users, lastCounts.posts = users, posts
+	return users, posts, nil
+}
+
+// 8. 路由器
+// 标准库的http.ServeMux只能按路径前缀匹配，ID需要用strings.TrimPrefix手工截取，
+// 同一路径的不同HTTP方法也要在处理器里用switch分发。下面实现一个小型路由器：
+// - 用"方法 路径"声明路由，例如"GET /users/{id:int}"
+// - 路径参数支持类型：{id:int}只匹配整数，{name}匹配任意单段，{path...}匹配剩余的所有段
+// - 参数之后可以跟固定后缀，例如"POST /users/{id:int}:restore"匹配/users/3:restore，id为3（自定义方法风格）
+// - 路径存在但方法不匹配时自动返回405，并通过Allow头告诉客户端支持哪些方法
+// - HEAD请求自动使用对应的GET路由，OPTIONS请求自动返回Allow头
+// - 每条路由可以附加自己的中间件，与withMiddleware使用相同的中间件签名
+
+// Middleware：中间件类型，与loggingMiddleware、corsMiddleware的签名一致
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// routeSegment：路由模式中的一段（以"/"分隔）
+type routeSegment struct {
+	literal  string // 字面量段，如"users"；参数段为空
+	param    string // 参数名，如"id"；字面量段为空
+	kind     string // 参数类型："int"表示整数，""表示任意字符串
+	suffix   string // 参数之后的固定后缀，如{id:int}:restore中的":restore"
+	catchAll bool   // 是否为{name...}形式，匹配剩余的所有段
+}
+
+// Route：一条已注册的路由
+type Route struct {
+	Method   string           // HTTP方法，如"GET"
+	Pattern  string           // 路径模式，如"/users/{id:int}"
+	segments []routeSegment   // 解析后的路径段
+	handler  http.HandlerFunc // 已经套上路由级中间件的处理器
+	name     string           // 处理器函数名，用作OpenAPI的operationId
+	doc      RouteDoc         // 文档信息，用于生成OpenAPI文档
+	cors     *CORSPolicy      // 路由专用的CORS策略，nil表示使用全局默认策略
+}
+
+// CORS：为路由指定专用的CORS策略，返回路由本身以便链式调用
+func (r *Route) CORS(policy *CORSPolicy) *Route {
+	r.cors = policy
+	return r
+}
+
+// Router：路由器，按注册顺序保存所有路由
+type Router struct {
+	routes   []*Route
+	NotFound http.HandlerFunc // 没有任何路由匹配时的处理器，nil表示返回404
+}
+
+// NewRouter：创建空路由器
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle：注册路由
+// 参数：route - "方法 路径"形式的路由声明；handler - 处理器；middlewares - 只作用于这条路由的中间件
+// 中间件按参数顺序从外到内执行：Handle(r, h, a, b)等价于a(b(h))
+func (rt *Router) Handle(route string, handler http.HandlerFunc, middlewares ...Middleware) *Route {
+	method, pattern, ok := strings.Cut(route, " ")
+	if !ok || !strings.HasPrefix(pattern, "/") {
+		// 路由声明错误属于编程错误，启动时直接panic，避免带着错误的路由表运行
+		panic(fmt.Sprintf("无效的路由声明: %q（格式应为\"GET /path\"）", route))
+	}
+
+	name := handlerName(handler) // 在套上中间件之前取名字，否则得到的是中间件内部的闭包
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	r := &Route{Method: method, Pattern: pattern, segments: parsePattern(pattern), handler: handler, name: name}
+	rt.routes = append(rt.routes, r)
+	return r
+}
+
+// parsePattern：把路径模式解析为路由段
+func parsePattern(pattern string) []routeSegment {
+	var segments []routeSegment
+	for _, part := range splitPath(pattern) {
+		end := strings.Index(part, "}")
+		if !strings.HasPrefix(part, "{") || end < 0 {
+			segments = append(segments, routeSegment{literal: part})
+			continue
+		}
+		name := part[1:end]
+		segment := routeSegment{suffix: part[end+1:]}
+		if strings.HasSuffix(name, "...") {
+			segment.catchAll = true
+			name = strings.TrimSuffix(name, "...")
+		}
+		segment.param, segment.kind, _ = strings.Cut(name, ":")
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// splitPath：把"/users/1"拆分为["users", "1"]，根路径"/"得到空切片
+// 末尾的斜杠会被忽略，因此"/users/"与"/users"等价
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match：判断路径是否匹配该路由
+// 返回值：params - 提取出的路径参数；ok - 是否匹配；badParam - 结构匹配但类型不符的参数名
+func (route *Route) match(parts []string) (params map[string]string, ok bool, badParam string) {
+	params = make(map[string]string)
+	for i, segment := range route.segments {
+		if segment.catchAll {
+			params[segment.param] = strings.Join(parts[i:], "/")
+			if len(parts) <= i {
+				return nil, false, ""
+			}
+			return params, badParam == "", badParam
+		}
+		if i >= len(parts) {
+			return nil, false, ""
+		}
+		if segment.param == "" {
+			if segment.literal != parts[i] {
+				return nil, false, ""
+			}
+			continue
+		}
+		value := parts[i]
+		if segment.suffix != "" {
+			// 后缀不同说明是另一条路由（例如/users/3与/users/3:restore），不算参数类型错误
+			if !strings.HasSuffix(value, segment.suffix) {
+				return nil, false, ""
+			}
+			value = strings.TrimSuffix(value, segment.suffix)
+		}
+		if segment.kind == "int" {
+			if _, err := strconv.Atoi(value); err != nil && badParam == "" {
+				badParam = segment.param
+			}
+		}
+		params[segment.param] = value
+	}
+	if len(parts) != len(route.segments) {
+		return nil, false, ""
+	}
+	return params, badParam == "", badParam
+}
+
+// resolve：在路由表中查找与请求匹配的路由
+// 返回值：matched - 路径和方法都匹配的路由；params - 路径参数；allowed - 路径匹配的路由支持的方法；badParam - 类型不符的路径参数
+func (rt *Router) resolve(r *http.Request) (matched *Route, matchedParams map[string]string, allowed []string, badParam string) {
+	parts := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		params, ok, bad := route.match(parts)
+		if !ok {
+			if bad != "" && badParam == "" {
+				badParam = bad
+			}
+			continue
+		}
+		allowed = append(allowed, route.Method)
+		// HEAD请求可以由GET路由处理，net/http会自动丢弃HEAD响应的响应体
+		if matched == nil && (route.Method == r.Method || (r.Method == http.MethodHead && route.Method == http.MethodGet)) {
+			matched, matchedParams = route, params
+		}
+	}
+	return matched, matchedParams, allowed, badParam
+}
+
+// Lookup：返回与请求匹配的路由，没有匹配时返回nil
+// 供路由器之外的中间件使用，例如按路由限流
+func (rt *Router) Lookup(r *http.Request) *Route {
+	matched, _, _, _ := rt.resolve(r)
+	return matched
+}
+
+// ServeHTTP：实现http.Handler接口，按路由表分发请求
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	matched, matchedParams, allowed, badParam := rt.resolve(r)
+	switch {
+	case matched != nil:
+		ctx := context.WithValue(r.Context(), pathParamsKey{}, matchedParams)
+		matched.handler(w, r.WithContext(ctx))
+	case len(allowed) > 0:
+		w.Header().Set("Allow", allowHeader(allowed))
+		if r.Method == http.MethodOptions {
+			// OPTIONS请求：返回该路径支持的方法
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeProblem(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s 不支持 %s 方法", r.URL.Path, r.Method))
+	case badParam != "":
+		// 路径结构与某条路由一致，但参数类型不符，例如/users/abc
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("路径参数 %s 必须是整数", badParam))
+	case rt.NotFound != nil:
+		rt.NotFound(w, r)
+	default:
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("路径 %s 不存在", r.URL.Path))
+	}
+}
+
+// allowHeader：生成Allow头，GET隐含HEAD，并且总是支持OPTIONS
+func allowHeader(methods []string) string {
+	set := map[string]bool{http.MethodOptions: true}
+	for _, method := range methods {
+		set[method] = true
+		if method == http.MethodGet {
+			set[http.MethodHead] = true
+		}
+	}
+	list := make([]string, 0, len(set))
+	for method := range set {
+		list = append(list, method)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// pathParamsKey：在请求上下文中保存路径参数的键
+// 使用未导出的空结构体类型作为键，避免与其他包放入context的值冲突
+type pathParamsKey struct{}
+
+// pathParam：读取字符串类型的路径参数
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// pathInt：读取整数类型的路径参数
+// 路由器已经保证{name:int}参数是合法整数，因此这里不需要再处理转换错误
+func pathInt(r *http.Request, name string) int {
+	value, _ := strconv.Atoi(pathParam(r, name))
+	return value
+}
+
+// 8.1 OpenAPI文档
+// 路由表本身就是API最准确的描述：每条路由在注册时可以附加摘要、查询参数、请求体和响应体等文档信息，
+// generateOpenAPI遍历路由表，再通过反射读取User、Post等结构体的json标签生成数据模型，得到OpenAPI 3.1文档
+// 主页和/openapi.json都从这份文档生成，新增或修改路由时文档自动同步，不会再与代码不一致
+
+// apiVersion：API版本号，出现在OpenAPI文档和健康检查响应中
+// 这里是变量而不是常量，发布时可以在链接阶段注入真实版本，源码中的值只是本地开发时的默认值：
+// go build -ldflags "-X main.apiVersion=1.2.0" 10-web-server.go
+var apiVersion = "1.0.0"
+
+// QueryParam：路由支持的查询参数
+type QueryParam struct {
+	Name        string   // 参数名，如"limit"
+	Type        string   // JSON Schema类型：string、integer等
+	Description string   // 参数说明
+	Enum        []string // 可选值列表，为空表示不限制
+}
+
+// expandQuery：帖子接口共用的expand参数，取值author时在每个帖子中附上作者详情
+var expandQuery = QueryParam{Name: "expand", Type: "string", Description: "展开关联数据", Enum: []string{"author"}}
+
+// includeQuery：/users和/posts共用的include参数，取值deleted时同时列出回收站中的记录（需要trash:admin权限）
+var includeQuery = QueryParam{Name: "include", Type: "string", Description: "deleted表示同时列出回收站中的记录，需要trash:admin权限", Enum: []string{"deleted"}}
+
+// mediaType：表示非JSON的响应内容类型，例如Returns(http.StatusOK, mediaType("text/html"))
+type mediaType string
+
+// RouteDoc：路由的文档信息
+type RouteDoc struct {
+	Summary    string       // 一句话说明
+	Query      []QueryParam // 查询参数
+	Request    interface{}  // 请求体的示例值（零值即可，只用于反射类型），nil表示没有请求体
+	Status     int          // 成功响应的状态码
+	Response   interface{}  // 成功响应体的示例值，nil表示没有响应体
+	Scopes     []string     // 调用所需的权限范围，为空表示允许匿名访问
+	ETag       bool         // 是否支持ETag条件请求：GET支持If-None-Match，写操作要求If-Match
+	Idempotent bool         // 是否支持Idempotency-Key请求头
+}
+
+// Doc：设置路由的摘要，返回路由本身以便链式调用
+func (r *Route) Doc(summary string) *Route {
+	r.doc.Summary = summary
+	return r
+}
+
+// Query：声明路由支持的查询参数
+func (r *Route) Query(params ...QueryParam) *Route {
+	r.doc.Query = append(r.doc.Query, params...)
+	return r
+}
+
+// Accepts：声明请求体的类型
+func (r *Route) Accepts(body interface{}) *Route {
+	r.doc.Request = body
+	return r
+}
+
+// Returns：声明成功响应的状态码和响应体类型
+func (r *Route) Returns(status int, body interface{}) *Route {
+	r.doc.Status, r.doc.Response = status, body
+	return r
+}
+
+// Secured：要求调用方拥有全部指定的权限范围
+// 权限检查（requireScopes）和文档中的security声明来自同一处，两者不会不一致
+func (r *Route) Secured(scopes ...string) *Route {
+	r.handler = requireScopes(scopes...)(r.handler)
+	r.doc.Scopes = append(r.doc.Scopes, scopes...)
+	return r
+}
+
+// Idempotent：为路由加上requireIdempotency中间件
+// 应在Secured之前调用：后调用的中间件包在外层先执行，这样没有权限的请求在权限检查时就被拒绝，不会占用幂等键
+func (r *Route) Idempotent() *Route {
+	r.handler = requireIdempotency(r.handler)
+	r.doc.Idempotent = true
+	return r
+}
+
+// Conditional：声明路由支持ETag条件请求
+func (r *Route) Conditional() *Route {
+	r.doc.ETag = true
+	return r
+}
+
+// listQuery：列表接口通用的分页和排序参数，sort的可选值来自排序键表
+func listQuery[T any](sortKeys map[string]func(T) sortValue) []QueryParam {
+	keys := make([]string, 0, len(sortKeys)*2)
+	for key := range sortKeys {
+		keys = append(keys, key, "-"+key)
+	}
+	sort.Strings(keys)
+	return []QueryParam{
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("每页条数，1到%d，默认%d", maxPageLimit, defaultPageLimit)},
+		{Name: "cursor", Type: "string", Description: "上一页响应Link头中的游标"},
+		{Name: "sort", Type: "string", Description: "排序字段，前缀\"-\"表示降序", Enum: keys},
+	}
+}
+
+// OpenAPI文档的数据结构，只包含本服务用到的部分
+type OpenAPIDoc struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"` // 路径 -> 小写方法名 -> 操作
+	Components OpenAPIComponents                `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`             // http或apiKey
+	Scheme string `json:"scheme,omitempty"` // type为http时的认证方案，如bearer
+	In     string `json:"in,omitempty"`     // type为apiKey时密钥所在位置
+	Name   string `json:"name,omitempty"`   // type为apiKey时的请求头名称
+}
+
+// Operation：一个"方法 + 路径"对应的操作
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path或query
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema：JSON Schema（OpenAPI 3.1直接使用JSON Schema 2020-12）
+type Schema struct {
+	Ref        string             `json:"$ref,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Enum       []string           `json:"enum,omitempty"`
+	MaxLength  int                `json:"maxLength,omitempty"`
+	ReadOnly   bool               `json:"readOnly,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+}
+
+// readOnlyFields：由服务器维护、客户端不能修改的字段，与JSON Merge Patch中的不可变字段是同一份列表
+var readOnlyFields = map[reflect.Type][]string{
+	reflect.TypeOf(User{}): userImmutableFields,
+	reflect.TypeOf(Post{}): postImmutableFields,
+}
+
+// schemaGenerator：通过反射为Go类型生成Schema，具名结构体放入components并以$ref引用
+type schemaGenerator struct {
+	components map[string]*Schema
+}
+
+// schemaFor：返回类型t对应的Schema
+func (g *schemaGenerator) schemaFor(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(json.RawMessage(nil)) {
+		return &Schema{} // json.RawMessage是原样输出的任意JSON，不是字节数组
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t) // 匿名结构体直接内联
+		}
+		if _, exists := g.components[t.Name()]; !exists {
+			g.components[t.Name()] = nil // 先占位，防止自引用的类型无限递归
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	default:
+		return &Schema{} // interface{}等无法确定类型的值，接受任意JSON
+	}
+}
+
+// structSchema：按encoding/json的规则读取导出字段和json标签，生成对象Schema
+// 没有omitempty的字段在响应中总会出现，因此列为required；额外的format标签（如email、date-time）写入Schema
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	readOnly := make(map[string]bool)
+	for _, name := range readOnlyFields[t] {
+		readOnly[name] = true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		// 匿名嵌入且没有json标签的结构体，字段会被提升到外层（与encoding/json一致）
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			embedded := g.structSchema(field.Type)
+			for name, property := range embedded.Properties {
+				schema.Properties[name] = property
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		property := g.schemaFor(field.Type)
+		if format := field.Tag.Get("format"); format != "" {
+			property.Format = format
+		}
+		if readOnly[name] {
+			property.ReadOnly = true
+		}
+		schema.Properties[name] = property
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// handlerName：返回处理器函数名，作为operationId使用
+// 例如main.getUsers返回"getUsers"，闭包main.serveOpenAPI.func1返回"serveOpenAPI"
+func handlerName(handler http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	_, name, _ = strings.Cut(name, ".")
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+// openAPIPath：把路由模式转换为OpenAPI路径模板，例如/users/{id:int}转换为/users/{id}
+func (r *Route) openAPIPath() string {
+	var b strings.Builder
+	for _, segment := range r.segments {
+		b.WriteString("/")
+		if segment.param == "" {
+			b.WriteString(segment.literal)
+		} else {
+			b.WriteString("{" + segment.param + "}" + segment.suffix)
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// content：生成请求体或响应体的content字段
+// mediaType直接作为内容类型；其他值按JSON处理，extra是额外接受的JSON兼容类型（如merge-patch+json）
+func (g *schemaGenerator) content(body interface{}, extra ...string) map[string]*MediaType {
+	if media, ok := body.(mediaType); ok {
+		return map[string]*MediaType{string(media): {Schema: &Schema{Type: "string"}}}
+	}
+	schema := g.schemaFor(reflect.TypeOf(body))
+	content := map[string]*MediaType{"application/json": {Schema: schema}}
+	for _, media := range extra {
+		content[media] = &MediaType{Schema: schema}
+	}
+	return content
+}
+
+// generateOpenAPI：根据路由表生成OpenAPI文档
+func generateOpenAPI(router *Router) *OpenAPIDoc {
+	g := &schemaGenerator{components: make(map[string]*Schema)}
+	doc := &OpenAPIDoc{
+		OpenAPI: "3.1.0",
+		Info: OpenAPIInfo{
+			Title:       "Go Web服务器示例",
+			Version:     apiVersion,
+			Description: "读操作允许匿名访问；写操作需要通过Authorization: Bearer或X-API-Key请求头携带API密钥。错误响应统一使用RFC 7807 problem+json格式。",
+		},
+		Paths: make(map[string]map[string]*Operation),
+		Components: OpenAPIComponents{
+			Schemas: g.components,
+			SecuritySchemes: map[string]*SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+				"apiKeyAuth": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+			},
+		},
+	}
+	problem := map[string]*MediaType{"application/problem+json": {Schema: g.schemaFor(reflect.TypeOf(Problem{}))}}
+
+	for _, route := range router.routes {
+		op := &Operation{
+			OperationID: route.name,
+			Summary:     route.doc.Summary,
+			Responses:   make(map[string]*Response),
+		}
+		if segments := route.segments; len(segments) > 0 && segments[0].literal != "" {
+			op.Tags = []string{segments[0].literal} // 按第一段路径分组，如users、posts
+		}
+
+		for _, segment := range route.segments {
+			if segment.param == "" {
+				continue
+			}
+			schema := &Schema{Type: "string"}
+			if segment.kind == "int" {
+				schema.Type = "integer"
+			}
+			op.Parameters = append(op.Parameters, Parameter{Name: segment.param, In: "path", Required: true, Schema: schema})
+		}
+		for _, q := range route.doc.Query {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: q.Name, In: "query", Description: q.Description,
+				Schema: &Schema{Type: q.Type, Enum: q.Enum},
+			})
+		}
+
+		if route.doc.ETag {
+			if route.Method == http.MethodGet {
+				op.Parameters = append(op.Parameters, Parameter{Name: "If-None-Match", In: "header", Description: "之前响应中的ETag，资源未变化时返回304", Schema: &Schema{Type: "string"}})
+				op.Responses["304"] = &Response{Description: "资源未变化"}
+			} else {
+				op.Parameters = append(op.Parameters, Parameter{Name: "If-Match", In: "header", Required: true, Description: "GET响应中的ETag", Schema: &Schema{Type: "string"}})
+				op.Responses["412"] = &Response{Description: "资源已被修改，ETag不是最新版本", Content: problem}
+				op.Responses["428"] = &Response{Description: "缺少If-Match请求头", Content: problem}
+			}
+		}
+
+		if route.doc.Idempotent {
+			op.Parameters = append(op.Parameters, Parameter{Name: idempotencyHeader, In: "header", Description: "客户端生成的唯一键，重试时携带相同的键，服务器重放第一次的响应而不会重复创建", Schema: &Schema{Type: "string", MaxLength: maxIdempotencyKeyLen}})
+			op.Responses["409"] = &Response{Description: "使用相同Idempotency-Key的请求正在处理", Content: problem}
+		}
+
+		if route.doc.Request != nil {
+			var extra []string
+			if route.Method == http.MethodPatch {
+				extra = append(extra, "application/merge-patch+json")
+			}
+			op.RequestBody = &RequestBody{Required: true, Content: g.content(route.doc.Request, extra...)}
+		}
+
+		status := route.doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := &Response{Description: http.StatusText(status)}
+		if route.doc.Response != nil {
+			success.Content = g.content(route.doc.Response)
+		}
+		op.Responses[strconv.Itoa(status)] = success
+		op.Responses["default"] = &Response{Description: "错误（problem+json）", Content: problem}
+
+		if len(route.doc.Scopes) > 0 {
+			op.Security = []map[string][]string{
+				{"bearerAuth": route.doc.Scopes},
+				{"apiKeyAuth": route.doc.Scopes},
+			}
+			op.Responses["401"] = &Response{Description: "缺少或无效的API密钥", Content: problem}
+			op.Responses["403"] = &Response{Description: "API密钥缺少所需的权限范围", Content: problem}
+		}
+
+		path := route.openAPIPath()
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*Operation)
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = op
+	}
+	return doc
+}
+
+// serveOpenAPI：返回OpenAPI文档的处理器（GET /openapi.json）
+// 文档在第一次请求时生成：此时所有路由都已注册完毕
+func serveOpenAPI(router *Router) http.HandlerFunc {
+	var once sync.Once
+	var body []byte
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			body, _ = json.MarshalIndent(generateOpenAPI(router), "", "  ")
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// 9. 初始化数据
+// initData：服务器启动时初始化示例数据
+// 功能：添加一些默认用户和帖子，方便测试API功能
+// 注意：使用SQLite存储时数据会跨重启保留，因此只在存储为空时写入示例数据，避免重复插入
+func initData() error {
+	existing, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil // 存储中已有数据（例如上次运行写入的SQLite文件），跳过初始化
+	}
+
+	// 添加示例用户，ID由存储分配（空存储中依次为1、2）
+	seedUsers := []User{
+		{Name: "张三", Email: "zhangsan@example.com", Age: 25},
+		{Name: "李四", Email: "lisi@example.com", Age: 30},
+	}
+	for i := range seedUsers {
+		seedUsers[i].Created = time.Now().Format(time.RFC3339)
+		if err := store.CreateUser(&seedUsers[i]); err != nil {
+			return err
+		}
+	}
+
+	// 添加示例帖子
+	seedPosts := []Post{
+		{Title: "Go语言入门", Content: "Go语言是一门现代化的编程语言，具有并发支持...", AuthorID: seedUsers[0].ID},
+		{Title: "Web开发基础", Content: "使用Go语言构建Web应用非常简单...", AuthorID: seedUsers[1].ID},
+	}
+	for i := range seedPosts {
+		seedPosts[i].Date = time.Now().Format(time.RFC3339)
+		if err := store.CreatePost(&seedPosts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 全局变量
+var startTime = time.Now() // 记录服务器启动时间，作为process_start_time_seconds指标输出
+
+// 10. 静态文件服务
+// 原先的handleStatic把r.URL.Path直接交给http.ServeFile：能否找到文件取决于启动时的工作目录，也没有任何缓存控制
+// 现在主页模板和/static/下的资源在编译时通过embed打包进程序，启动时一次性加载到内存：
+// - 内容哈希：每个文件额外以"style.1a2b3c4d.css"的形式提供，文件名中带有内容的SHA-256前缀，
+//   内容变化则URL变化，因此可以让浏览器缓存一年（immutable）；主页通过{{asset "style.css"}}引用带哈希的URL
+// - 不带哈希的原始URL使用no-cache，浏览器每次用ETag或Last-Modified向服务器确认，未变化时得到304
+// - 预压缩：文本文件在加载时压缩一次，客户端支持gzip时直接返回压缩后的内容，不必每个请求都压缩
+// - 路径安全：请求路径只用来在内存中的文件表里查找，从不拼接成磁盘路径，因此"../"等路径穿越不可能读到其他文件
+//   （10-web-server_test.go用各种穿越写法实际请求服务器验证这一点）
+// - SPA模式：开启后，未匹配任何路由的页面请求返回主页，由前端路由处理（见spaFallback）
+
+// webFiles：编译时打包的web目录，包括主页模板web/index.html和静态资源web/static/
+//
+//go:embed web
+var webFiles embed.FS
+
+// staticAsset：加载到内存中的一个静态文件
+type staticAsset struct {
+	hashedName  string // 带内容哈希的文件名，如"style.1a2b3c4d.css"
+	contentType string // 根据扩展名确定的Content-Type
+	data        []byte // 原始内容
+	gzipped     []byte // gzip压缩后的内容，压缩效果不明显的文件为nil
+	hash        string // 内容哈希，用作ETag
+}
+
+// AssetServer：静态资源表
+type AssetServer struct {
+	byName  map[string]*staticAsset // 原始文件名（相对于web/static） -> 资源
+	byHash  map[string]*staticAsset // 带哈希的文件名 -> 资源
+	modTime time.Time               // 所有资源的Last-Modified时间
+}
+
+// assets：全局的静态资源表，程序启动时从webFiles加载
+var assets = mustLoadAssets(webFiles, "web/static")
+
+// compressibleTypes：值得压缩的内容类型前缀，图片等已压缩格式再压缩没有收益
+var compressibleTypes = []string{"text/", "application/javascript", "application/json", "image/svg+xml"}
+
+// mustLoadAssets：遍历fsys中root目录下的所有文件，计算哈希并预压缩
+// 打包的文件在编译时就已确定，加载失败属于编程错误，因此直接panic
+func mustLoadAssets(fsys fs.FS, root string) *AssetServer {
+	server := &AssetServer{
+		byName:  make(map[string]*staticAsset),
+		byHash:  make(map[string]*staticAsset),
+		modTime: assetModTime(),
+	}
+	err := fs.WalkDir(fsys, root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(file, root+"/")
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:4])
+		ext := path.Ext(name)
+		asset := &staticAsset{
+			hashedName:  strings.TrimSuffix(name, ext) + "." + hash + ext,
+			contentType: mime.TypeByExtension(ext),
+			data:        data,
+			hash:        hash,
+		}
+		if asset.contentType == "" {
+			asset.contentType = "application/octet-stream"
+		}
+		for _, prefix := range compressibleTypes {
+			if strings.HasPrefix(asset.contentType, prefix) {
+				asset.gzipped = gzipIfSmaller(data)
+				break
+			}
+		}
+		server.byName[name] = asset
+		server.byHash[asset.hashedName] = asset
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("加载静态资源失败: %v", err))
+	}
+	return server
+}
+
+// gzipIfSmaller：压缩数据，压缩后没有明显变小（不足原大小的90%）时返回nil
+func gzipIfSmaller(data []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression) // 级别是合法常量，不会出错
+	zw.Write(data)
+	zw.Close()
+	if buf.Len() >= len(data)*9/10 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// assetModTime：静态资源的Last-Modified时间
+// embed打包的文件没有修改时间，这里取可执行文件的修改时间（即编译时间），资源只会随重新编译而变化
+func assetModTime() time.Time {
+	if exe, err := os.Executable(); err == nil {
+		if info, err := os.Stat(exe); err == nil {
+			return info.ModTime().Truncate(time.Second) // HTTP日期只精确到秒
+		}
+	}
+	return time.Now().Truncate(time.Second)
+}
+
+// URL：返回资源带内容哈希的URL，供主页模板中的{{asset "style.css"}}使用
+// 资源不存在时返回错误，模板渲染随之失败，拼错的文件名在开发时就能发现
+func (s *AssetServer) URL(name string) (string, error) {
+	asset, ok := s.byName[name]
+	if !ok {
+		return "", fmt.Errorf("静态资源不存在: %s", name)
+	}
+	return "/static/" + asset.hashedName, nil
+}
+
+// acceptsGzip：判断客户端是否接受gzip编码（Accept-Encoding中出现gzip且q值不为0）
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64) // 无法解析的q值按0处理
+		}
+		return q > 0
+	}
+	return false
+}
+
+// handleStatic：处理静态文件请求（GET /static/{path...}）
+// 功能：从内存中的资源表返回文件，带哈希的URL长期缓存，原始URL每次校验
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "path")
+
+	// 只在两张内存表中查找：表中的键都来自embed打包时的文件列表，
+	// 任何包含".."、反斜杠、编码字符的路径都不会与之相等
+	asset, immutable := assets.byHash[name], true
+	if asset == nil {
+		asset, immutable = assets.byName[name], false
+	}
+	if asset == nil {
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("静态文件 %s 不存在", name))
+		return
+	}
+
+	header := w.Header()
+	if immutable {
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+	header.Set("Content-Type", asset.contentType) // 显式设置，避免ServeContent按压缩后的内容猜测类型
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	data, etag := asset.data, `"`+asset.hash+`"`
+	if asset.gzipped != nil {
+		header.Set("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			// 同一资源的不同编码是不同的表示，强ETag必须不同
+			data, etag = asset.gzipped, `"`+asset.hash+`-gz"`
+			header.Set("Content-Encoding", "gzip")
+		}
+	}
+	header.Set("ETag", etag)
+
+	// http.ServeContent处理If-None-Match、If-Modified-Since（返回304）、Range和HEAD请求
+	http.ServeContent(w, r, name, assets.modTime, bytes.NewReader(data))
+}
+
+// spaFallback：SPA（单页应用）模式下未匹配任何路由时的处理器
+// 前端路由的页面（如/dashboard/users）在服务器上没有对应的路由，浏览器直接访问或刷新时应返回主页，由前端脚本渲染
+// 只有浏览器的页面请求（GET/HEAD、Accept包含text/html、最后一段没有扩展名）才返回主页；
+// API客户端、拼错的静态文件和/static/下的路径仍然得到404，避免把HTML当成脚本或JSON返回
+func spaFallback(home http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isPage := (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+			strings.Contains(r.Header.Get("Accept"), "text/html") &&
+			!strings.HasPrefix(r.URL.Path, "/static/") &&
+			path.Ext(r.URL.Path) == ""
+		if !isPage {
+			writeProblem(w, http.StatusNotFound, fmt.Sprintf("路径 %s 不存在", r.URL.Path))
+			return
+		}
+		home(w, r)
+	}
+}
+
+// 11. 主页服务
+// homeEndpoint：主页中展示的一个API端点
+type homeEndpoint struct {
+	Method  string
+	Path    string
+	Summary string
+	Scopes  []string
+}
+
+// homeTemplate：主页模板，来自打包的web/index.html
+// html/template会对插入的内容自动做HTML转义，比手工拼接字符串安全
+// asset函数把静态资源名转换为带内容哈希的URL
+var homeTemplate = template.Must(template.New("index.html").
+	Funcs(template.FuncMap{"asset": assets.URL}).
+	ParseFS(webFiles, "web/index.html"))
+
+// homeMethodOrder：主页中同一路径下各方法的展示顺序
+var homeMethodOrder = []string{"get", "post", "put", "patch", "delete"}
+
+// serveHomePage：返回主页处理器（GET /）
+// 功能：从OpenAPI文档生成API端点列表和使用示例，方便用户了解如何使用API
+func serveHomePage(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc := generateOpenAPI(router)
+
+		paths := make([]string, 0, len(doc.Paths))
+		for path := range doc.Paths {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		var endpoints []homeEndpoint
+		for _, path := range paths {
+			for _, method := range homeMethodOrder {
+				if op, ok := doc.Paths[path][method]; ok {
+					var scopes []string
+					if len(op.Security) > 0 {
+						scopes = op.Security[0]["bearerAuth"]
+					}
+					endpoints = append(endpoints, homeEndpoint{strings.ToUpper(method), path, op.Summary, scopes})
+				}
+			}
+		}
+
+		// 设置响应头Content-Type为text/html，告诉客户端返回的是HTML内容
+		// 主页内容随路由表变化，并且引用的静态资源URL带有哈希，不能长期缓存
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		data := struct {
+			Title     string
+			Version   string
+			Endpoints []homeEndpoint
+		}{doc.Info.Title, doc.Info.Version, endpoints}
+		if err := homeTemplate.Execute(w, data); err != nil {
+			requestLogger(r).Error("渲染主页失败", "error", err)
+		}
+	}
+}
+
+// 12. 中间件链
+// withMiddleware：组合多个中间件，形成中间件链
+// 功能：将日志中间件和认证中间件组合，应用到处理器上
+// 注意：中间件的顺序很重要，这里依次执行loggingMiddleware、extra、authMiddleware
+// 认证放在日志之后：认证失败的请求也会被记录日志
+// extra：附加在日志和认证之间的中间件（例如限流）。限流必须在认证之前：
+// 否则携带错误密钥的请求在认证阶段就返回401，根本不消耗额度，猜测密钥的请求不受任何限制
+// 需要查询路由表的中间件（CORS、指标）在newRouter中套在最外层
+func withMiddleware(next http.HandlerFunc, extra ...Middleware) http.HandlerFunc {
+	next = authMiddleware(next)
+	for i := len(extra) - 1; i >= 0; i-- {
+		next = extra[i](next)
+	}
+	return loggingMiddleware(next)
+}
+
+// rateLimitOptions：限流配置，Limit为0表示不限流
+type rateLimitOptions struct {
+	Limit          int           // 每个键在窗口内允许的请求数
+	Window         time.Duration // 窗口长度
+	Key            string        // 限流键类型：ip、apikey、route
+	TrustedProxies []*net.IPNet  // 受信任的反向代理，只有它们转发的X-Forwarded-For才会被采信
+}
+
+// newRouter：创建路由器、声明所有路由，并套上全局中间件链
+// 路由注册单独放在函数中，这样main函数和测试（10-web-server_test.go）可以共用同一套路由
+// 全局中间件包在路由器外层，因此404、405响应同样会经过CORS和日志中间件
+// 参数：limits - 限流配置；cors - 默认CORS策略，nil表示不处理跨域请求；spa - 是否开启SPA回退（见spaFallback）
+func newRouter(limits rateLimitOptions, cors *CORSPolicy, spa bool) (http.Handler, error) {
+	router := NewRouter()
+	home := serveHomePage(router)
+	if spa {
+		router.NotFound = spaFallback(home)
+	}
+
+	// router.Handle：将"方法 路径"与处理器函数关联，返回的*Route可以链式补充文档信息
+	// 读操作允许匿名访问；写操作通过Secured声明所需的权限范围，同时用于权限检查和OpenAPI文档
+	router.Handle("GET /", home).Doc("API主页").Returns(http.StatusOK, mediaType("text/html"))
+	// API文档是公开信息，任何网站（例如在线的Swagger UI）都可以跨域读取
+	router.Handle("GET /openapi.json", serveOpenAPI(router)).Doc("OpenAPI 3.1文档").Returns(http.StatusOK, map[string]interface{}{}).
+		CORS(&CORSPolicy{AllowedOrigins: []string{"*"}, MaxAge: 24 * time.Hour})
+	router.Handle("GET /static/{path...}", handleStatic).Doc("静态文件").Returns(http.StatusOK, mediaType("application/octet-stream"))
+	// 探针不需要认证，也不受限流（见rateLimitMiddleware）
+	router.Handle("GET /livez", handleLivez).Doc("存活探针：进程是否在运行").Returns(http.StatusOK, HealthReport{})
+	router.Handle("GET /readyz", handleReadyz).Doc("就绪探针：返回各组件的检查结果，不就绪时状态码为503").
+		Returns(http.StatusOK, HealthReport{})
+	router.Handle("GET /health", handleReadyz).Doc("健康检查（与/readyz相同，保留给已有的监控配置）").
+		Returns(http.StatusOK, HealthReport{})
+	router.Handle("GET /events", handleEvents).Doc("订阅用户和帖子的变更事件（Server-Sent Events）").
+		Returns(http.StatusOK, mediaType("text/event-stream"))
+	// 监控指标只给Prometheus等服务端程序抓取，不允许任何网页跨域读取
+	router.Handle("GET /metrics", handleMetrics).Doc("Prometheus监控指标").Returns(http.StatusOK, mediaType("text/plain")).
+		CORS(sameOriginOnly)
+
+	router.Handle("GET /users", getUsers).Doc("获取用户列表").Conditional().
+		Query(listQuery(userSortKeys)...).
+		Query(
+			QueryParam{Name: "age_min", Type: "integer", Description: "最小年龄（含）"},
+			QueryParam{Name: "age_max", Type: "integer", Description: "最大年龄（含）"},
+			QueryParam{Name: "email", Type: "string", Description: "邮箱域名，如example.com"},
+			includeQuery,
+		).
+		Returns(http.StatusOK, []User{})
+	router.Handle("POST /users", createUser).Doc("创建新用户").Idempotent().Secured(scopeUsersWrite).
+		Accepts(User{}).Returns(http.StatusCreated, User{})
+	router.Handle("GET /users/{id:int}", getUser).Doc("获取单个用户").Conditional().Returns(http.StatusOK, User{})
+	router.Handle("PUT /users/{id:int}", updateUser).Doc("替换用户").Conditional().Secured(scopeUsersWrite).
+		Accepts(User{}).Returns(http.StatusOK, User{})
+	router.Handle("PATCH /users/{id:int}", patchUser).Doc("部分更新用户（JSON Merge Patch）").Conditional().Secured(scopeUsersWrite).
+		Accepts(User{}).Returns(http.StatusOK, User{})
+	router.Handle("DELETE /users/{id:int}", deleteUser).Doc("删除用户").Conditional().Secured(scopeUsersWrite).
+		Query(
+			QueryParam{Name: "posts", Type: "string", Description: "名下帖子的处理方式，默认使用服务器配置", Enum: []string{deleteReject, deleteCascade, deleteReassign}},
+			QueryParam{Name: "reassign_to", Type: "integer", Description: "posts=reassign时接收帖子的用户ID"},
+		).
+		Returns(http.StatusNoContent, nil)
+	router.Handle("POST /users/{id:int}:restore", restoreUser).Doc("从回收站恢复用户（连同随它一起删除的帖子）").Secured(scopeTrashAdmin).
+		Returns(http.StatusOK, User{})
+	router.Handle("GET /users/{id:int}/posts", getUserPosts).Doc("获取用户的帖子列表").Conditional().
+		Query(listQuery(postSortKeys)...).
+		Query(expandQuery).
+		Returns(http.StatusOK, []PostWithAuthor{})
+	router.Handle("POST /users:import", importUsers).Doc("批量导入用户（CSV或NDJSON，任何一行校验失败则不导入）").Idempotent().Secured(scopeUsersWrite).
+		Accepts(mediaType("text/csv")).Returns(http.StatusCreated, ImportResult{})
+	router.Handle("GET /users:export", exportUsers).Doc("流式导出全部用户").
+		Query(QueryParam{Name: "format", Type: "string", Description: "导出格式，默认csv", Enum: []string{"csv", "ndjson"}}).
+		Returns(http.StatusOK, mediaType("text/csv"))
+
+	router.Handle("GET /posts", getPosts).Doc("获取帖子列表").Conditional().
+		Query(listQuery(postSortKeys)...).
+		Query(
+			QueryParam{Name: "author_id", Type: "integer", Description: "按作者的用户ID筛选"},
+			expandQuery,
+			includeQuery,
+		).
+		Returns(http.StatusOK, []PostWithAuthor{})
+	router.Handle("GET /posts/search", searchPosts).Doc("全文搜索帖子（按BM25相关度排序）").Conditional().
+		Query(
+			QueryParam{Name: "q", Type: "string", Description: "搜索关键词，支持中英文混合"},
+			QueryParam{Name: "limit", Type: "integer", Description: fmt.Sprintf("返回的结果数，1到%d，默认%d", maxPageLimit, defaultSearchLimit)},
+		).
+		Returns(http.StatusOK, []SearchHit{})
+	router.Handle("POST /posts", createPost).Doc("创建新帖子").Idempotent().Secured(scopePostsWrite).
+		Accepts(Post{}).Returns(http.StatusCreated, Post{})
+	router.Handle("POST /posts:import", importPosts).Doc("批量导入帖子（CSV或NDJSON，任何一行校验失败则不导入）").Idempotent().Secured(scopePostsWrite).
+		Accepts(mediaType("text/csv")).Returns(http.StatusCreated, ImportResult{})
+	router.Handle("GET /posts/{id:int}", getPost).Doc("获取单个帖子").Conditional().
+		Query(expandQuery).
+		Returns(http.StatusOK, PostWithAuthor{})
+	router.Handle("PUT /posts/{id:int}", updatePost).Doc("替换帖子").Conditional().Secured(scopePostsWrite).
+		Accepts(Post{}).Returns(http.StatusOK, Post{})
+	router.Handle("PATCH /posts/{id:int}", patchPost).Doc("部分更新帖子（JSON Merge Patch）").Conditional().Secured(scopePostsWrite).
+		Accepts(Post{}).Returns(http.StatusOK, Post{})
+	router.Handle("DELETE /posts/{id:int}", deletePost).Doc("删除帖子").Conditional().Secured(scopePostsWrite).
+		Returns(http.StatusNoContent, nil)
+	router.Handle("POST /posts/{id:int}:restore", restorePost).Doc("从回收站恢复帖子").Secured(scopeTrashAdmin).
+		Returns(http.StatusOK, Post{})
+	router.Handle("GET /trash", getTrash).Doc("查看回收站").Conditional().Secured(scopeTrashAdmin).
+		Returns(http.StatusOK, Trash{})
+
+	router.Handle("POST /batch", handleBatch(router)).Doc("按顺序执行多个用户和帖子操作（atomic模式下全部成功或全部撤销，需要API密钥）").Idempotent().
+		Accepts(BatchRequest{}).Returns(http.StatusOK, BatchResponse{})
+
+	router.Handle("GET /apikeys", listAPIKeys).Doc("列出API密钥").Secured(scopeAPIKeysAdmin).
+		Returns(http.StatusOK, []APIKey{})
+	router.Handle("POST /apikeys", issueAPIKey).Doc("签发API密钥").Secured(scopeAPIKeysAdmin).
+		Accepts(IssueAPIKeyRequest{}).Returns(http.StatusCreated, IssuedAPIKey{})
+	router.Handle("DELETE /apikeys/{id}", revokeAPIKey).Doc("吊销API密钥").Secured(scopeAPIKeysAdmin).
+		Returns(http.StatusNoContent, nil)
+
+	var extra []Middleware
+	if limits.Limit > 0 {
+		keyFunc, err := rateLimitKeyFunc(limits.Key, limits.TrustedProxies, router)
+		if err != nil {
+			return nil, err
+		}
+		policy := &RateLimitPolicy{Limiter: NewRateLimiter(limits.Limit, limits.Window), KeyFunc: keyFunc}
+		extra = append(extra, rateLimitMiddleware(policy))
+	}
+	handler := withMiddleware(router.ServeHTTP, extra...)
+	if cors != nil {
+		// CORS在认证之外：预检请求不携带凭证，必须在认证之前处理；认证失败的响应也要带上CORS头，页面才能读到401
+		handler = corsMiddleware(router, cors)(handler)
+	}
+	// 指标中间件在最外层，CORS预检、认证失败和限流拒绝的请求都会被统计
+	return metricsMiddleware(metrics, router)(handler), nil
+}
+
+// 12.1 配置管理
+// Config沿用12-advanced-topics.go中的配置结构：嵌套结构体分组、json标签对应配置文件中的字段
+// 配置来源按优先级从低到高依次为：默认值 < 配置文件（-config） < 环境变量（WEB_前缀） < 命令行参数
+// 例如：go run 10-web-server.go -config=server.json，或 WEB_PORT=9090 go run 10-web-server.go
+type Config struct {
+	Server struct {
+		Host              string   `json:"host"`                // 监听的主机名，空字符串表示所有网卡
+		Port              int      `json:"port"`                // 监听端口
+		ReadTimeout       Duration `json:"read_timeout"`        // 读取整个请求（含请求体）的超时时间
+		ReadHeaderTimeout Duration `json:"read_header_timeout"` // 读取请求头的超时时间，防御慢速请求头攻击（Slowloris）
+		WriteTimeout      Duration `json:"write_timeout"`       // 从读完请求头到写完响应的超时时间
+		IdleTimeout       Duration `json:"idle_timeout"`        // keep-alive连接的最大空闲时间
+		MaxHeaderBytes    int      `json:"max_header_bytes"`    // 请求头的最大字节数
+		ShutdownTimeout   Duration `json:"shutdown_timeout"`    // 优雅关闭时等待进行中请求完成的最长时间
+		DrainDelay        Duration `json:"drain_delay"`         // 收到退出信号后，/readyz报告未就绪、继续处理请求多久再开始关闭
+		SPA               bool     `json:"spa"`                 // 未匹配路由的页面请求是否返回主页（单页应用模式）
+		IdempotencyTTL    Duration `json:"idempotency_ttl"`     // Idempotency-Key对应的响应保存多久
+	} `json:"server"`
+	Storage struct {
+		Kind             string   `json:"kind"`               // 存储类型：memory或sqlite
+		Path             string   `json:"path"`               // SQLite数据库文件路径
+		UserDeletePolicy string   `json:"user_delete_policy"` // 删除用户时如何处理其帖子：reject、cascade或reassign
+		ReassignTo       int      `json:"reassign_to"`        // reassign策略下接收帖子的用户ID
+		TrashRetention   Duration `json:"trash_retention"`    // 删除的记录在回收站中保留多久，超过后永久删除
+		PurgeInterval    Duration `json:"purge_interval"`     // 多久清理一次回收站
+	} `json:"storage"`
+	Auth struct {
+		AdminKeyFile string `json:"admin_key_file"` // 保存管理员API密钥的文件，未设置环境变量API_ADMIN_KEY时使用
+	} `json:"auth"`
+	RateLimit struct {
+		Limit          int      `json:"limit"`           // 每个限流键在窗口内允许的请求数，0表示不限流
+		Window         Duration `json:"window"`          // 限流窗口长度
+		Key            string   `json:"key"`             // 限流键类型：ip、apikey、route
+		TrustedProxies string   `json:"trusted_proxies"` // 受信任的反向代理（逗号分隔的IP或CIDR）
+	} `json:"rate_limit"`
+	CORS struct {
+		Origins     string   `json:"origins"`     // 允许跨域访问的源（逗号分隔），支持https://*.example.com形式的通配子域名，空字符串表示不允许跨域
+		Credentials bool     `json:"credentials"` // 是否允许跨域请求携带凭证
+		MaxAge      Duration `json:"max_age"`     // 浏览器缓存预检结果的时间
+	} `json:"cors"`
+}
+
+// Duration：可以在JSON中写成"5s"、"1m30s"形式的时间长度
+// time.Duration在JSON中只能写成纳秒整数，不适合人工编辑的配置文件
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON：实现json.Unmarshaler接口，按time.ParseDuration的格式解析字符串
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("时间长度必须是字符串（例如\"5s\"）: %w", err)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON：实现json.Marshaler接口，输出与UnmarshalJSON对称的字符串形式
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// defaultConfig：返回默认配置，没有任何外部配置时服务器使用这些值
+func defaultConfig() *Config {
+	var config Config
+	config.Server.Port = 8080
+	config.Server.ReadTimeout = Duration{15 * time.Second}
+	config.Server.ReadHeaderTimeout = Duration{5 * time.Second}
+	config.Server.WriteTimeout = Duration{30 * time.Second}
+	config.Server.IdleTimeout = Duration{2 * time.Minute}
+	config.Server.MaxHeaderBytes = 1 << 20 // 1MB，与http.DefaultMaxHeaderBytes相同
+	config.Server.ShutdownTimeout = Duration{10 * time.Second}
+	config.Server.IdempotencyTTL = Duration{24 * time.Hour}
+	config.Storage.Kind = "memory"
+	config.Storage.Path = "webserver.db"
+	config.Storage.UserDeletePolicy = deleteReject
+	config.Storage.TrashRetention = Duration{30 * 24 * time.Hour}
+	config.Storage.PurgeInterval = Duration{time.Hour}
+	config.Auth.AdminKeyFile = "admin.key"
+	config.RateLimit.Limit = 120
+	config.RateLimit.Window = Duration{time.Minute}
+	config.RateLimit.Key = "ip"
+	config.CORS.Origins = "*"
+	config.CORS.MaxAge = Duration{10 * time.Minute}
+	return &config
+}
+
+// loadConfig：从JSON数据加载配置
+// 与12-advanced-topics.go不同，这里在已有配置的基础上解析：JSON中没有出现的字段保持原值（默认值）
+func loadConfig(jsonData []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields() // 拼错的配置项直接报错，而不是被悄悄忽略
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("解析配置失败: %w", err)
+	}
+	return nil
+}
+
+// bindConfigFlags：把配置字段绑定到命令行参数上
+// 参数的默认值就是config中的当前值，解析命令行时直接写回config
+func bindConfigFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.Server.Host, "host", config.Server.Host, "监听的主机名，默认监听所有网卡")
+	fs.IntVar(&config.Server.Port, "port", config.Server.Port, "监听端口")
+	fs.DurationVar(&config.Server.ReadTimeout.Duration, "read-timeout", config.Server.ReadTimeout.Duration, "读取整个请求的超时时间")
+	fs.DurationVar(&config.Server.ReadHeaderTimeout.Duration, "read-header-timeout", config.Server.ReadHeaderTimeout.Duration, "读取请求头的超时时间")
+	fs.DurationVar(&config.Server.WriteTimeout.Duration, "write-timeout", config.Server.WriteTimeout.Duration, "写响应的超时时间")
+	fs.DurationVar(&config.Server.IdleTimeout.Duration, "idle-timeout", config.Server.IdleTimeout.Duration, "keep-alive连接的最大空闲时间")
+	fs.IntVar(&config.Server.MaxHeaderBytes, "max-header-bytes", config.Server.MaxHeaderBytes, "请求头的最大字节数")
+	fs.DurationVar(&config.Server.ShutdownTimeout.Duration, "shutdown-timeout", config.Server.ShutdownTimeout.Duration, "优雅关闭时等待进行中请求完成的最长时间")
+	fs.DurationVar(&config.Server.DrainDelay.Duration, "drain-delay", config.Server.DrainDelay.Duration, "收到退出信号后先让/readyz返回503，等待负载均衡器摘除本实例后再关闭（例如5s）")
+	fs.BoolVar(&config.Server.SPA, "spa", config.Server.SPA, "单页应用模式：未匹配任何路由的页面请求返回主页，由前端路由处理")
+	fs.DurationVar(&config.Server.IdempotencyTTL.Duration, "idempotency-ttl", config.Server.IdempotencyTTL.Duration, "Idempotency-Key对应的响应保存多久，有效期内的重试直接重放第一次的响应")
+	fs.StringVar(&config.Storage.Kind, "store", config.Storage.Kind, "存储类型: memory（内存，重启后丢失）或 sqlite（持久化到文件）")
+	fs.StringVar(&config.Storage.Path, "db", config.Storage.Path, "SQLite数据库文件路径（仅在 -store=sqlite 时使用）")
+	fs.StringVar(&config.Storage.UserDeletePolicy, "user-delete-policy", config.Storage.UserDeletePolicy, "删除用户时如何处理其帖子: reject（拒绝，返回409）、cascade（一并删除）或 reassign（转给 -reassign-to 指定的用户）")
+	fs.IntVar(&config.Storage.ReassignTo, "reassign-to", config.Storage.ReassignTo, "reassign策略下接收帖子的用户ID")
+	fs.DurationVar(&config.Storage.TrashRetention.Duration, "trash-retention", config.Storage.TrashRetention.Duration, "删除的用户和帖子在回收站中保留多久，超过后永久删除")
+	fs.DurationVar(&config.Storage.PurgeInterval.Duration, "purge-interval", config.Storage.PurgeInterval.Duration, "多久清理一次回收站中过期的记录")
+	fs.StringVar(&config.Auth.AdminKeyFile, "admin-key-file", config.Auth.AdminKeyFile, "保存管理员API密钥的文件（权限0600），不存在时生成新密钥写入；设置了环境变量API_ADMIN_KEY时不使用")
+	fs.IntVar(&config.RateLimit.Limit, "rate-limit", config.RateLimit.Limit, "每个限流键在窗口内允许的请求数，0表示不限流")
+	fs.DurationVar(&config.RateLimit.Window.Duration, "rate-window", config.RateLimit.Window.Duration, "限流窗口长度")
+	fs.StringVar(&config.RateLimit.Key, "rate-key", config.RateLimit.Key, "限流键: ip（客户端IP）、apikey（API密钥）或 route（路由）")
+	fs.StringVar(&config.RateLimit.TrustedProxies, "trusted-proxies", config.RateLimit.TrustedProxies, "受信任的反向代理（逗号分隔的IP或CIDR），用于解析X-Forwarded-For")
+	fs.StringVar(&config.CORS.Origins, "cors-origins", config.CORS.Origins, "允许跨域访问的源（逗号分隔），支持https://*.example.com，空字符串表示不允许跨域")
+	fs.BoolVar(&config.CORS.Credentials, "cors-credentials", config.CORS.Credentials, "是否允许跨域请求携带凭证（不能与\"*\"同时使用）")
+	fs.DurationVar(&config.CORS.MaxAge.Duration, "cors-max-age", config.CORS.MaxAge.Duration, "浏览器缓存CORS预检结果的时间")
+}
+
+// envName：由命令行参数名得到对应的环境变量名，例如rate-limit对应WEB_RATE_LIMIT
+func envName(flagName string) string {
+	return "WEB_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv：用环境变量覆盖配置
+// 环境变量与命令行参数一一对应，复用fs.Set按参数类型解析取值，无需为每个字段单独写解析代码
+func applyEnv(fs *flag.FlagSet) error {
+	var firstErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || firstErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			firstErr = fmt.Errorf("环境变量 %s 无效: %w", envName(f.Name), err)
+		}
+	})
+	return firstErr
+}
+
+// parseConfig：按"默认值 < 配置文件 < 环境变量 < 命令行参数"的优先级得到最终配置
+// 配置文件路径本身来自命令行，所以命令行要解析两次：
+// 第一次取得-config，加载文件和环境变量之后再解析一次，让命令行参数覆盖它们
+func parseConfig(fs *flag.FlagSet, args []string, config *Config) error {
+	configPath := fs.String("config", os.Getenv("WEB_CONFIG"), "JSON配置文件路径（也可通过环境变量WEB_CONFIG指定）")
+	bindConfigFlags(fs, config)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return fmt.Errorf("读取配置文件失败: %w", err)
+		}
+		if err := loadConfig(data, config); err != nil {
+			return err
+		}
+	}
+	if err := applyEnv(fs); err != nil {
+		return err
+	}
+	return fs.Parse(args)
+}
+
+// Addr：返回"host:port"形式的监听地址
+func (c *Config) Addr() string {
+	return net.JoinHostPort(c.Server.Host, strconv.Itoa(c.Server.Port))
+}
+
+// newHTTPServer：根据配置创建http.Server
+// http.ListenAndServe使用的默认服务器没有任何超时，慢速或恶意客户端可以无限期占用连接
+func newHTTPServer(config *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.Addr(),
+		Handler:           handler,
+		ReadTimeout:       config.Server.ReadTimeout.Duration,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout.Duration,
+		WriteTimeout:      config.Server.WriteTimeout.Duration,
+		IdleTimeout:       config.Server.IdleTimeout.Duration,
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+	}
+}
+
+// serveUntilSignal：启动服务器，收到SIGINT（Ctrl+C）或SIGTERM后优雅关闭
+// 优雅关闭：停止接受新连接，等待进行中的请求处理完毕；超过timeout仍未完成的连接会被强制关闭
+// 收到信号后/readyz立即返回503；drainDelay大于0时先照常处理drainDelay时间的请求再关闭，
+// 负载均衡器在这段时间内通过探针发现实例未就绪并停止转发，新请求就不会落到正在关闭的实例上
+func serveUntilSignal(server *http.Server, drainDelay, timeout time.Duration) error {
+	// signal.NotifyContext：收到指定信号时取消ctx
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		// 调用Shutdown后ListenAndServe立即返回http.ErrServerClosed，这不是错误
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err // 启动失败（例如端口被占用）
+	case <-ctx.Done():
+	}
+	stop() // 恢复默认的信号处理：再按一次Ctrl+C可以立即退出
+
+	fmt.Println("\n收到退出信号")
+	healthChecker.SetDraining() // 从现在起/readyz返回503
+	if drainDelay > 0 {
+		fmt.Printf("等待负载均衡器摘除本实例（%v），期间照常处理请求...\n", drainDelay)
+		time.Sleep(drainDelay)
+	}
+	fmt.Printf("等待进行中的请求完成（最多%v）...\n", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close() // 超时：强制关闭剩余连接
+		return fmt.Errorf("优雅关闭超时: %w", err)
+	}
+	fmt.Println("服务器已停止")
+	return nil
+}
+
+// 主函数：程序入口点
+func main() {
+	fmt.Println("=== Go语言Web服务器开发 ===")
+
+	// 加载配置：默认值、配置文件、环境变量和命令行参数
+	// 示例：go run 10-web-server.go -store=sqlite -db=webserver.db
+	config := defaultConfig()
+	if err := parseConfig(flag.CommandLine, os.Args[1:], config); err != nil {
+		log.Fatal("加载配置失败:", err)
+	}
+
+	// 创建存储实例并赋值给全局变量store，处理器通过它访问数据
+	var err error
+	store, err = newStore(config.Storage.Kind, config.Storage.Path)
+	if err != nil {
+		log.Fatal("初始化存储失败:", err)
+	}
+	defer store.Close() // 程序退出时释放存储资源（如关闭数据库连接）
+	fmt.Printf("使用存储: %s\n", config.Storage.Kind)
+	registerHealthChecks(healthChecker, store)
+
+	// 删除用户的默认策略
+	userDeletePolicy, err = NewUserDeletePolicy(config.Storage.UserDeletePolicy, config.Storage.ReassignTo)
+	if err != nil {
+		log.Fatal("用户删除策略无效:", err)
+	}
+
+	// 创建请求的幂等记录按配置的有效期保存
+	if config.Server.IdempotencyTTL.Duration <= 0 {
+		log.Fatal("idempotency-ttl必须大于0")
+	}
+	idempotencyKeys = NewIdempotencyStore(config.Server.IdempotencyTTL.Duration)
+
+	// 回收站的保留时长和清理间隔
+	if config.Storage.TrashRetention.Duration <= 0 || config.Storage.PurgeInterval.Duration <= 0 {
+		log.Fatal("trash-retention和purge-interval必须大于0")
+	}
+	trashRetention = config.Storage.TrashRetention.Duration
+
+	// 初始化示例数据
+	if err := initData(); err != nil {
+		log.Fatal("初始化示例数据失败:", err)
+	}
+
+	// 由存储中的帖子建立搜索索引（SQLite中可能已有上次运行写入的帖子）
+	posts, err := store.ListPosts()
+	if err != nil {
+		log.Fatal("建立搜索索引失败:", err)
+	}
+	searchIndex.Rebuild(posts)
+
+	// 准备管理员API密钥，写操作需要携带它（或由它签发的密钥）
+	if err := bootstrapAdminKey(config.Auth.AdminKeyFile); err != nil {
+		log.Fatal("初始化API密钥失败:", err)
+	}
+
+	// 设置路由规则、限流和跨域策略
+	proxies, err := parseTrustedProxies(config.RateLimit.TrustedProxies)
+	if err != nil {
+		log.Fatal("解析受信任代理失败:", err)
+	}
+	var origins []string
+	for _, origin := range strings.Split(config.CORS.Origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	cors, err := NewCORSPolicy(origins, config.CORS.Credentials, config.CORS.MaxAge.Duration)
+	if err != nil {
+		log.Fatal("CORS配置无效:", err)
+	}
+	router, err := newRouter(rateLimitOptions{
+		Limit:          config.RateLimit.Limit,
+		Window:         config.RateLimit.Window.Duration,
+		Key:            config.RateLimit.Key,
+		TrustedProxies: proxies,
+	}, cors, config.Server.SPA)
+	if err != nil {
+		log.Fatal("初始化路由失败:", err)
+	}
+
+	// 启动HTTP服务器
+	fmt.Printf("服务器启动在 http://localhost:%d\n", config.Server.Port)
+	fmt.Println("按 Ctrl+C 停止服务器")
+
+	// 后台定期清理回收站，服务器关闭时停止
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	go purgeTrash(purgeCtx, config.Storage.PurgeInterval.Duration)
+
+	// newHTTPServer：创建带超时设置的http.Server，处理器是newRouter创建的路由器
+	// serveUntilSignal：阻塞直到服务器出错或收到退出信号并完成优雅关闭
+	server := newHTTPServer(config, router)
+	server.RegisterOnShutdown(events.Close) // 关闭时断开事件流，否则Shutdown要一直等到超时
+	server.RegisterOnShutdown(stopPurge)
+	if err := serveUntilSignal(server, config.Server.DrainDelay.Duration, config.Server.ShutdownTimeout.Duration); err != nil {
+		// 这里不使用log.Fatal：它会直接退出进程，跳过上面defer的store.Close()
+		log.Println("服务器错误:", err)
 	}
-	defer resp.Body.Close()  // 关闭响应体
-	
-	fmt.Printf("获取用户响应状态: %s\n", resp.Status)
 }
@@ -0,0 +1,1412 @@
+package main
+
+// 10-web-server.go的测试：静态文件服务、各API的行为和并发安全
+// 仓库中每个示例都是独立的main包，运行时需要把两个文件一起传给go test：
+// go test 10-web-server.go 10-web-server_test.go
+// 测试用httptest在进程内启动服务器，实际发送请求，任何一项回归都会让go test失败
+// 处理器通过全局变量访问存储和密钥，测试之间不能并行，每个测试都换上全新的实例（见setGlobal）
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setGlobal：测试期间把全局变量替换为value，测试结束时恢复原值
+func setGlobal[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	saved := *p
+	*p = value
+	t.Cleanup(func() { *p = saved })
+}
+
+// newStaticTestServer：启动开启SPA回退的测试服务器，测试结束时自动关闭
+func newStaticTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(io.Discard, nil))) // 访问日志对测试没有意义
+
+	router, err := newRouter(rateLimitOptions{}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// rawGet：通过原始TCP连接发送请求行，路径原样发送
+// http.Client会规范化URL，无法发出"/static/../x"这样的请求行，路径穿越的请求只能这样发送
+func rawGet(t *testing.T, server *httptest.Server, target string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+	for _, header := range headers {
+		request += header + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("%s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// TestStaticPathTraversal：各种穿越写法（../、编码的%2e%2e和%2f、反斜杠、双斜杠、NUL）都不能返回200，
+// 响应中也不能出现源码、系统文件或主页模板的内容；打包目录中静态资源以外的文件（web/index.html）不能通过/static/访问
+// 请求带有Accept: text/html，同时检验SPA回退不会接管这些请求
+func TestStaticPathTraversal(t *testing.T) {
+	server := newStaticTestServer(t)
+	traversals := []string{
+		"/static/../10-web-server.go",
+		"/static/../../../../etc/passwd",
+		"/static/%2e%2e/10-web-server.go",
+		"/static/%2e%2e%2f%2e%2e%2fetc%2fpasswd",
+		"/static/..%2f10-web-server.go",
+		"/static/..%5c10-web-server.go",
+		"/static/..\\10-web-server.go",
+		"/static//etc/passwd",
+		"/static/%2fetc%2fpasswd",
+		"/static/style.css/../../index.html",
+		"/static/./../web/index.html",
+		"/static/%00style.css",
+		"/static/index.html",
+		"/static/web/index.html",
+		"/static/static/style.css",
+		"/web/index.html",
+		"/static/",
+	}
+	for _, target := range traversals {
+		resp, body := rawGet(t, server, target, "Accept: text/html")
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%s 返回 200", target)
+		}
+		for _, leak := range []string{"package main", "root:", "{{"} {
+			if bytes.Contains(body, []byte(leak)) {
+				t.Errorf("%s 的响应中包含 %q", target, leak)
+			}
+		}
+	}
+}
+
+// TestStaticCaching：带哈希的URL长期缓存，原始URL每次校验，If-None-Match返回304，支持gzip时返回压缩内容
+func TestStaticCaching(t *testing.T) {
+	server := newStaticTestServer(t)
+
+	hashedURL, err := assets.URL("style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := rawGet(t, server, hashedURL)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("%s 返回 %d，Cache-Control: %s", hashedURL, resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	resp, _ = rawGet(t, server, "/static/style.css")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-cache" || resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("/static/style.css 返回 %d，Cache-Control: %s", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	etag := resp.Header.Get("ETag")
+	resp, _ = rawGet(t, server, "/static/style.css", "If-None-Match: "+etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: %s 返回 %d", etag, resp.StatusCode)
+	}
+
+	resp, body := rawGet(t, server, "/static/app.js", "Accept-Encoding: gzip")
+	if original := len(assets.byName["app.js"].data); resp.Header.Get("Content-Encoding") != "gzip" || len(body) == 0 || len(body) >= original {
+		t.Errorf("/static/app.js 压缩后 %d 字节（原始 %d 字节），Content-Encoding: %s", len(body), original, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// TestSPAFallback：SPA回退只对页面请求生效，API请求和带扩展名的路径仍然404
+func TestSPAFallback(t *testing.T) {
+	server := newStaticTestServer(t)
+	tests := []struct {
+		target string
+		accept string
+		status int
+	}{
+		{"/dashboard/users", "text/html", http.StatusOK},
+		{"/dashboard/users", "application/json", http.StatusNotFound},
+		{"/missing.js", "text/html", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, body := rawGet(t, server, tt.target, "Accept: "+tt.accept)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s（Accept: %s）返回 %d，期望 %d", tt.target, tt.accept, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusOK && !bytes.Contains(body, []byte("<html")) {
+			t.Errorf("%s 没有返回主页", tt.target)
+		}
+	}
+}
+
+// apiServer：API测试服务器，使用全新的存储和密钥
+type apiServer struct {
+	*httptest.Server
+	t        *testing.T
+	adminKey string // 拥有全部权限的API密钥
+}
+
+// newAPITestServer：用全新的存储（memory或sqlite）启动测试服务器，不限流、不处理跨域请求
+func newAPITestServer(t *testing.T, kind string) *apiServer {
+	t.Helper()
+	return newAPITestServerWith(t, kind, rateLimitOptions{}, nil)
+}
+
+// newAPITestServerWith：与newAPITestServer相同，另外指定限流配置和默认CORS策略
+// 存储、密钥、搜索索引和幂等记录都换成全新的实例，测试结束时关闭服务器并恢复原来的全局变量
+func newAPITestServerWith(t *testing.T, kind string, limits rateLimitOptions, cors *CORSPolicy) *apiServer {
+	t.Helper()
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	s, err := newStore(kind, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	setGlobal(t, &store, s)
+	setGlobal(t, &apiKeys, NewAPIKeyStore())
+	setGlobal(t, &searchIndex, NewSearchIndex())
+	setGlobal(t, &idempotencyKeys, NewIdempotencyStore(time.Hour))
+
+	adminKey, _, err := apiKeys.Issue("test-admin", []string{scopeUsersWrite, scopePostsWrite, scopeAPIKeysAdmin, scopeTrashAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := newRouter(limits, cors, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return &apiServer{Server: server, t: t, adminKey: adminKey}
+}
+
+// auth：携带管理员密钥的请求头
+func (s *apiServer) auth() string {
+	return "Authorization: Bearer " + s.adminKey
+}
+
+// send：发送请求，headers的写法与rawGet相同（"名称: 值"），有请求体时默认使用application/json
+// 返回错误而不是直接让测试失败，因此可以在测试启动的goroutine中调用
+func (s *apiServer) send(method, target, body string, headers ...string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, s.URL+target, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Set(name, strings.TrimSpace(value))
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// do：发送请求，失败时终止测试；只能在测试自己的goroutine中调用
+func (s *apiServer) do(method, target, body string, headers ...string) (*http.Response, []byte) {
+	s.t.Helper()
+	resp, data, err := s.send(method, target, body, headers...)
+	if err != nil {
+		s.t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return resp, data
+}
+
+// create：以管理员身份创建资源，返回服务器分配的ID
+func (s *apiServer) create(target, body string) (int, error) {
+	resp, data, err := s.send(http.MethodPost, target, body, s.auth())
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("POST %s 返回 %d: %s", target, resp.StatusCode, data)
+	}
+	var created struct {
+		ID int `json:"id"`
+	}
+	return created.ID, json.Unmarshal(data, &created)
+}
+
+// TestConcurrentCreates：多个goroutine同时创建用户和帖子并穿插读取列表，ID不能重复，记录数必须与请求数完全一致
+// 用go test -race运行时，存储层任何未加锁的并发读写都会被报告为数据竞争
+func TestConcurrentCreates(t *testing.T) {
+	const workers, requestsPerWorker = 20, 10
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			server := newAPITestServer(t, kind)
+			var (
+				mu      sync.Mutex           // 保护下面两个map
+				userIDs = make(map[int]bool) // 服务器返回的用户ID
+				postIDs = make(map[int]bool) // 服务器返回的帖子ID
+			)
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for i := 0; i < requestsPerWorker; i++ {
+						userID, err := server.create("/users", fmt.Sprintf(`{"name": "压测用户-%d-%d", "email": "load-%d-%d@example.com", "age": 30}`, worker, i, worker, i))
+						if err != nil {
+							t.Error(err)
+							continue
+						}
+						postID, err := server.create("/posts", fmt.Sprintf(`{"title": "压测帖子-%d-%d", "content": "并发写入测试", "author_id": %d}`, worker, i, userID))
+						if err != nil {
+							t.Error(err)
+							continue
+						}
+						// 穿插读请求，让读写并发发生
+						if resp, _, err := server.send(http.MethodGet, "/users", ""); err != nil || resp.StatusCode != http.StatusOK {
+							t.Errorf("GET /users: %v", err)
+						}
+
+						mu.Lock()
+						if userIDs[userID] || postIDs[postID] {
+							t.Errorf("重复的ID：用户%d，帖子%d", userID, postID)
+						}
+						userIDs[userID], postIDs[postID] = true, true
+						mu.Unlock()
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			// 存储从空开始，记录数必须正好等于请求数
+			want := workers * requestsPerWorker
+			users, posts, err := store.Count(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if users != want || posts != want || len(userIDs) != want || len(postIDs) != want {
+				t.Errorf("期望%d个用户和%d个帖子，存储中有%d个用户、%d个帖子，返回了%d个不同的用户ID、%d个不同的帖子ID",
+					want, want, users, posts, len(userIDs), len(postIDs))
+			}
+		})
+	}
+}
+
+// TestUpdateChecksExistenceFirst：PUT先确认资源存在、版本匹配，再校验请求体
+// 资源不存在时即使请求体无效也返回404；资源存在且If-Match正确时才报告422
+func TestUpdateChecksExistenceFirst(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	userID, err := server.create("/users", `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := server.create("/posts", fmt.Sprintf(`{"title": "标题", "content": "内容", "author_id": %d}`, userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const invalid = `{"name": "", "email": "not-an-email", "age": -1, "title": ""}`
+	tests := []struct {
+		target  string
+		ifMatch string
+		status  int
+	}{
+		{"/users/999", `"v1"`, http.StatusNotFound},
+		{fmt.Sprintf("/users/%d", userID), `"v1"`, http.StatusUnprocessableEntity},
+		{fmt.Sprintf("/users/%d", userID), `"v9"`, http.StatusPreconditionFailed},
+		{"/posts/999", `"v1"`, http.StatusNotFound},
+		{fmt.Sprintf("/posts/%d", postID), `"v1"`, http.StatusUnprocessableEntity},
+		{fmt.Sprintf("/posts/%d", postID), `"v9"`, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		resp, body := server.do(http.MethodPut, tt.target, invalid, server.auth(), "If-Match: "+tt.ifMatch)
+		if resp.StatusCode != tt.status {
+			t.Errorf("PUT %s（If-Match: %s）返回 %d，期望 %d: %s", tt.target, tt.ifMatch, resp.StatusCode, tt.status, body)
+		}
+	}
+}
+
+// TestConditionalRequests：GET的If-None-Match命中时返回304；写操作缺少If-Match返回428，版本不匹配返回412并告知当前ETag
+// 步骤按顺序执行，PATCH成功后用户的版本从v1变为v2
+func TestConditionalRequests(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	userID, err := server.create("/users", `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := server.create("/posts", fmt.Sprintf(`{"title": "标题", "content": "内容", "author_id": %d}`, userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := fmt.Sprintf("/users/%d", userID)
+	post := fmt.Sprintf("/posts/%d", postID)
+	const replacement = `{"name": "张三", "email": "zhangsan@example.com", "age": 26}`
+
+	steps := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers []string
+		status  int
+		etag    string // 期望的ETag响应头，空字符串表示不检查
+	}{
+		{"If-None-Match命中", http.MethodGet, user, "", []string{`If-None-Match: "v1"`}, http.StatusNotModified, `"v1"`},
+		{"If-None-Match弱比较", http.MethodGet, user, "", []string{`If-None-Match: W/"v1"`}, http.StatusNotModified, `"v1"`},
+		{"If-None-Match列出多个ETag", http.MethodGet, user, "", []string{`If-None-Match: "v0", "v1"`}, http.StatusNotModified, `"v1"`},
+		{"If-None-Match未命中", http.MethodGet, user, "", []string{`If-None-Match: "v2"`}, http.StatusOK, `"v1"`},
+		{"PUT缺少If-Match", http.MethodPut, user, replacement, nil, http.StatusPreconditionRequired, ""},
+		{"PATCH缺少If-Match", http.MethodPatch, user, `{"age": 26}`, nil, http.StatusPreconditionRequired, ""},
+		{"DELETE缺少If-Match", http.MethodDelete, user, "", nil, http.StatusPreconditionRequired, ""},
+		{"PUT版本不匹配", http.MethodPut, user, replacement, []string{`If-Match: "v2"`}, http.StatusPreconditionFailed, `"v1"`},
+		{"If-Match使用强比较", http.MethodPatch, user, `{"age": 26}`, []string{`If-Match: W/"v1"`}, http.StatusPreconditionFailed, `"v1"`},
+		{"PATCH版本匹配", http.MethodPatch, user, `{"age": 26}`, []string{`If-Match: "v1"`}, http.StatusOK, `"v2"`},
+		{"PUT使用过期的版本", http.MethodPut, user, replacement, []string{`If-Match: "v1"`}, http.StatusPreconditionFailed, `"v2"`},
+		{"修改后旧ETag不再命中", http.MethodGet, user, "", []string{`If-None-Match: "v1"`}, http.StatusOK, `"v2"`},
+		{"帖子PUT缺少If-Match", http.MethodPut, post, `{"title": "新标题", "content": "内容", "author_id": 1}`, nil, http.StatusPreconditionRequired, ""},
+		{"帖子DELETE版本不匹配", http.MethodDelete, post, "", []string{`If-Match: "v3"`}, http.StatusPreconditionFailed, `"v1"`},
+	}
+	for _, step := range steps {
+		resp, body := server.do(step.method, step.target, step.body, append(step.headers, server.auth())...)
+		if resp.StatusCode != step.status {
+			t.Fatalf("%s：%s %s 返回 %d，期望 %d: %s", step.name, step.method, step.target, resp.StatusCode, step.status, body)
+		}
+		if etag := resp.Header.Get("ETag"); step.etag != "" && etag != step.etag {
+			t.Errorf("%s：ETag是 %s，期望 %s", step.name, etag, step.etag)
+		}
+		if resp.StatusCode == http.StatusNotModified && len(body) > 0 {
+			t.Errorf("%s：304响应带有响应体 %q", step.name, body)
+		}
+	}
+
+	// 列表的ETag由内容生成：内容不变时命中，新增用户后失效
+	resp, _ := server.do(http.MethodGet, "/users", "")
+	listETag := resp.Header.Get("ETag")
+	if resp, _ := server.do(http.MethodGet, "/users", "", "If-None-Match: "+listETag); listETag == "" || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("列表的If-None-Match返回 %d（ETag: %q），期望 304", resp.StatusCode, listETag)
+	}
+	if _, err := server.create("/users", `{"name": "李四", "email": "lisi@example.com", "age": 30}`); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := server.do(http.MethodGet, "/users", "", "If-None-Match: "+listETag); resp.StatusCode != http.StatusOK {
+		t.Errorf("列表变化后If-None-Match返回 %d，期望 200", resp.StatusCode)
+	}
+}
+
+// TestBootstrapAdminKey：生成的管理员密钥写入0600权限的文件，重启后从文件读取同一个密钥；环境变量API_ADMIN_KEY优先
+func TestBootstrapAdminKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "admin.key")
+	t.Setenv("API_ADMIN_KEY", "")
+
+	setGlobal(t, &apiKeys, NewAPIKeyStore())
+	if err := bootstrapAdminKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("密钥文件的权限是 %v，期望 0600", perm)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := strings.TrimSpace(string(data))
+	if _, ok := apiKeys.Authenticate(plaintext); !ok {
+		t.Fatal("文件中的密钥无法通过认证")
+	}
+
+	// 模拟重启：全新的密钥存储从同一个文件加载
+	setGlobal(t, &apiKeys, NewAPIKeyStore())
+	if err := bootstrapAdminKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := apiKeys.Authenticate(plaintext); !ok {
+		t.Error("重启后文件中的密钥无法通过认证")
+	}
+
+	t.Setenv("API_ADMIN_KEY", "env-secret")
+	setGlobal(t, &apiKeys, NewAPIKeyStore())
+	if err := bootstrapAdminKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := apiKeys.Authenticate("env-secret"); !ok {
+		t.Error("环境变量中的密钥无法通过认证")
+	}
+	if _, ok := apiKeys.Authenticate(plaintext); ok {
+		t.Error("设置了API_ADMIN_KEY时不应再加载密钥文件")
+	}
+}
+
+// TestAuth：写操作需要API密钥；没有密钥或密钥无效时返回401，密钥缺少所需权限时返回403；读操作允许匿名访问
+func TestAuth(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	postsKey, _, err := apiKeys.Issue("posts-only", []string{scopePostsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersKey, _, err := apiKeys.Issue("users-only", []string{scopeUsersWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, err := apiKeys.Issue("revoked", []string{scopeUsersWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiKeys.Revoke(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	const newUser = `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers []string
+		status  int
+	}{
+		{"没有密钥", http.MethodPost, "/users", nil, http.StatusUnauthorized},
+		{"无效的密钥", http.MethodPost, "/users", []string{"Authorization: Bearer not-a-key"}, http.StatusUnauthorized},
+		{"已吊销的密钥", http.MethodPost, "/users", []string{"Authorization: Bearer " + revokedKey}, http.StatusUnauthorized},
+		{"无效的密钥也不能匿名读取", http.MethodGet, "/users", []string{"X-API-Key: not-a-key"}, http.StatusUnauthorized},
+		{"缺少users:write", http.MethodPost, "/users", []string{"Authorization: Bearer " + postsKey}, http.StatusForbidden},
+		{"缺少apikeys:admin", http.MethodGet, "/apikeys", []string{"X-API-Key: " + usersKey}, http.StatusForbidden},
+		{"匿名读取", http.MethodGet, "/users", nil, http.StatusOK},
+		{"X-API-Key写法", http.MethodPost, "/users", []string{"X-API-Key: " + usersKey}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == http.MethodPost {
+				body = newUser
+			}
+			resp, data := server.do(tt.method, tt.target, body, tt.headers...)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s %s 返回 %d，期望 %d: %s", tt.method, tt.target, resp.StatusCode, tt.status, data)
+			}
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401响应缺少WWW-Authenticate头")
+			}
+		})
+	}
+}
+
+// TestMigratePostAuthors：旧数据库中作者名称找不到对应用户的帖子，迁移后归到同名的占位用户，仍然可以修改
+func TestMigratePostAuthors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 添加author_id之前的表结构：帖子的author列保存作者名称
+	for _, statement := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, email TEXT NOT NULL, age INTEGER NOT NULL, created TEXT NOT NULL)`,
+		`CREATE TABLE posts (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL, content TEXT NOT NULL, author TEXT NOT NULL, date TEXT NOT NULL)`,
+		`INSERT INTO users (name, email, age, created) VALUES ('张三', 'zhangsan@example.com', 25, '2024-01-01T00:00:00Z')`,
+		`INSERT INTO posts (title, content, author, date) VALUES
+		    ('第一篇', '内容', '张三', '2024-01-02T00:00:00Z'),
+		    ('第二篇', '内容', '李四', '2024-01-03T00:00:00Z'),
+		    ('第三篇', '内容', '李四', '2024-01-04T00:00:00Z'),
+		    ('第四篇', '内容', '', '2024-01-05T00:00:00Z')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[int]string)
+	for _, user := range users {
+		if err := user.Validate(); err != nil {
+			t.Errorf("用户 %q 无效: %v", user.Name, err)
+		}
+		names[user.ID] = user.Name
+	}
+	posts, err := s.ListPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"第一篇": "张三", "第二篇": "李四", "第三篇": "李四", "第四篇": "未知作者"}
+	for _, post := range posts {
+		if got := names[post.AuthorID]; got != want[post.Title] {
+			t.Errorf("%s 的作者是 %q（author_id=%d），期望 %q", post.Title, got, post.AuthorID, want[post.Title])
+		}
+	}
+	if len(users) != 3 || len(posts) != 4 {
+		t.Fatalf("迁移后有%d个用户、%d个帖子，期望3个用户、4个帖子", len(users), len(posts))
+	}
+
+	// 原来作者不存在的帖子可以正常修改，不会因为ErrAuthorNotFound被拒绝
+	var orphan Post
+	for _, post := range posts {
+		if post.Title == "第二篇" {
+			orphan = post
+		}
+	}
+	orphan.Content = "修改后的内容"
+	if err := s.UpdatePost(&orphan); err != nil {
+		t.Errorf("修改迁移后的帖子失败: %v", err)
+	}
+}
+
+// TestUserPostsAndExpand：用户的帖子列表只包含该用户的帖子，expand=author为每个帖子附上正确的作者
+func TestUserPostsAndExpand(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			server := newAPITestServer(t, kind)
+			authors := make(map[int]string)
+			for _, name := range []string{"张三", "李四", "王五"} {
+				id, err := server.create("/users", fmt.Sprintf(`{"name": %q, "email": "user@example.com", "age": 30}`, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				authors[id] = name
+				for i := 0; i < 2; i++ {
+					if _, err := server.create("/posts", fmt.Sprintf(`{"title": "%s的帖子%d", "content": "内容", "author_id": %d}`, name, i, id)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for id, name := range authors {
+				resp, body := server.do(http.MethodGet, fmt.Sprintf("/users/%d/posts?expand=author", id), "")
+				var posts []PostWithAuthor
+				if err := json.Unmarshal(body, &posts); err != nil || resp.StatusCode != http.StatusOK {
+					t.Fatalf("GET /users/%d/posts 返回 %d: %s", id, resp.StatusCode, body)
+				}
+				if len(posts) != 2 {
+					t.Errorf("%s 有 %d 个帖子，期望 2 个", name, len(posts))
+				}
+				for _, post := range posts {
+					if post.AuthorID != id || post.Author == nil || post.Author.Name != name {
+						t.Errorf("%s 的帖子列表中出现了 %+v", name, post)
+					}
+				}
+			}
+
+			resp, body := server.do(http.MethodGet, "/posts?expand=author&limit=4", "")
+			var posts []PostWithAuthor
+			if err := json.Unmarshal(body, &posts); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /posts 返回 %d: %s", resp.StatusCode, body)
+			}
+			for _, post := range posts {
+				if post.Author == nil || post.Author.Name != authors[post.AuthorID] {
+					t.Errorf("帖子 %d 展开的作者是 %+v，期望 %s", post.ID, post.Author, authors[post.AuthorID])
+				}
+			}
+			if resp, _ := server.do(http.MethodGet, "/users/999/posts", ""); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET /users/999/posts 返回 %d，期望 404", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// errInjected：failingStore模拟的存储故障
+var errInjected = errors.New("模拟的存储故障")
+
+// failingStore：在指定的调用上返回错误的存储，用于验证存储在请求中途出错时的处理
+type failingStore struct {
+	Store
+	failCreateUser int  // 事务中第几次CreateUser返回错误，0表示不出错
+	failListAfter  bool // 为true时ListUsersAfter只能读取第一批，之后的批次返回错误
+}
+
+// Begin：返回的事务按failCreateUser注入错误
+func (s *failingStore) Begin() (Tx, error) {
+	tx, err := s.Store.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &failingTx{Tx: tx, failAt: s.failCreateUser}, nil
+}
+
+// ListUsersAfter：afterID大于0说明已经读过第一批
+func (s *failingStore) ListUsersAfter(afterID, limit int) ([]User, error) {
+	if s.failListAfter && afterID > 0 {
+		return nil, errInjected
+	}
+	return s.Store.ListUsersAfter(afterID, limit)
+}
+
+// failingTx：第failAt次CreateUser返回错误的事务
+type failingTx struct {
+	Tx
+	failAt  int
+	created int
+}
+
+// CreateUser：计数并在第failAt次返回错误
+func (tx *failingTx) CreateUser(user *User) error {
+	tx.created++
+	if tx.created == tx.failAt {
+		return errInjected
+	}
+	return tx.Tx.CreateUser(user)
+}
+
+// storedCounts：返回存储中未删除的用户数和帖子数
+func storedCounts(t *testing.T) (users, posts int) {
+	t.Helper()
+	users, posts, err := store.Count(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users, posts
+}
+
+// TestImportRowErrors：任何一行有问题时返回422，按行号列出每个出错行，不导入任何数据
+func TestImportRowErrors(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	authorID, err := server.create("/users", `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		rows        []int // 期望报告错误的行号
+	}{
+		{
+			name:        "CSV字段错误和列数不符",
+			target:      "/users:import",
+			contentType: "text/csv",
+			body:        "name,email,age\n李四,lisi@example.com,30\n,bad-email,abc\n王五,wangwu@example.com\n",
+			rows:        []int{3, 4},
+		},
+		{
+			name:        "NDJSON字段错误和格式错误",
+			target:      "/users:import",
+			contentType: "application/x-ndjson",
+			body:        `{"name": "李四", "email": "lisi@example.com", "age": 30}` + "\n" + `{"name": "", "email": "x@example.com", "age": 200}` + "\n" + `{not json` + "\n",
+			rows:        []int{2, 3},
+		},
+		{
+			name:        "帖子的作者不存在",
+			target:      "/posts:import",
+			contentType: "text/csv",
+			body:        fmt.Sprintf("title,content,author_id\n标题一,内容,%d\n标题二,内容,999\n", authorID),
+			rows:        []int{3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := server.do(http.MethodPost, tt.target, tt.body, server.auth(), "Content-Type: "+tt.contentType)
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("返回 %d，期望 422: %s", resp.StatusCode, body)
+			}
+			var problem Problem
+			if err := json.Unmarshal(body, &problem); err != nil {
+				t.Fatal(err)
+			}
+			var rows []int
+			for _, rowErr := range problem.Rows {
+				rows = append(rows, rowErr.Row)
+				if len(rowErr.Errors) == 0 {
+					t.Errorf("第%d行没有列出错误原因", rowErr.Row)
+				}
+			}
+			if fmt.Sprint(rows) != fmt.Sprint(tt.rows) {
+				t.Errorf("报告的出错行是 %v，期望 %v", rows, tt.rows)
+			}
+			if users, posts := storedCounts(t); users != 1 || posts != 0 {
+				t.Errorf("导入失败后有%d个用户、%d个帖子，期望没有导入任何数据", users, posts)
+			}
+		})
+	}
+}
+
+// TestImportRollsBackOnStorageError：校验通过后写入第3行时存储出错，已经写入的前两行也被撤销
+func TestImportRollsBackOnStorageError(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			server := newAPITestServer(t, kind)
+			healthy := store
+			setGlobal(t, &store, Store(&failingStore{Store: healthy, failCreateUser: 3}))
+
+			var csv strings.Builder
+			csv.WriteString("name,email,age\n")
+			for i := 1; i <= 5; i++ {
+				fmt.Fprintf(&csv, "用户%d,user%d@example.com,30\n", i, i)
+			}
+			resp, body := server.do(http.MethodPost, "/users:import", csv.String(), server.auth(), "Content-Type: text/csv")
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Fatalf("返回 %d，期望 500: %s", resp.StatusCode, body)
+			}
+			if users, _ := storedCounts(t); users != 0 {
+				t.Errorf("写入中途失败后存储中有%d个用户，期望0个", users)
+			}
+
+			// 存储恢复后重新提交同一个文件，全部导入且没有重复
+			store = healthy
+			resp, body = server.do(http.MethodPost, "/users:import", csv.String(), server.auth(), "Content-Type: text/csv")
+			var result ImportResult
+			if err := json.Unmarshal(body, &result); err != nil || resp.StatusCode != http.StatusCreated || result.Imported != 5 {
+				t.Fatalf("重新导入返回 %d: %s", resp.StatusCode, body)
+			}
+			if users, _ := storedCounts(t); users != 5 {
+				t.Errorf("重新导入后存储中有%d个用户，期望5个", users)
+			}
+		})
+	}
+}
+
+// importTestUsers：通过NDJSON导入n个用户
+func importTestUsers(t *testing.T, server *apiServer, n int) {
+	t.Helper()
+	var ndjson strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&ndjson, `{"name": "用户%d", "email": "user%d@example.com", "age": 30}`+"\n", i, i)
+	}
+	resp, body := server.do(http.MethodPost, "/users:import", ndjson.String(), server.auth(), "Content-Type: application/x-ndjson")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("导入用户返回 %d: %s", resp.StatusCode, body)
+	}
+}
+
+// TestExportUsers：导出跨越多个批次的全部用户，按ID升序，CSV带表头；批量请求中不能调用导出
+func TestExportUsers(t *testing.T) {
+	server := newAPITestServer(t, "sqlite")
+	n := exportBatchSize*2 + 7
+	importTestUsers(t, server, n)
+
+	for _, format := range []string{"csv", "ndjson"} {
+		resp, body := server.do(http.MethodGet, "/users:export?format="+format, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("导出%s返回 %d: %s", format, resp.StatusCode, body)
+		}
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if format == "csv" {
+			if lines[0] != "id,name,email,age,created,version" {
+				t.Errorf("CSV表头是 %q", lines[0])
+			}
+			lines = lines[1:]
+		}
+		if len(lines) != n {
+			t.Fatalf("%s导出了%d行，期望%d行", format, len(lines), n)
+		}
+		for i, line := range []string{lines[0], lines[n-1]} {
+			want := []string{"用户1", fmt.Sprintf("用户%d", n)}[i]
+			if !strings.Contains(line, want) {
+				t.Errorf("%s第%d行是 %q，期望包含 %q", format, []int{1, n}[i], line, want)
+			}
+		}
+	}
+
+	resp, body := server.do(http.MethodPost, "/batch", `{"mode": "best_effort", "operations": [{"method": "GET", "path": "/users:export"}]}`, server.auth())
+	var batch BatchResponse
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch.Results) != 1 {
+		t.Fatalf("批量请求返回 %d: %s", resp.StatusCode, body)
+	}
+	if batch.Results[0].Status != http.StatusBadRequest {
+		t.Errorf("批量请求中的导出返回 %d，期望 400", batch.Results[0].Status)
+	}
+}
+
+// syncBuffer：可以被服务器goroutine写入、被测试读取的日志缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestExportAbortIsLogged：导出中途存储出错时中断连接，客户端不会收到看似完整的文件，访问日志仍然记录这次请求
+func TestExportAbortIsLogged(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	importTestUsers(t, server, exportBatchSize+1)
+	setGlobal(t, &store, Store(&failingStore{Store: store, failListAfter: true}))
+	var logs syncBuffer
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	if _, _, err := server.send(http.MethodGet, "/users:export", ""); err == nil {
+		t.Error("导出中途失败时客户端应当读到错误，而不是完整的响应")
+	}
+	var entry struct {
+		Msg     string `json:"msg"`
+		Path    string `json:"path"`
+		Aborted bool   `json:"aborted"`
+	}
+	found := false
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Msg == "access" && entry.Path == "/users:export" {
+			found = entry.Aborted
+		}
+	}
+	if !found {
+		t.Errorf("访问日志中没有aborted为true的导出请求:\n%s", logs.String())
+	}
+}
+
+// runBatch：以管理员身份提交批量请求，返回状态码和解析后的响应
+func runBatch(t *testing.T, server *apiServer, body string) (int, BatchResponse) {
+	t.Helper()
+	resp, data := server.do(http.MethodPost, "/batch", body, server.auth())
+	var batch BatchResponse
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatalf("批量请求返回 %d: %s", resp.StatusCode, data)
+	}
+	return resp.StatusCode, batch
+}
+
+// batchStatuses：按顺序列出每个子请求的状态码
+func batchStatuses(batch BatchResponse) []int {
+	statuses := make([]int, len(batch.Results))
+	for i, result := range batch.Results {
+		statuses[i] = result.Status
+	}
+	return statuses
+}
+
+// batchWithFailure：第3个子请求校验失败的批量请求，第2个子请求引用第1个创建的用户
+const batchWithFailure = `{"mode": %q, "operations": [
+	{"id": "alice", "method": "POST", "path": "/users", "body": {"name": "爱丽丝", "email": "alice@example.com", "age": 30}},
+	{"method": "POST", "path": "/posts", "body": {"title": "第一篇帖子", "content": "内容", "author_id": "${alice.id}"}},
+	{"method": "POST", "path": "/users", "body": {"name": "", "email": "bad", "age": -1}},
+	{"method": "POST", "path": "/users", "body": {"name": "鲍勃", "email": "bob@example.com", "age": 40}}
+]}`
+
+// TestBatchAtomicRollback：atomic模式下第一个失败的子请求撤销之前的全部修改，之后的子请求不再执行
+func TestBatchAtomicRollback(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			server := newAPITestServer(t, kind)
+			status, batch := runBatch(t, server, fmt.Sprintf(batchWithFailure, batchAtomic))
+			if status != http.StatusMultiStatus || batch.Committed {
+				t.Errorf("返回 %d，committed=%v，期望 207 且没有提交", status, batch.Committed)
+			}
+			want := []int{http.StatusCreated, http.StatusCreated, http.StatusUnprocessableEntity, http.StatusFailedDependency}
+			if got := batchStatuses(batch); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("子请求状态码是 %v，期望 %v", got, want)
+			}
+			for i, result := range batch.Results {
+				if result.RolledBack != (i < 2) {
+					t.Errorf("第%d个子请求的rolled_back是 %v", i+1, result.RolledBack)
+				}
+			}
+			if users, posts := storedCounts(t); users != 0 || posts != 0 {
+				t.Errorf("回滚后存储中有%d个用户、%d个帖子，期望都没有", users, posts)
+			}
+		})
+	}
+}
+
+// TestBatchBestEffort：best_effort模式下每个子请求独立执行，失败的子请求不影响其他子请求
+func TestBatchBestEffort(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	status, batch := runBatch(t, server, fmt.Sprintf(batchWithFailure, batchBestEffort))
+	if status != http.StatusMultiStatus || !batch.Committed {
+		t.Errorf("返回 %d，committed=%v，期望 207 且已提交", status, batch.Committed)
+	}
+	want := []int{http.StatusCreated, http.StatusCreated, http.StatusUnprocessableEntity, http.StatusCreated}
+	if got := batchStatuses(batch); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("子请求状态码是 %v，期望 %v", got, want)
+	}
+	for i, result := range batch.Results {
+		if result.RolledBack {
+			t.Errorf("第%d个子请求被标记为rolled_back", i+1)
+		}
+	}
+	if users, posts := storedCounts(t); users != 2 || posts != 1 {
+		t.Errorf("存储中有%d个用户、%d个帖子，期望2个用户、1个帖子", users, posts)
+	}
+}
+
+// TestBatchRefs：${名称.字段}在path、headers和body中替换为之前子请求响应中的字段
+// body中恰好是一个引用的字符串替换为原始的JSON值（数字仍是数字），其他位置按文本替换
+func TestBatchRefs(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	status, batch := runBatch(t, server, `{"operations": [
+		{"id": "alice", "method": "POST", "path": "/users", "body": {"name": "爱丽丝", "email": "alice@example.com", "age": 30}},
+		{"id": "post", "method": "POST", "path": "/posts", "body": {"title": "${alice.name}的第一篇帖子", "content": "内容", "author_id": "${alice.id}"}},
+		{"method": "PUT", "path": "/users/${alice.id}", "headers": {"If-Match": "\"v${alice.version}\""},
+		 "body": {"name": "爱丽丝", "email": "alice@example.com", "age": 31}}
+	]}`)
+	if status != http.StatusOK || !batch.Committed {
+		t.Fatalf("返回 %d，子请求状态码 %v: %+v", status, batchStatuses(batch), batch.Results)
+	}
+	var user User
+	var post Post
+	if err := json.Unmarshal(batch.Results[0].Body, &user); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(batch.Results[1].Body, &post); err != nil {
+		t.Fatal(err)
+	}
+	if post.AuthorID != user.ID || post.Title != "爱丽丝的第一篇帖子" {
+		t.Errorf("帖子的author_id是 %d、标题是 %q，期望 %d 和 %q", post.AuthorID, post.Title, user.ID, "爱丽丝的第一篇帖子")
+	}
+	if etag := batch.Results[2].ETag; etag != versionETag(2) {
+		t.Errorf("修改后的ETag是 %s，期望 %s", etag, versionETag(2))
+	}
+
+	// 引用不存在或失败的子请求时，该子请求返回400，不会发送带有原样"${...}"的请求
+	status, batch = runBatch(t, server, `{"mode": "best_effort", "operations": [
+		{"id": "bad", "method": "POST", "path": "/users", "body": {"name": ""}},
+		{"method": "GET", "path": "/users/${bad.id}"},
+		{"method": "GET", "path": "/users/${nobody.id}"}
+	]}`)
+	want := []int{http.StatusUnprocessableEntity, http.StatusBadRequest, http.StatusBadRequest}
+	if got := batchStatuses(batch); status != http.StatusMultiStatus || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("返回 %d，子请求状态码 %v，期望 207 和 %v", status, got, want)
+	}
+}
+
+// TestBatchRateLimit：每个子请求消耗一次限流额度，剩余额度不足以执行整个批量请求时返回429，一个子请求也不执行
+func TestBatchRateLimit(t *testing.T) {
+	server := newAPITestServerWith(t, "memory", rateLimitOptions{Limit: 5, Window: time.Minute, Key: "ip"}, nil)
+	const threeUsers = `{"operations": [
+		{"method": "POST", "path": "/users", "body": {"name": "用户%[1]d", "email": "user%[1]d-1@example.com", "age": 30}},
+		{"method": "POST", "path": "/users", "body": {"name": "用户%[1]d", "email": "user%[1]d-2@example.com", "age": 30}},
+		{"method": "POST", "path": "/users", "body": {"name": "用户%[1]d", "email": "user%[1]d-3@example.com", "age": 30}}
+	]}`
+
+	resp, body := server.do(http.MethodPost, "/batch", fmt.Sprintf(threeUsers, 1), server.auth())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("第一个批量请求返回 %d: %s", resp.StatusCode, body)
+	}
+	if remaining := resp.Header.Get("RateLimit-Remaining"); remaining != "2" {
+		t.Errorf("执行3个子请求后RateLimit-Remaining是 %s，期望 2", remaining)
+	}
+
+	// 剩余2次：/batch本身扣除1次后只剩1次，不足以执行另外2个子请求
+	resp, body = server.do(http.MethodPost, "/batch", fmt.Sprintf(threeUsers, 2), server.auth())
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("额度不足时返回 %d（Retry-After: %q），期望 429 并带有Retry-After: %s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+	if users, _ := storedCounts(t); users != 3 {
+		t.Errorf("存储中有%d个用户，期望只有第一个批量请求创建的3个", users)
+	}
+}
+
+// TestRateLimit：超过限额返回429并带有Retry-After和RateLimit-*响应头；无效的密钥按客户端IP计数，先被限流再返回401
+func TestRateLimit(t *testing.T) {
+	const limit = 3
+	server := newAPITestServerWith(t, "memory", rateLimitOptions{Limit: limit, Window: time.Minute, Key: "apikey"}, nil)
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int // 额度用完之前每个请求的状态码
+	}{
+		{"有效的密钥", []string{server.auth()}, http.StatusOK},
+		{"无效的密钥", []string{"Authorization: Bearer guessed-key"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 1; i <= limit; i++ {
+				resp, body := server.do(http.MethodGet, "/users", "", tt.headers...)
+				if resp.StatusCode != tt.status {
+					t.Fatalf("第%d个请求返回 %d，期望 %d: %s", i, resp.StatusCode, tt.status, body)
+				}
+				if got, want := resp.Header.Get("RateLimit-Remaining"), fmt.Sprint(limit-i); got != want || resp.Header.Get("RateLimit-Limit") != fmt.Sprint(limit) {
+					t.Errorf("第%d个请求的RateLimit-Remaining是 %q，期望 %q", i, got, want)
+				}
+			}
+			resp, body := server.do(http.MethodGet, "/users", "", tt.headers...)
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("超过限额后返回 %d，期望 429: %s", resp.StatusCode, body)
+			}
+			retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > 60 {
+				t.Errorf("Retry-After是 %q，期望1到60秒", resp.Header.Get("Retry-After"))
+			}
+			if resp.Header.Get("RateLimit-Remaining") != "0" || resp.Header.Get("RateLimit-Reset") != resp.Header.Get("Retry-After") {
+				t.Errorf("429响应的RateLimit-Remaining是 %q、RateLimit-Reset是 %q",
+					resp.Header.Get("RateLimit-Remaining"), resp.Header.Get("RateLimit-Reset"))
+			}
+		})
+	}
+
+	// 无效的密钥和匿名请求共用客户端IP的额度
+	if resp, _ := server.do(http.MethodGet, "/users", ""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("同一IP的匿名请求返回 %d，期望 429", resp.StatusCode)
+	}
+	// 健康检查探针不限流
+	if resp, body := server.do(http.MethodGet, "/livez", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("额度用完后/livez返回 %d: %s", resp.StatusCode, body)
+	}
+}
+
+// TestRateLimiterSweep：窗口内没有请求的键会被清理，不会在map中无限累积
+func TestRateLimiterSweep(t *testing.T) {
+	const window = 20 * time.Millisecond
+	rl := NewRateLimiter(1, window)
+	for i := 0; i < 100; i++ {
+		rl.Take(fmt.Sprintf("ip:10.0.0.%d", i))
+	}
+	time.Sleep(2 * window)
+
+	if allowed, _, _ := rl.Take("ip:10.0.0.200"); !allowed {
+		t.Fatal("新的键被拒绝")
+	}
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if len(rl.requests) != 1 {
+		t.Errorf("窗口过去之后还保留着%d个键，期望只剩刚刚请求的1个", len(rl.requests))
+	}
+}
+
+// TestCORS：允许的源（含通配子域名）得到Access-Control-*响应头，其他源没有；预检请求不经过认证；响应总是带有Vary: Origin
+func TestCORS(t *testing.T) {
+	policy, err := NewCORSPolicy([]string{"https://app.example.com", "https://*.example.org"}, true, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newAPITestServerWith(t, "memory", rateLimitOptions{}, policy)
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		origin    string
+		preflight string // 预检请求的Access-Control-Request-Method
+		allowed   bool
+	}{
+		{"精确匹配", http.MethodGet, "/users", "https://app.example.com", "", true},
+		{"通配子域名", http.MethodGet, "/users", "https://app.example.org", "", true},
+		{"多级子域名", http.MethodGet, "/users", "https://a.b.example.org", "", true},
+		{"通配符不匹配主域名", http.MethodGet, "/users", "https://example.org", "", false},
+		{"协议不同", http.MethodGet, "/users", "http://app.example.org", "", false},
+		{"通配符部分不是主机名", http.MethodGet, "/users", "https://evil.com/.example.org", "", false},
+		{"未列出的源", http.MethodGet, "/users", "https://evil.com", "", false},
+		{"不是跨域请求", http.MethodGet, "/users", "", "", false},
+		{"需要密钥的路由的预检", http.MethodOptions, "/users", "https://app.example.org", http.MethodPost, true},
+		{"预检不允许的源", http.MethodOptions, "/users", "https://evil.com", http.MethodPost, false},
+		{"预检不存在的路由", http.MethodOptions, "/nowhere", "https://app.example.com", http.MethodPut, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.origin != "" {
+				headers = append(headers, "Origin: "+tt.origin)
+			}
+			if tt.preflight != "" {
+				headers = append(headers, "Access-Control-Request-Method: "+tt.preflight, "Access-Control-Request-Headers: authorization, content-type")
+			}
+			resp, body := server.do(tt.method, tt.target, "", headers...)
+			if tt.preflight != "" && resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("预检请求返回 %d，期望 204: %s", resp.StatusCode, body)
+			}
+			if tt.preflight == "" && resp.StatusCode != http.StatusOK {
+				t.Fatalf("返回 %d，期望 200: %s", resp.StatusCode, body)
+			}
+			if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Origin") {
+				t.Errorf("响应缺少Vary: Origin，Vary是 %q", resp.Header.Values("Vary"))
+			}
+
+			allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
+			if !tt.allowed {
+				if allowOrigin != "" {
+					t.Errorf("不允许的源得到了Access-Control-Allow-Origin: %s", allowOrigin)
+				}
+				return
+			}
+			if allowOrigin != tt.origin || resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("Access-Control-Allow-Origin是 %q、Allow-Credentials是 %q，期望回显 %q 并允许凭证",
+					allowOrigin, resp.Header.Get("Access-Control-Allow-Credentials"), tt.origin)
+			}
+			if tt.preflight == "" {
+				if !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "ETag") {
+					t.Errorf("Access-Control-Expose-Headers是 %q，期望包含ETag", resp.Header.Get("Access-Control-Expose-Headers"))
+				}
+				return
+			}
+			if resp.Header.Get("Access-Control-Allow-Methods") != tt.preflight || resp.Header.Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("Access-Control-Allow-Methods是 %q、Max-Age是 %q",
+					resp.Header.Get("Access-Control-Allow-Methods"), resp.Header.Get("Access-Control-Max-Age"))
+			}
+			if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+				t.Errorf("Access-Control-Allow-Headers是 %q，期望包含Authorization", resp.Header.Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
+
+// TestIdempotency：相同的Idempotency-Key和请求体重放第一次的响应而不再创建；同一个键用于不同的请求体返回422；键按API密钥隔离
+func TestIdempotency(t *testing.T) {
+	policy, err := NewCORSPolicy([]string{"https://app.example.com"}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newAPITestServerWith(t, "memory", rateLimitOptions{}, policy)
+	otherKey, _, err := apiKeys.Issue("other", []string{scopeUsersWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		zhangsan = `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`
+		lisi     = `{"name": "李四", "email": "lisi@example.com", "age": 30}`
+	)
+
+	first, firstBody := server.do(http.MethodPost, "/users", zhangsan, server.auth(), "Idempotency-Key: create-1")
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("第一次请求返回 %d: %s", first.StatusCode, firstBody)
+	}
+
+	steps := []struct {
+		name     string
+		body     string
+		headers  []string
+		status   int
+		replayed bool
+	}{
+		{"相同的键和请求体", zhangsan, []string{server.auth(), "Idempotency-Key: create-1"}, http.StatusCreated, true},
+		{"相同的键、不同的请求体", lisi, []string{server.auth(), "Idempotency-Key: create-1"}, http.StatusUnprocessableEntity, false},
+		{"过长的键", lisi, []string{server.auth(), "Idempotency-Key: " + strings.Repeat("k", maxIdempotencyKeyLen+1)}, http.StatusBadRequest, false},
+		{"其他调用方使用相同的键", lisi, []string{"X-API-Key: " + otherKey, "Idempotency-Key: create-1"}, http.StatusCreated, false},
+	}
+	for _, step := range steps {
+		resp, body := server.do(http.MethodPost, "/users", step.body, step.headers...)
+		if resp.StatusCode != step.status {
+			t.Fatalf("%s：返回 %d，期望 %d: %s", step.name, resp.StatusCode, step.status, body)
+		}
+		if replayed := resp.Header.Get("Idempotent-Replayed") == "true"; replayed != step.replayed {
+			t.Errorf("%s：Idempotent-Replayed是 %q", step.name, resp.Header.Get("Idempotent-Replayed"))
+		}
+		if !step.replayed {
+			continue
+		}
+		if !bytes.Equal(body, firstBody) {
+			t.Errorf("%s：重放的响应体 %s 与第一次的 %s 不同", step.name, body, firstBody)
+		}
+		for _, name := range []string{"ETag", "Location"} {
+			if resp.Header.Get(name) != first.Header.Get(name) {
+				t.Errorf("%s：重放的%s是 %q，第一次是 %q", step.name, name, resp.Header.Get(name), first.Header.Get(name))
+			}
+		}
+	}
+	if users, _ := storedCounts(t); users != 2 {
+		t.Errorf("存储中有%d个用户，期望2个（重放和422都不能创建用户）", users)
+	}
+
+	// 浏览器页面要能携带Idempotency-Key并读取Idempotent-Replayed
+	resp, _ := server.do(http.MethodOptions, "/users", "", "Origin: https://app.example.com", "Access-Control-Request-Method: POST", "Access-Control-Request-Headers: idempotency-key")
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), idempotencyHeader) {
+		t.Errorf("预检响应的Access-Control-Allow-Headers是 %q，期望包含%s", resp.Header.Get("Access-Control-Allow-Headers"), idempotencyHeader)
+	}
+	resp, _ = server.do(http.MethodPost, "/users", zhangsan, server.auth(), "Idempotency-Key: create-1", "Origin: https://app.example.com")
+	if !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), idempotentReplayedHeader) {
+		t.Errorf("Access-Control-Expose-Headers是 %q，期望包含%s", resp.Header.Get("Access-Control-Expose-Headers"), idempotentReplayedHeader)
+	}
+}
+
+// TestSoftDelete：删除把用户和级联的帖子移入回收站，恢复后原样可见，超过保留时长的记录被永久删除
+// deleted_at总是UTC时间，与服务器所在的时区无关
+func TestSoftDelete(t *testing.T) {
+	setGlobal(t, &time.Local, time.FixedZone("UTC+8", 8*60*60))
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			server := newAPITestServer(t, kind)
+			userID, err := server.create("/users", `{"name": "张三", "email": "zhangsan@example.com", "age": 25}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			postID, err := server.create("/posts", fmt.Sprintf(`{"title": "回收站测试", "content": "内容", "author_id": %d}`, userID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := fmt.Sprintf("/users/%d", userID)
+			post := fmt.Sprintf("/posts/%d", postID)
+			expect := func(method, target string, status int) []byte {
+				t.Helper()
+				resp, body := server.do(method, target, "", server.auth(), "If-Match: *")
+				if resp.StatusCode != status {
+					t.Fatalf("%s %s 返回 %d，期望 %d: %s", method, target, resp.StatusCode, status, body)
+				}
+				return body
+			}
+
+			expect(http.MethodDelete, user+"?posts=cascade", http.StatusNoContent)
+			expect(http.MethodGet, user, http.StatusNotFound)
+			expect(http.MethodGet, post, http.StatusNotFound)
+			if users, posts := storedCounts(t); users != 0 || posts != 0 {
+				t.Errorf("删除后仍能看到%d个用户、%d个帖子", users, posts)
+			}
+			if resp, _ := server.do(http.MethodGet, "/users?include=deleted", ""); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("匿名查看已删除的用户返回 %d，期望 401", resp.StatusCode)
+			}
+
+			var trash Trash
+			if err := json.Unmarshal(expect(http.MethodGet, "/trash", http.StatusOK), &trash); err != nil {
+				t.Fatal(err)
+			}
+			if len(trash.Users) != 1 || len(trash.Posts) != 1 {
+				t.Fatalf("回收站中有%d个用户、%d个帖子，期望各1个", len(trash.Users), len(trash.Posts))
+			}
+			for _, deletedAt := range []string{trash.Users[0].DeletedAt, trash.Posts[0].DeletedAt} {
+				at, err := time.Parse(time.RFC3339, deletedAt)
+				if err != nil || !strings.HasSuffix(deletedAt, "Z") || time.Since(at) > time.Minute {
+					t.Errorf("deleted_at是 %q，期望刚刚的UTC时间", deletedAt)
+				}
+			}
+
+			// 作者仍在回收站中时不能单独恢复帖子；恢复作者时级联删除的帖子一起恢复
+			expect(http.MethodPost, post+":restore", http.StatusConflict)
+			var restored User
+			if err := json.Unmarshal(expect(http.MethodPost, user+":restore", http.StatusOK), &restored); err != nil {
+				t.Fatal(err)
+			}
+			if restored.DeletedAt != "" {
+				t.Errorf("恢复后的用户仍带有deleted_at: %s", restored.DeletedAt)
+			}
+			expect(http.MethodGet, post, http.StatusOK)
+			expect(http.MethodPost, user+":restore", http.StatusNotFound)
+			var found []Post
+			if err := json.Unmarshal(expect(http.MethodGet, "/posts/search?q=回收站", http.StatusOK), &found); err != nil || len(found) != 1 {
+				t.Errorf("恢复后搜索到%d个帖子（%v），期望重新加入搜索索引", len(found), err)
+			}
+
+			// 永久删除：还没有超过保留时长的记录不受影响，超过之后无法再恢复
+			expect(http.MethodDelete, post, http.StatusNoContent)
+			if users, posts, err := store.PurgeDeleted(time.Now().Add(-time.Hour)); err != nil || users != 0 || posts != 0 {
+				t.Errorf("清理一小时前删除的记录：删除了%d个用户、%d个帖子（%v），期望没有", users, posts, err)
+			}
+			if _, posts, err := store.PurgeDeleted(time.Now().Add(time.Second)); err != nil || posts != 1 {
+				t.Errorf("清理全部过期记录：删除了%d个帖子（%v），期望1个", posts, err)
+			}
+			expect(http.MethodPost, post+":restore", http.StatusNotFound)
+			if err := json.Unmarshal(expect(http.MethodGet, "/trash", http.StatusOK), &trash); err != nil || len(trash.Posts) != 0 {
+				t.Errorf("永久删除后回收站中还有%d个帖子", len(trash.Posts))
+			}
+		})
+	}
+}
+
+// TestReadiness：/readyz汇总各组件的检查结果，关键组件不可用或开始优雅关闭后返回503；/livez始终返回200
+func TestReadiness(t *testing.T) {
+	server := newAPITestServer(t, "memory")
+	failing := func(context.Context) error { return errors.New("连接被拒绝") }
+
+	tests := []struct {
+		name     string
+		extra    *healthCheck // 在store之外额外注册的检查
+		draining bool
+		status   int
+		report   string
+	}{
+		{"全部可用", nil, false, http.StatusOK, healthOK},
+		{"非关键组件不可用", &healthCheck{name: "cache", critical: false, check: failing}, false, http.StatusOK, healthDegraded},
+		{"关键组件不可用", &healthCheck{name: "queue", critical: true, check: failing}, false, http.StatusServiceUnavailable, healthUnavailable},
+		{"优雅关闭中", nil, true, http.StatusServiceUnavailable, healthDraining},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHealthChecker(0)
+			registerHealthChecks(hc, store)
+			if tt.extra != nil {
+				hc.Register(tt.extra.name, tt.extra.critical, time.Second, tt.extra.check)
+			}
+			if tt.draining {
+				hc.SetDraining()
+			}
+			setGlobal(t, &healthChecker, hc)
+
+			for _, target := range []string{"/readyz", "/health"} {
+				resp, body := server.do(http.MethodGet, target, "")
+				var report HealthReport
+				if err := json.Unmarshal(body, &report); err != nil {
+					t.Fatalf("GET %s: %v: %s", target, err, body)
+				}
+				if resp.StatusCode != tt.status || report.Status != tt.report {
+					t.Errorf("GET %s 返回 %d（%s），期望 %d（%s）", target, resp.StatusCode, report.Status, tt.status, tt.report)
+				}
+				if resp.Header.Get("Cache-Control") != "no-store" {
+					t.Errorf("GET %s 的Cache-Control是 %q，期望 no-store", target, resp.Header.Get("Cache-Control"))
+				}
+				if report.Components["store"].Status != componentUp {
+					t.Errorf("GET %s 报告store为 %+v", target, report.Components["store"])
+				}
+			}
+			if resp, body := server.do(http.MethodGet, "/livez", ""); resp.StatusCode != http.StatusOK {
+				t.Errorf("GET /livez 返回 %d: %s", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+// TestHealthCheckerTimeoutAndCache：卡住的检查在超时后按不可用处理，不拖慢其他检查；缓存期内不重复执行检查
+func TestHealthCheckerTimeoutAndCache(t *testing.T) {
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	var mu sync.Mutex
+	calls := 0
+	hc := NewHealthChecker(time.Hour)
+	hc.Register("stuck", true, 20*time.Millisecond, func(context.Context) error {
+		time.Sleep(time.Second) // 不遵守ctx的检查
+		return nil
+	})
+	hc.Register("counted", false, time.Second, func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return nil
+	})
+
+	start := time.Now()
+	report, ready := hc.Ready()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("检查耗时%v，超时的检查拖慢了探针", elapsed)
+	}
+	if ready || report.Components["stuck"].Status != componentDown || !strings.Contains(report.Components["stuck"].Error, "超时") {
+		t.Errorf("超时的关键组件报告为 %+v，就绪: %v", report.Components["stuck"], ready)
+	}
+	hc.Ready()
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("缓存期内检查执行了%d次，期望1次", calls)
+	}
+}
@@ -0,0 +1,31 @@
+// 主页脚本：订阅 /events 事件流，实时显示用户和帖子的变更
+// EventSource断线后会自动重连，并通过Last-Event-ID补发错过的事件
+(function () {
+  var list = document.getElementById("events");
+  if (!list || !window.EventSource) {
+    return;
+  }
+
+  var types = ["user.created", "user.updated", "user.deleted", "user.restored", "post.created", "post.updated", "post.deleted", "post.restored"];
+  var source = new EventSource("/events");
+
+  // show：在列表顶部插入一条事件，最多保留20条
+  function show(text) {
+    var item = document.createElement("li");
+    item.textContent = new Date().toLocaleTimeString() + "  " + text;
+    list.insertBefore(item, list.firstChild);
+    while (list.children.length > 20) {
+      list.removeChild(list.lastChild);
+    }
+  }
+
+  types.forEach(function (type) {
+    source.addEventListener(type, function (event) {
+      show(type + " " + event.data);
+    });
+  });
+  // reset：错过的事件已无法补发，提示刷新页面重新获取数据
+  source.addEventListener("reset", function () {
+    show("事件流已重置，请刷新页面获取最新数据");
+  });
+})();